@@ -0,0 +1,478 @@
+package bta
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Func holds the points of a function body, as built from its syntax.
+type Func struct {
+	Entry  Point
+	decl   *ast.FuncDecl
+	info   *types.Info
+	vars   []types.Object
+	points map[ast.Stmt][]Point
+}
+
+// FromFunc builds the points of a function body. Info must hold the Defs, Uses
+// and Implicits of decl. Only the variables local to the function are
+// tracked; everything else is taken to be static.
+func FromFunc(decl *ast.FuncDecl, info *types.Info) *Func {
+	f := &Func{decl: decl, info: info, points: map[ast.Stmt][]Point{}}
+	for id, obj := range info.Defs {
+		if f.local(obj) && id.Pos() >= decl.Pos() && id.Pos() < decl.End() {
+			f.vars = append(f.vars, obj)
+		}
+	}
+	for _, obj := range info.Implicits {
+		if f.local(obj) {
+			f.vars = append(f.vars, obj)
+		}
+	}
+	if decl.Body != nil {
+		b := &builder{Func: f, labels: map[string]*label{}}
+		b.findLabels(decl.Body)
+		f.Entry = b.stmt(decl.Body, nil)
+	}
+	return f
+}
+
+// Points gives the points that represent a statement. A statement that defines
+// several variables is represented by a point for each of them, in order. A
+// range statement is represented by its header and then the points that bind
+// its key and value, a switch by the test of each case in order, a case clause
+// by the point that binds the variable of a type switch, and a labelled
+// statement by the point that goto statements jump to.
+func (f *Func) Points(s ast.Stmt) []Point {
+	return f.points[s]
+}
+
+// Initial creates the division that a function body starts in. The parameters
+// are dynamic unless they are listed, as are the receiver and named results.
+// All other variables start out static.
+func (f *Func) Initial(static ...types.Object) Division {
+	d := Division{}
+	for _, v := range f.vars {
+		d[v] = true
+	}
+	for _, fields := range []*ast.FieldList{f.decl.Recv, f.decl.Type.Params, f.decl.Type.Results} {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			for _, name := range field.Names {
+				if obj := f.info.Defs[name]; obj != nil {
+					d[obj] = false
+				}
+			}
+		}
+	}
+	for _, v := range static {
+		d[v] = true
+	}
+	return d
+}
+
+func (f *Func) local(obj types.Object) bool {
+	v, ok := obj.(*types.Var)
+	return ok && !v.IsField() && v.Pos() >= f.decl.Pos() && v.Pos() < f.decl.End()
+}
+
+// node is a Point built from a statement.
+type node struct {
+	def     types.Object
+	uses    []types.Object
+	next    []Point
+	dynamic bool // which way control goes is never known
+}
+
+func (p *node) Next() []Point {
+	var res []Point
+	for _, q := range p.next {
+		if q != nil {
+			res = append(res, q)
+		}
+	}
+	return res
+}
+
+func (p *node) Defs() types.Object   { return p.def }
+func (p *node) Uses() []types.Object { return p.uses }
+
+// CouldBeTrue reports whether the variables a branch tests are all static.
+func (p *node) CouldBeTrue(d Division) bool {
+	if p.dynamic {
+		return false
+	}
+	for _, v := range p.uses {
+		if !d[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// A label is where a labelled statement begins, and where break and continue
+// statements referring to it go.
+type label struct {
+	start     *node
+	brk, cont Point
+}
+
+// builder creates points by working backwards through the statements of a
+// function, so that each statement's successor is known when it is reached.
+type builder struct {
+	*Func
+	brk, cont Point
+	labels    map[string]*label
+	label     *label // labelling the statement being built
+}
+
+func (b *builder) findLabels(s ast.Stmt) {
+	ast.Inspect(s, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.LabeledStmt:
+			b.labels[n.Label.Name] = &label{start: &node{}}
+		}
+		return true
+	})
+}
+
+func (b *builder) inLoop(brk, cont Point) *builder {
+	c := *b
+	c.brk, c.cont = brk, cont
+	return &c
+}
+
+func (b *builder) stmt(s ast.Stmt, next Point) Point {
+	l := b.label
+	if l != nil {
+		c := *b
+		c.label = nil
+		b = &c
+	}
+	switch s := s.(type) {
+	case nil, *ast.EmptyStmt:
+		return next
+
+	case *ast.BlockStmt:
+		for i := len(s.List) - 1; i >= 0; i-- {
+			next = b.stmt(s.List[i], next)
+		}
+		return next
+
+	case *ast.ExprStmt:
+		if def, uses := b.mutated(s.X); def != nil {
+			return b.add(s, []types.Object{def}, append(uses, b.uses(s.X)...), next)
+		}
+		return b.add(s, nil, b.uses(s.X), next)
+
+	case *ast.SendStmt:
+		return b.add(s, nil, b.uses(s.Chan, s.Value), next)
+
+	case *ast.GoStmt:
+		return b.add(s, nil, b.uses(s.Call), next)
+
+	case *ast.DeferStmt:
+		return b.add(s, nil, b.uses(s.Call), next)
+
+	case *ast.IncDecStmt:
+		def, uses := b.target(s.X)
+		return b.add(s, []types.Object{def}, append(uses, b.uses(s.X)...), next)
+
+	case *ast.AssignStmt:
+		var defs []types.Object
+		var uses [][]types.Object
+		for i, x := range s.Lhs {
+			def, u := b.target(x)
+			defs = append(defs, def)
+			if s.Tok != token.ASSIGN && s.Tok != token.DEFINE {
+				u = append(u, b.uses(x)...)
+			}
+			if len(s.Lhs) == len(s.Rhs) {
+				u = append(u, b.uses(s.Rhs[i])...)
+			} else {
+				u = append(u, b.uses(s.Rhs...)...)
+			}
+			uses = append(uses, u)
+		}
+		return b.addEach(s, defs, uses, next)
+
+	case *ast.DeclStmt:
+		decl, ok := s.Decl.(*ast.GenDecl)
+		if !ok || decl.Tok != token.VAR {
+			return next
+		}
+		var defs, uses []types.Object
+		for _, spec := range decl.Specs {
+			spec := spec.(*ast.ValueSpec)
+			for _, name := range spec.Names {
+				def, _ := b.target(name)
+				defs = append(defs, def)
+			}
+			uses = append(uses, b.uses(spec.Values...)...)
+		}
+		return b.add(s, defs, uses, next)
+
+	case *ast.ReturnStmt:
+		return b.add(s, nil, b.uses(s.Results...), nil)
+
+	case *ast.BranchStmt:
+		return b.branch(s, next)
+
+	case *ast.LabeledStmt:
+		l := b.labels[s.Label.Name]
+		l.brk = next
+		c := *b
+		c.label = l
+		l.start.next = []Point{c.stmt(s.Stmt, next)}
+		b.points[s] = []Point{l.start}
+		return l.start
+
+	case *ast.IfStmt:
+		then := b.stmt(s.Body, next)
+		els := b.stmt(s.Else, next)
+		p := b.add(s, nil, b.uses(s.Cond), then, els)
+		return b.stmt(s.Init, p)
+
+	case *ast.ForStmt:
+		header := &node{uses: b.uses(s.Cond)}
+		b.points[s] = []Point{header}
+		post := b.stmt(s.Post, header)
+		if l != nil {
+			l.cont = post
+		}
+		body := b.inLoop(next, post).stmt(s.Body, post)
+		header.next = []Point{body}
+		if s.Cond != nil {
+			header.next = append(header.next, next)
+		}
+		return b.stmt(s.Init, header)
+
+	case *ast.RangeStmt:
+		header := &node{uses: b.uses(s.X)}
+		b.points[s] = []Point{header}
+		if l != nil {
+			l.cont = header
+		}
+		body := b.inLoop(next, header).stmt(s.Body, header)
+		var binds []Point
+		for _, x := range []ast.Expr{s.Value, s.Key} {
+			if x == nil {
+				continue
+			}
+			def, uses := b.target(x)
+			body = &node{def: def, uses: append(uses, header.uses...), next: []Point{body}}
+			binds = append([]Point{body}, binds...)
+		}
+		b.points[s] = append(b.points[s], binds...)
+		header.next = []Point{body, next}
+		return header
+
+	case *ast.SwitchStmt:
+		var tag []types.Object
+		if s.Tag != nil {
+			tag = b.uses(s.Tag)
+		}
+		p := b.cases(s, s.Body, tag, next)
+		return b.stmt(s.Init, p)
+
+	case *ast.TypeSwitchStmt:
+		var x ast.Expr
+		switch a := s.Assign.(type) {
+		case *ast.AssignStmt:
+			x = a.Rhs[0]
+		case *ast.ExprStmt:
+			x = a.X
+		}
+		p := b.cases(s, s.Body, b.uses(x), next)
+		return b.stmt(s.Init, p)
+
+	case *ast.SelectStmt:
+		inner := b.inLoop(next, b.cont)
+		p := &node{dynamic: true}
+		b.points[s] = []Point{p}
+		for _, c := range s.Body.List {
+			c := c.(*ast.CommClause)
+			var body Point = next
+			for i := len(c.Body) - 1; i >= 0; i-- {
+				body = inner.stmt(c.Body[i], body)
+			}
+			p.next = append(p.next, inner.stmt(c.Comm, body))
+		}
+		return p
+	}
+	return next
+}
+
+// add creates the points for a statement that defines the given variables.
+func (b *builder) add(s ast.Stmt, defs, uses []types.Object, next ...Point) Point {
+	if len(defs) == 0 {
+		defs = []types.Object{nil}
+	}
+	each := make([][]types.Object, len(defs))
+	for i := range each {
+		each[i] = uses
+	}
+	return b.addEach(s, defs, each, next...)
+}
+
+// addEach is like add, for a statement that uses different variables to
+// define each one.
+func (b *builder) addEach(s ast.Stmt, defs []types.Object, uses [][]types.Object, next ...Point) Point {
+	points := make([]Point, len(defs))
+	var first, last *node
+	for i, def := range defs {
+		p := &node{def: def, uses: uses[i]}
+		if last != nil {
+			last.next = []Point{p}
+		} else {
+			first = p
+		}
+		last = p
+		points[i] = p
+	}
+	last.next = next
+	b.points[s] = points
+	return first
+}
+
+// target finds the variable that assigning to an expression defines, and the
+// variables the assignment uses to do so. Assigning to part of a variable uses
+// the rest of it.
+func (b *builder) target(x ast.Expr) (types.Object, []types.Object) {
+	switch x := x.(type) {
+	case *ast.Ident:
+		obj := b.info.Defs[x]
+		if obj == nil {
+			obj = b.info.Uses[x]
+		}
+		if !b.local(obj) {
+			return nil, nil
+		}
+		return obj, nil
+
+	case *ast.ParenExpr:
+		return b.target(x.X)
+
+	case *ast.IndexExpr:
+		def, uses := b.target(x.X)
+		return def, append(append(uses, b.uses(x.X)...), b.uses(x.Index)...)
+
+	case *ast.SelectorExpr:
+		def, uses := b.target(x.X)
+		return def, append(uses, b.uses(x.X)...)
+	}
+	return nil, b.uses(x)
+}
+
+// mutated finds the variable whose elements a call to copy or delete changes,
+// and the variables it uses to do so, as if the call assigned to it.
+func (b *builder) mutated(x ast.Expr) (types.Object, []types.Object) {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok || len(call.Args) != 2 {
+		return nil, nil
+	}
+	fun, ok := ast.Unparen(call.Fun).(*ast.Ident)
+	if !ok {
+		return nil, nil
+	}
+	if f, ok := b.info.Uses[fun].(*types.Builtin); !ok || f.Name() != "copy" && f.Name() != "delete" {
+		return nil, nil
+	}
+	return b.target(call.Args[0])
+}
+
+// uses finds the local variables that expressions refer to.
+func (b *builder) uses(xs ...ast.Expr) []types.Object {
+	var res []types.Object
+	for _, x := range xs {
+		if x == nil {
+			continue
+		}
+		ast.Inspect(x, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if obj := b.info.Uses[id]; b.local(obj) {
+					res = append(res, obj)
+				}
+			}
+			return true
+		})
+	}
+	return res
+}
+
+func (b *builder) branch(s *ast.BranchStmt, next Point) Point {
+	var target Point
+	switch s.Tok {
+	case token.BREAK:
+		target = b.brk
+		if s.Label != nil {
+			target = b.labels[s.Label.Name].brk
+		}
+	case token.CONTINUE:
+		target = b.cont
+		if s.Label != nil {
+			target = b.labels[s.Label.Name].cont
+		}
+	case token.GOTO:
+		target = b.labels[s.Label.Name].start
+	case token.FALLTHROUGH:
+		// the start of the next case
+		target = next
+	}
+	p := &node{next: []Point{target}}
+	b.points[s] = []Point{p}
+	return p
+}
+
+// cases creates a point for each case of a switch, testing the tag along with
+// the expressions of the case.
+func (b *builder) cases(s ast.Stmt, body *ast.BlockStmt, tag []types.Object, next Point) Point {
+	inner := b.inLoop(next, b.cont)
+	clauses := body.List
+	bodies := make([]Point, len(clauses))
+	follow := next
+	for i := len(clauses) - 1; i >= 0; i-- {
+		c := clauses[i].(*ast.CaseClause)
+		var p Point = next
+		for j := len(c.Body) - 1; j >= 0; j-- {
+			stmt := c.Body[j]
+			if br, ok := stmt.(*ast.BranchStmt); ok && br.Tok == token.FALLTHROUGH {
+				p = inner.branch(br, follow)
+				continue
+			}
+			p = inner.stmt(stmt, p)
+		}
+		if obj := b.info.Implicits[c]; b.local(obj) {
+			p = &node{def: obj, uses: tag, next: []Point{p}}
+			b.points[c] = []Point{p}
+		}
+		bodies[i] = p
+		follow = p
+	}
+	var test Point = next
+	for i := len(clauses) - 1; i >= 0; i-- {
+		if clauses[i].(*ast.CaseClause).List == nil {
+			test = bodies[i]
+		}
+	}
+	var tests []Point
+	for i := len(clauses) - 1; i >= 0; i-- {
+		c := clauses[i].(*ast.CaseClause)
+		if c.List == nil {
+			continue
+		}
+		test = &node{uses: append(b.uses(c.List...), tag...), next: []Point{bodies[i], test}}
+		tests = append([]Point{test}, tests...)
+	}
+	if tests == nil {
+		test = &node{uses: tag, next: []Point{test}}
+		tests = []Point{test}
+	}
+	b.points[s] = tests
+	return test
+}
@@ -2,7 +2,6 @@ package bta
 
 import (
 	"go/types"
-	"log"
 )
 
 // Point represents a subject of control flow.
@@ -64,7 +63,6 @@ func (p *Graph) Division(d Division) map[Point]Division {
 				update(p, p.defs, res[p.point][d])
 			}
 			for _, q := range p.loopDeps {
-				log.Println(p, p.defs, q.point)
 				update(p, p.defs, q.point.CouldBeTrue(res[q.point]))
 			}
 		}
@@ -1,6 +1,9 @@
 package bta
 
 import (
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"go/types"
 	"testing"
 	"testing/quick"
@@ -174,3 +177,132 @@ func TestLoopWithoutSelfDep(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFromFunc(t *testing.T) {
+	for _, test := range []struct {
+		name, src string
+		static    []string
+		expected  map[string]bool
+	}{
+		{
+			"Straight",
+			`func f(x, y int) int {
+				a := x
+				b, c := y, a
+				return a + b + c
+			}`,
+			[]string{"x"},
+			map[string]bool{"a": true, "b": false, "c": true},
+		},
+		{
+			"StaticLoop",
+			`func f(n, x int) int {
+				s := 0
+				for i := 0; i < n; i++ {
+					s += x
+				}
+				return s
+			}`,
+			[]string{"n"},
+			map[string]bool{"i": true, "s": false},
+		},
+		{
+			"DynamicLoop",
+			`func f(n, x int) int {
+				s := 0
+				for i := 0; i < n; i++ {
+					s += x
+				}
+				return s
+			}`,
+			[]string{"x"},
+			map[string]bool{"i": false, "s": false},
+		},
+		{
+			"LabelledBreak",
+			`func f(n int, xs []int) int {
+				s := 0
+			outer:
+				for i := 0; ; i++ {
+					for _, x := range xs {
+						if x == n {
+							break outer
+						}
+					}
+					s += i
+				}
+				return s
+			}`,
+			[]string{"n"},
+			map[string]bool{"i": false, "s": false, "x": false},
+		},
+		{
+			"Switch",
+			`func f(n, x int) int {
+				y := 0
+				switch n {
+				case 1:
+					y = n
+					fallthrough
+				case 2:
+					y = y + x
+				default:
+					y = 3
+				}
+				return y
+			}`,
+			[]string{"n"},
+			map[string]bool{"y": false},
+		},
+		{
+			"Delete",
+			`func f(k int, x string) int {
+				m := map[string]int{"a": k}
+				n := len(m)
+				delete(m, x)
+				return n + len(m)
+			}`,
+			[]string{"k"},
+			map[string]bool{"m": false, "n": true},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "test.go", "package test\n"+test.src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &types.Info{
+				Defs:      map[*ast.Ident]types.Object{},
+				Uses:      map[*ast.Ident]types.Object{},
+				Implicits: map[ast.Node]types.Object{},
+			}
+			if _, err := new(types.Config).Check("test", fset, []*ast.File{file}, info); err != nil {
+				t.Fatal(err)
+			}
+			decl := file.Decls[0].(*ast.FuncDecl)
+			var static []types.Object
+			for id, obj := range info.Defs {
+				for _, name := range test.static {
+					if id.Name == name {
+						static = append(static, obj)
+					}
+				}
+			}
+			f := FromFunc(decl, info)
+			res := NewGraph(f.Entry).Division(f.Initial(static...))
+			actual := map[string]bool{}
+			for p, d := range res {
+				if v := p.Defs(); v != nil {
+					s, ok := actual[v.Name()]
+					actual[v.Name()] = d[v] && (s || !ok)
+				}
+			}
+			for name, s := range test.expected {
+				if actual[name] != s {
+					t.Errorf("%s: expected static %v, got %v", name, s, actual[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"slices"
+	"strings"
+
+	"github.com/bobappleyard/deflect/partial"
+)
+
+const directivePrefix = "//deflect:"
+
+// A request is a specialization that a directive asks for.
+type request struct {
+	pos    token.Pos
+	fn     string
+	static map[string]partial.Value
+}
+
+// scan collects the directives in the comments of the package.
+//
+// A specialize directive asks for a function to be specialized, and may appear
+// anywhere in the package:
+//
+//	//deflect:specialize Render(mode="html", width=80)
+//
+// A static directive in the doc comment of a function declares parameters to
+// be static, so that the function is specialized according to binding time
+// analysis, and the parameters must be given values:
+//
+//	//deflect:static mode width
+func (p *pkg) scan() error {
+	p.static = map[string][]string{}
+	docs := map[*ast.CommentGroup]*ast.FuncDecl{}
+	for _, f := range p.files {
+		for _, d := range f.Decls {
+			if d, ok := d.(*ast.FuncDecl); ok && d.Doc != nil && d.Recv == nil {
+				docs[d.Doc] = d
+			}
+		}
+	}
+	for _, f := range p.files {
+		for _, g := range f.Comments {
+			for _, c := range g.List {
+				if !strings.HasPrefix(c.Text, directivePrefix) {
+					continue
+				}
+				kind, args, _ := strings.Cut(c.Text[len(directivePrefix):], " ")
+				var err error
+				switch kind {
+				case "specialize":
+					err = p.specializeDirective(c.Slash, args)
+				case "static":
+					err = p.staticDirective(docs[g], args)
+				default:
+					err = fmt.Errorf("unknown directive %s", kind)
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %w", p.fset.Position(c.Slash), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *pkg) specializeDirective(pos token.Pos, args string) error {
+	args = strings.TrimSpace(args)
+	open := strings.Index(args, "(")
+	if open < 0 || !strings.HasSuffix(args, ")") {
+		return fmt.Errorf("specialize directive %q is not of the form name(values)", args)
+	}
+	fn := strings.TrimSpace(args[:open])
+	if !token.IsIdentifier(fn) {
+		return fmt.Errorf("%q is not a function name", fn)
+	}
+	static, err := p.parseStatic(args[open+1:len(args)-1], pos)
+	if err != nil {
+		return err
+	}
+	p.requests = append(p.requests, request{pos, fn, static})
+	return nil
+}
+
+func (p *pkg) staticDirective(decl *ast.FuncDecl, args string) error {
+	if decl == nil {
+		return fmt.Errorf("static directive must be in the doc comment of a function")
+	}
+	names := strings.Fields(args)
+	if names == nil {
+		return fmt.Errorf("static directive names no parameters")
+	}
+	for _, name := range names {
+		if !hasParam(decl, name) {
+			return fmt.Errorf("%s has no parameter %s", decl.Name.Name, name)
+		}
+	}
+	p.static[decl.Name.Name] = append(p.static[decl.Name.Name], names...)
+	return nil
+}
+
+func hasParam(decl *ast.FuncDecl, name string) bool {
+	for _, f := range decl.Type.Params.List {
+		for _, param := range f.Names {
+			if param.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// specializeAll produces the specializations that directives ask for.
+func (p *pkg) specializeAll() ([]*ast.FuncDecl, error) {
+	if p.requests == nil {
+		return nil, fmt.Errorf("no specialize directives in package %s", p.name)
+	}
+	// Each request is named before any is specialized, so that the functions
+	// that calls are specialized into do not take the names. Requests whose
+	// values give the same name are told apart by suffixes.
+	names := make([]string, len(p.requests))
+	for i, r := range p.requests {
+		decl, _, err := p.lookup(r.fn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.fset.Position(r.pos), err)
+		}
+		name := residualName(decl, r.static)
+		for {
+			j := slices.Index(names[:i], name)
+			if j < 0 {
+				break
+			}
+			if q := p.requests[j]; q.fn == r.fn && sameValues(q.static, r.static) {
+				return nil, fmt.Errorf("%s: %s is already specialized at %s", p.fset.Position(r.pos), r.fn, p.fset.Position(q.pos))
+			}
+			name += "_"
+		}
+		names[i] = name
+		p.calls.Reserve(name)
+	}
+	var decls []*ast.FuncDecl
+	for i, r := range p.requests {
+		decl, err := p.specialize(r.fn, r.static, names[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.fset.Position(r.pos), err)
+		}
+		decls = append(decls, decl)
+	}
+	return decls, nil
+}
+
+// sameValues reports whether two requests give the same static values.
+func sameValues(a, b map[string]partial.Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, v := range a {
+		if w, ok := b[name]; !ok || !v.Matches(w) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+// Command deflect specializes functions in a Go package, given the values of
+// some of their parameters. The residual functions are written to a new file
+// in the same package.
+//
+// Usage:
+//
+//	deflect -pkg ./foo -func Render -static 'mode="html",width=80' -o render_html.go
+//
+// The residual function is named after the function and the static values,
+// RenderHtml80 in this case, unless -name is given. Fields of struct
+// parameters may be given values too, as in -static 'opts.Width=80'. Values
+// are Go expressions in the scope of the function's file, so they may convert
+// to the package's types or be composite literals of them, as in
+// -static 'opts=Options{Width: 80}'.
+//
+// Without -func, the specializations asked for by directives in the package
+// are generated, which suits go generate:
+//
+//	//go:generate deflect -o render_gen.go
+//
+//	//deflect:specialize Render(mode="html", width=80)
+//
+// Calls to other functions and methods of the package with static arguments
+// are specialized as well. Those that only return something are replaced by
+// what they return, and the others call specialized functions that are written
+// along with the residual ones.
+//
+// A function's doc comment may also declare which of its parameters are
+// static, in which case it is specialized according to binding time analysis:
+//
+//	//deflect:static mode width
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"log"
+	"os"
+)
+
+var (
+	pkgDir   = flag.String("pkg", ".", "directory of the package containing the function")
+	funcName = flag.String("func", "", "name of the function to specialize (default those named by directives)")
+	static   = flag.String("static", "", "static parameter values, as a comma separated list of name=value")
+	name     = flag.String("name", "", "name of the residual function")
+	output   = flag.String("o", "", "file to write the residual functions to (default standard output)")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("deflect: ")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: deflect [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 || *funcName == "" && (*static != "" || *name != "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	pkg, err := load(*pkgDir, *output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var decls []*ast.FuncDecl
+	if *funcName != "" {
+		_, f, err := pkg.lookup(*funcName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		values, err := pkg.parseStatic(*static, f.Name.Pos())
+		if err != nil {
+			log.Fatal(err)
+		}
+		decl, err := pkg.specialize(*funcName, values, *name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		decls = append(decls, decl)
+	} else {
+		decls, err = pkg.specializeAll()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	decls = append(decls, pkg.calls.Funcs()...)
+	src, err := pkg.file(decls...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*output, src, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/bobappleyard/deflect/partial"
+)
+
+// A pkg is a package loaded from source.
+type pkg struct {
+	fset  *token.FileSet
+	name  string
+	files []*ast.File
+	info  *types.Info
+	types *types.Package
+	calls *partial.Package // that calls made by residual functions are specialized to
+
+	requests []request
+	static   map[string][]string // parameters declared static, by function
+}
+
+// load parses and type checks the package in a directory. The file that output
+// names is left out, as it holds the results of an earlier run.
+func load(dir, output string) (*pkg, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	skip := ""
+	if output != "" {
+		skip, _ = filepath.Abs(output)
+	}
+	p := &pkg{
+		fset: token.NewFileSet(),
+		name: bp.Name,
+		info: &types.Info{
+			Types:     map[ast.Expr]types.TypeAndValue{},
+			Defs:      map[*ast.Ident]types.Object{},
+			Uses:      map[*ast.Ident]types.Object{},
+			Implicits: map[ast.Node]types.Object{},
+		},
+	}
+	for _, name := range bp.GoFiles {
+		path := filepath.Join(bp.Dir, name)
+		if abs, _ := filepath.Abs(path); abs == skip {
+			continue
+		}
+		f, err := parser.ParseFile(p.fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		p.files = append(p.files, f)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(p.fset, "source", nil)}
+	p.types, err = conf.Check(bp.ImportPath, p.fset, p.files, p.info)
+	if err != nil {
+		return nil, err
+	}
+	p.calls = partial.NewPackage(p.files, p.info)
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// lookup finds a top level function, along with the file it is declared in.
+func (p *pkg) lookup(name string) (*ast.FuncDecl, *ast.File, error) {
+	for _, f := range p.files {
+		for _, d := range f.Decls {
+			if d, ok := d.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == name {
+				return d, f, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("no function %s in package %s", name, p.name)
+}
+
+// specialize produces the residual version of a function, named after the
+// function and its static parameters unless a name is given. A function with
+// parameters declared static is specialized offline, and must be given values
+// for exactly those parameters. Calls to other functions of the package are
+// specialized too, into the functions that p.calls.Funcs gives.
+func (p *pkg) specialize(fn string, static map[string]partial.Value, name string) (*ast.FuncDecl, error) {
+	decl, _, err := p.lookup(fn)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = residualName(decl, static)
+	}
+	p.calls.Reserve(name)
+	opts := []partial.Option{partial.Calls(p.calls), partial.Named(name)}
+	if declared := p.static[fn]; declared != nil {
+		for _, param := range declared {
+			if _, ok := static[param]; !ok {
+				return nil, fmt.Errorf("%s: static parameter %s has no value", fn, param)
+			}
+		}
+		for param := range static {
+			if !slices.Contains(declared, param) {
+				return nil, fmt.Errorf("%s: parameter %s is not declared static", fn, param)
+			}
+		}
+		d, err := partial.Divide(decl, p.info, declared)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, partial.Offline(d))
+	}
+	return partial.Specialize(decl, p.info, static, opts...)
+}
+
+// residualName joins the name of a function with the static values of its
+// parameters, in the order they are declared. Values of fields follow the
+// value of their parameter, in order of their names, and minus signs are
+// spelled out so that negative values are told apart. A name that the values
+// add nothing to is suffixed so as not to redeclare the function.
+func residualName(decl *ast.FuncDecl, static map[string]partial.Value) string {
+	var fields []string
+	for path := range static {
+		if strings.Contains(path, ".") {
+			fields = append(fields, path)
+		}
+	}
+	sort.Strings(fields)
+	name := decl.Name.Name
+	add := func(v partial.Value) {
+		src := strings.ReplaceAll(types.ExprString(v.Expr()), "-", " neg ")
+		words := strings.FieldsFunc(src, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, w := range words {
+			name += strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+	for _, f := range decl.Type.Params.List {
+		for _, param := range f.Names {
+			if v, ok := static[param.Name]; ok {
+				add(v)
+			}
+			for _, path := range fields {
+				if strings.HasPrefix(path, param.Name+".") {
+					add(static[path])
+				}
+			}
+		}
+	}
+	if name == decl.Name.Name {
+		name += "Residual"
+	}
+	return name
+}
+
+// file produces the source of a file in the package holding residual
+// functions.
+func (p *pkg) file(decls ...*ast.FuncDecl) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by deflect. DO NOT EDIT.\n\npackage %s\n", p.name)
+	if specs := p.imports(decls); specs != nil {
+		buf.WriteString("\nimport (\n")
+		for _, spec := range specs {
+			if spec.Name != nil {
+				buf.WriteString(spec.Name.Name + " ")
+			}
+			buf.WriteString(spec.Path.Value + "\n")
+		}
+		buf.WriteString(")\n")
+	}
+	for _, decl := range decls {
+		buf.WriteString("\n")
+		if err := format.Node(&buf, token.NewFileSet(), decl); err != nil {
+			return nil, err
+		}
+		buf.WriteString("\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+// imports finds the imports of the package that residual functions refer to.
+func (p *pkg) imports(decls []*ast.FuncDecl) []*ast.ImportSpec {
+	byName := map[string]*ast.ImportSpec{}
+	for _, f := range p.files {
+		for _, spec := range f.Imports {
+			obj := p.info.Implicits[spec]
+			if spec.Name != nil {
+				obj = p.info.Defs[spec.Name]
+			}
+			if obj != nil {
+				byName[obj.Name()] = spec
+			}
+		}
+	}
+	used := map[*ast.ImportSpec]bool{}
+	for _, decl := range decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if id, ok := sel.X.(*ast.Ident); ok && byName[id.Name] != nil {
+					used[byName[id.Name]] = true
+				}
+			}
+			return true
+		})
+	}
+	var specs []*ast.ImportSpec
+	for spec := range used {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Path.Value < specs[j].Path.Value
+	})
+	return specs
+}
+
+// parseStatic parses parameter values given as a comma separated list of
+// name=value pairs. The values are evaluated in the scope of the file that
+// holds pos, so they may be of the package's types or refer to its constants
+// and imports.
+func (p *pkg) parseStatic(s string, pos token.Pos) (map[string]partial.Value, error) {
+	res := map[string]partial.Value{}
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(s))
+	var errs scanner.ErrorList
+	var sc scanner.Scanner
+	sc.Init(file, []byte(s), errs.Add, 0)
+	start, depth := 0, 0
+	for {
+		pos, tok, _ := sc.Scan()
+		switch tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			depth--
+		case token.COMMA, token.EOF:
+			if depth > 0 {
+				break
+			}
+			end := len(s)
+			if tok == token.COMMA {
+				end = file.Offset(pos)
+			}
+			if err := p.parsePair(s[start:end], pos, res); err != nil {
+				return nil, err
+			}
+			start = end + 1
+		}
+		if tok == token.EOF {
+			break
+		}
+	}
+	if errs.Len() > 0 {
+		return nil, errs.Err()
+	}
+	return res, nil
+}
+
+// isPath reports whether s names a parameter, or a field of one as in
+// cfg.Mode.
+func isPath(s string) bool {
+	for _, name := range strings.Split(s, ".") {
+		if !token.IsIdentifier(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pkg) parsePair(s string, pos token.Pos, values map[string]partial.Value) error {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	name, value, ok := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if !ok || !isPath(name) {
+		return fmt.Errorf("static value %q is not of the form name=value", s)
+	}
+	x, err := parser.ParseExprFrom(p.fset, "", value, 0)
+	if err != nil {
+		return fmt.Errorf("static value for %s: %w", name, err)
+	}
+	info := &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Uses:  map[*ast.Ident]types.Object{},
+	}
+	if err := types.CheckExpr(p.fset, p.types, pos, x, info); err != nil {
+		return fmt.Errorf("static value for %s: %w", name, err)
+	}
+	v, err := partial.ConstantIn(x, info, p.types)
+	if err != nil {
+		return fmt.Errorf("static value for %s: %w", name, err)
+	}
+	values[name] = v
+	return nil
+}
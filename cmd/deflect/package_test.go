@@ -0,0 +1,406 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/bobappleyard/deflect/partial"
+)
+
+func TestParseStatic(t *testing.T) {
+	p, err := load(writePackage(t, `package render
+
+import "time"
+
+const Wide = 120
+
+type Options struct {
+	Indent int
+	Delay  time.Duration
+}
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := p.files[0].Name.Pos()
+	values, err := p.parseStatic(`mode="html", width=80,ok=true, opts.Indent=2, max=Wide, d=time.Second`, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]partial.Value{
+		"mode":        partial.String("html"),
+		"width":       partial.Int(80),
+		"ok":          partial.True,
+		"opts.Indent": partial.Int(2),
+		"max":         partial.Int(120),
+		"d":           partial.Int(1e9),
+	}
+	if len(values) != len(expected) {
+		t.Fatalf("expected %d values, got %d", len(expected), len(values))
+	}
+	for name, v := range expected {
+		if w, ok := values[name]; !ok || !v.Matches(w) {
+			t.Errorf("%s: expected %v, got %v", name, v, w)
+		}
+	}
+	for _, s := range []string{"mode", "1=2", `mode="html`, "x=y", "opts.=1", "x=Options{Indent: y}", "x=int8(300)"} {
+		if _, err := p.parseStatic(s, pos); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestResidualName(t *testing.T) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p; func Render(mode string, width int, s string) string", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl := f.Decls[0].(*ast.FuncDecl)
+	for _, test := range []struct {
+		static   map[string]partial.Value
+		expected string
+	}{
+		{map[string]partial.Value{"width": partial.Int(80), "mode": partial.String("html")}, "RenderHtml80"},
+		{map[string]partial.Value{"width": partial.Int(-7)}, "RenderNeg7"},
+		{map[string]partial.Value{"width": partial.Int(7)}, "Render7"},
+		{map[string]partial.Value{"mode": partial.String("")}, "RenderResidual"},
+		{nil, "RenderResidual"},
+	} {
+		if name := residualName(decl, test.static); name != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, name)
+		}
+	}
+}
+
+func TestSpecializePackage(t *testing.T) {
+	dir := writePackage(t, `package render
+
+import "strings"
+
+func Render(mode string, width int, s string) string {
+	if width == 80 {
+		return strings.Repeat(s, width) + mode
+	}
+	return s
+}
+`)
+	out := filepath.Join(dir, "render_html.go")
+	if err := os.WriteFile(out, []byte("package render\n\nfunc broken() { undefined() }\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p, err := load(dir, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl, err := p.specialize("Render", map[string]partial.Value{
+		"mode":  partial.String("html"),
+		"width": partial.Int(80),
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.file(decl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `// Code generated by deflect. DO NOT EDIT.
+
+package render
+
+import (
+	"strings"
+)
+
+func RenderHtml80(s string) string {
+	return strings.Repeat(s, 80) + "html"
+}
+`
+	if string(res) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res)
+	}
+}
+
+func TestSpecializeAliasedImport(t *testing.T) {
+	dir := writePackage(t, `package render
+
+import img "image"
+
+func Origin(x, y int) img.Point {
+	return img.Point{X: x, Y: y}
+}
+`)
+	p, err := load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl, err := p.specialize("Origin", map[string]partial.Value{"x": partial.Int(1)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.file(decl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `// Code generated by deflect. DO NOT EDIT.
+
+package render
+
+import (
+	img "image"
+)
+
+func Origin1(y int) img.Point {
+	return img.Point{X: 1, Y: y}
+}
+`
+	if string(res) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res)
+	}
+}
+
+func TestSpecializeMistyped(t *testing.T) {
+	dir := writePackage(t, `package render
+
+func Render(mode string, width int, s string) string {
+	return mode + s
+}
+`)
+	p, err := load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, static := range []map[string]partial.Value{
+		{"width": partial.String("a")},
+		{"mode": partial.Int(1)},
+		{"width": partial.Float(1.5)},
+	} {
+		if _, err := p.specialize("Render", static, ""); err == nil {
+			t.Errorf("%v: expected an error", static)
+		}
+	}
+}
+
+func TestSpecializeTyped(t *testing.T) {
+	dir := writePackage(t, `package render
+
+type Options struct {
+	Indent int
+	Bullet string
+}
+
+func Render(n int8, opts Options, s string) string {
+	if n > 2 {
+		return opts.Bullet + s
+	}
+	return s
+}
+`)
+	p, err := load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := p.parseStatic(`n=int8(3), opts=Options{Indent: 2, Bullet: "-"}`, p.files[0].Name.Pos())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl, err := p.specialize("Render", static, "RenderList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.file(decl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `// Code generated by deflect. DO NOT EDIT.
+
+package render
+
+func RenderList(s string) string {
+	return "-" + s
+}
+`
+	if string(res) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res)
+	}
+}
+
+func writePackage(t *testing.T, src string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "render.go"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDirectives(t *testing.T) {
+	dir := writePackage(t, `package render
+
+//go:generate deflect -o render_gen.go
+
+//deflect:specialize Render(mode="html", width=80)
+//deflect:specialize Render(mode="text", width=40)
+//deflect:specialize Pad(n=2)
+
+// Render renders s.
+//
+//deflect:static mode width
+func Render(mode string, width int, s string) string {
+	if width == 80 {
+		return s + mode
+	}
+	return s
+}
+
+func Pad(n int, s string) string {
+	return s + s
+}
+`)
+	p, err := load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls, err := p.specializeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.file(decls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `// Code generated by deflect. DO NOT EDIT.
+
+package render
+
+func RenderHtml80(s string) string {
+	return s + "html"
+}
+
+func RenderText40(s string) string {
+	return s
+}
+
+func Pad2(s string) string {
+	return s + s
+}
+`
+	if string(res) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res)
+	}
+}
+
+func TestSpecializeCalls(t *testing.T) {
+	dir := writePackage(t, `package render
+
+//deflect:specialize Render(width=3)
+//deflect:specialize Pad(n=2)
+
+func Render(width int, s string) string {
+	return Pad(width-1, s) + "|"
+}
+
+func Pad(n int, s string) string {
+	for i := 0; i < n; i = i + 1 {
+		s = " " + s
+	}
+	return s
+}
+`)
+	p, err := load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls, err := p.specializeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.file(append(decls, p.calls.Funcs()...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `// Code generated by deflect. DO NOT EDIT.
+
+package render
+
+func Render3(s string) string {
+	return Pad2_(s) + "|"
+}
+
+func Pad2(s string) string {
+	s = " " + s
+	s = " " + s
+	return s
+}
+
+func Pad2_(s string) string {
+	s = " " + s
+	s = " " + s
+	return s
+}
+`
+	if string(res) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res)
+	}
+}
+
+func TestDirectiveNames(t *testing.T) {
+	dir := writePackage(t, `package render
+
+//deflect:specialize Scale(x=-7)
+//deflect:specialize Scale(x=7)
+//deflect:specialize Scale(x=1.5)
+//deflect:specialize Scale(x=15)
+func Scale(x, y float64) float64 {
+	return x * y
+}
+`)
+	p, err := load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls, err := p.specializeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, decl := range decls {
+		names = append(names, decl.Name.Name)
+	}
+	expected := []string{"ScaleNeg7", "Scale7", "Scale15", "Scale15_"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestDirectiveErrors(t *testing.T) {
+	for _, src := range []string{
+		"package p\n\n//deflect:unknown\nfunc f(x int) {}\n",
+		"package p\n\n//deflect:static x\n\nfunc f(x int) {}\n",
+		"package p\n\n//deflect:static y\nfunc f(x int) {}\n",
+		"package p\n\n//deflect:specialize f x=1\nfunc f(x int) {}\n",
+	} {
+		if _, err := load(writePackage(t, src), ""); err == nil {
+			t.Errorf("expected an error for\n%s", src)
+		}
+	}
+	for _, src := range []string{
+		"package p\n\nfunc f(x int) {}\n",
+		"package p\n\n//deflect:specialize g(x=1)\nfunc f(x int) {}\n",
+		"package p\n\n//deflect:specialize f(x=1)\n//deflect:specialize f(x=1)\nfunc f(x int) {}\n",
+		"package p\n\n//deflect:specialize f(y=1)\n//deflect:static x\nfunc f(x, y int) {}\n",
+		"package p\n\n//deflect:specialize f(x=\"a\")\nfunc f(x int) {}\n",
+	} {
+		p, err := load(writePackage(t, src), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.specializeAll(); err == nil {
+			t.Errorf("expected an error for\n%s", src)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package partial
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+)
+
+// maxMake bounds the length of the known slices that make creates.
+const maxMake = 1 << 12
+
+// BuiltinValue is a predeclared function, as called in an expression whose
+// type is given. Calls to it are evaluated when enough of the arguments are
+// known, except for those to functions that have effects.
+type BuiltinValue struct {
+	baseValue
+	name   string
+	typ    types.Type // of the call
+	pkg    *types.Package
+	spread bool // the last argument is passed with ...
+}
+
+func (v *BuiltinValue) Expr() ast.Expr {
+	return &ast.Ident{Name: v.name}
+}
+
+func (v *BuiltinValue) Matches(w Value) bool {
+	u, ok := w.(*BuiltinValue)
+	return ok && u.name == v.name
+}
+
+func (v *BuiltinValue) Hash() uint64 {
+	return hashString(v.name)
+}
+
+func (v *BuiltinValue) Call(args []Value) []Value {
+	var res Value
+	switch v.name {
+	case "len", "cap":
+		if len(args) == 1 {
+			res = length(v.name, args[0])
+		}
+	case "append":
+		res = v.append(args)
+	case "make":
+		res = v.make(args)
+	case "min", "max":
+		res = v.extremum(args)
+	case "complex", "real", "imag":
+		res = v.complex(args)
+	}
+	if res != nil {
+		return []Value{res}
+	}
+	call := callExpr(v, args)
+	if v.spread {
+		call.Expr().(*ast.CallExpr).Ellipsis = 1
+	}
+	return []Value{call}
+}
+
+// append adds known elements to a known slice. When the slice has room for
+// them they are added to its array, and otherwise to a new one with no more
+// room than they need, as Go allows.
+func (v *BuiltinValue) append(args []Value) Value {
+	s, ok := v.typ.Underlying().(*types.Slice)
+	if !ok || len(args) == 0 {
+		return nil
+	}
+	var elems []Value
+	n := 0
+	switch x := args[0].(type) {
+	case *SliceValue:
+		elems, n = x.elems, x.len
+	case *nilValue:
+	default:
+		return nil
+	}
+	extra := args[1:]
+	if v.spread {
+		if len(extra) != 1 {
+			return nil
+		}
+		switch y := extra[0].(type) {
+		case *SliceValue:
+			extra = y.elems[:y.len]
+		case *nilValue:
+			extra = nil
+		case basicValue:
+			extra = stringBytes(y, s.Elem(), v.pkg)
+		default:
+			return nil
+		}
+	}
+	res := make([]Value, n, n+len(extra))
+	copy(res, elems)
+	for _, e := range extra {
+		if !static(e) {
+			return nil
+		}
+		res = append(res, assignable(e, s.Elem(), v.pkg))
+	}
+	if len(res) <= len(elems) {
+		res = append(res, elems[len(res):]...)
+	}
+	return &SliceValue{compositeValue{typ: v.typ, pkg: v.pkg}, res, n + len(extra)}
+}
+
+// stringBytes gives the bytes of a known string, as elements of a byte slice.
+func stringBytes(v basicValue, elem types.Type, pkg *types.Package) []Value {
+	b := []byte(constant.StringVal(v.basic().value))
+	res := make([]Value, len(b))
+	for i, c := range b {
+		res[i] = inPackage(makeValue(constant.MakeInt64(int64(c)), elem), pkg)
+	}
+	return res
+}
+
+// mutated gives the variable whose elements a call to copy or delete changes,
+// if the call names it.
+func mutated(x ast.Expr, objectOf func(*ast.Ident) types.Object) *ast.Ident {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok || len(call.Args) != 2 {
+		return nil
+	}
+	fun, ok := ast.Unparen(call.Fun).(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	if b, ok := objectOf(fun).(*types.Builtin); !ok || b.Name() != "copy" && b.Name() != "delete" {
+		return nil
+	}
+	id, _ := ast.Unparen(call.Args[0]).(*ast.Ident)
+	return id
+}
+
+// mutate gives the scope that follows a statement calling copy or delete to
+// change the elements of a variable's slice or map. A variable with a known
+// value keeps one if the elements it is given are known, and otherwise becomes
+// unknown.
+func mutate(x ast.Expr, scope ExecScope) ExecScope {
+	s, ok := scope.(objectScope)
+	if !ok {
+		return scope
+	}
+	id := mutated(x, s.objectOf)
+	if id == nil || !scope.Lookup(id.Name).Known() {
+		return scope
+	}
+	args := evalArgs(ast.Unparen(x).(*ast.CallExpr).Args, scope)
+	if v := mutation(args[0], args[1]); v != nil {
+		return scope.Bind(id.Name, v)
+	}
+	return scope.Bind(id.Name, &UnknownValue{&ast.Ident{Name: id.Name}})
+}
+
+// mutation gives the slice that copying known elements into a known slice
+// leaves, or the map that deleting a known key from a known map leaves. Copying
+// into a nil slice or deleting from a nil map does nothing.
+func mutation(dst, arg Value) Value {
+	switch dst := dst.(type) {
+	case *SliceValue:
+		elem := dst.typ.Underlying().(*types.Slice).Elem()
+		var src []Value
+		switch y := arg.(type) {
+		case *SliceValue:
+			src = y.elems[:y.len]
+		case *nilValue:
+		case basicValue:
+			src = stringBytes(y, elem, dst.pkg)
+		default:
+			return nil
+		}
+		elems := append([]Value(nil), dst.elems...)
+		for i := 0; i < dst.len && i < len(src); i++ {
+			if !static(src[i]) {
+				return nil
+			}
+			elems[i] = assignable(src[i], elem, dst.pkg)
+		}
+		return &SliceValue{dst.compositeValue, elems, dst.len}
+
+	case *MapValue:
+		if !static(arg) {
+			return nil
+		}
+		k := assignable(arg, dst.typ.Underlying().(*types.Map).Key(), dst.pkg)
+		res := &MapValue{compositeValue: dst.compositeValue}
+		for i, key := range dst.keys {
+			if !sameKey(key, k) {
+				res.keys = append(res.keys, key)
+				res.elems = append(res.elems, dst.elems[i])
+			}
+		}
+		return res
+
+	case *nilValue:
+		return dst
+	}
+	return nil
+}
+
+// make creates a slice of known length and capacity, or an empty map.
+func (v *BuiltinValue) make(args []Value) Value {
+	switch t := v.typ.Underlying().(type) {
+	case *types.Slice:
+		if len(args) < 2 {
+			return nil
+		}
+		n, ok := intValue(args[1])
+		c := n
+		if len(args) > 2 {
+			var cok bool
+			c, cok = intValue(args[2])
+			ok = ok && cok
+		}
+		zero := zeroValue(t.Elem(), v.pkg)
+		if !ok || n < 0 || n > c || c > maxMake || zero == nil {
+			return nil
+		}
+		elems := make([]Value, c)
+		for i := range elems {
+			elems[i] = zero
+		}
+		return &SliceValue{compositeValue{typ: v.typ, pkg: v.pkg}, elems, int(n)}
+
+	case *types.Map:
+		if len(args) > 1 && !args[1].Known() {
+			return nil
+		}
+		return &MapValue{compositeValue: compositeValue{typ: v.typ, pkg: v.pkg}}
+	}
+	return nil
+}
+
+// extremum finds the least or greatest of some values. The known values are
+// reduced to one, which is the result if no others are given.
+func (v *BuiltinValue) extremum(args []Value) Value {
+	op := token.LSS
+	if v.name == "max" {
+		op = token.GTR
+	}
+	var best Value
+	var rest []Value
+	for _, a := range args {
+		if _, ok := a.(basicValue); !ok {
+			rest = append(rest, a)
+			continue
+		}
+		if best == nil || a.Op(op, best).Matches(True) {
+			best = a
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best = assignable(best, v.typ, v.pkg)
+	if rest == nil {
+		return best
+	}
+	return callExpr(v, append(rest, best))
+}
+
+// complex applies complex, real or imag to known values.
+func (v *BuiltinValue) complex(args []Value) Value {
+	cs := make([]constant.Value, len(args))
+	for i, a := range args {
+		b, ok := a.(basicValue)
+		if !ok {
+			return nil
+		}
+		cs[i] = b.basic().value
+	}
+	switch {
+	case v.name == "complex" && len(cs) == 2:
+		return inPackage(makeValue(constant.BinaryOp(cs[0], token.ADD, constant.MakeImag(cs[1])), v.typ), v.pkg)
+	case v.name == "real" && len(cs) == 1:
+		return inPackage(makeValue(constant.Real(cs[0]), v.typ), v.pkg)
+	case v.name == "imag" && len(cs) == 1:
+		return inPackage(makeValue(constant.Imag(cs[0]), v.typ), v.pkg)
+	}
+	return nil
+}
+
+func intValue(v Value) (int64, bool) {
+	b, ok := v.(basicValue)
+	if !ok {
+		return 0, false
+	}
+	return constant.Int64Val(constant.ToInt(b.basic().value))
+}
+
+// panics reports whether an expression calls panic, after which the path
+// through the function goes no further.
+func panics(x ast.Expr, scope EvalScope) bool {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	id, ok := ast.Unparen(call.Fun).(*ast.Ident)
+	if !ok || id.Name != "panic" {
+		return false
+	}
+	tv, ok := typeOf(scope, call.Fun)
+	return ok && tv.IsBuiltin()
+}
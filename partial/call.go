@@ -0,0 +1,409 @@
+package partial
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+	"unicode"
+)
+
+// maxCallDepth bounds the number of calls that are specialized within each
+// other, as a recursive function can be specialized for ever more values.
+const maxCallDepth = 32
+
+// A Package holds the functions and methods declared in a package, so that
+// calls to them can be specialized along with the functions making them.
+type Package struct {
+	info  *types.Info
+	decls map[*types.Func]*ast.FuncDecl
+	names map[string]bool // that specialized functions cannot be given
+	specs []*specialization
+	roots []*ast.FuncDecl // specialized with Calls
+	depth int
+}
+
+// A specialization is a function specialized for the known values of some of
+// its parameters.
+type specialization struct {
+	decl    *ast.FuncDecl
+	static  []Value // by parameter, nil for those that remain
+	name    string
+	res     *ast.FuncDecl // nil until specialized
+	failed  bool
+	results []Value            // if the specialized function only returns them
+	inlined map[string][]Value // by the arguments for the other parameters
+}
+
+// NewPackage collects the functions and methods declared in the files of a
+// package. Info must hold the type information for the files. Generic
+// functions are left out.
+func NewPackage(files []*ast.File, info *types.Info) *Package {
+	p := &Package{
+		info:  info,
+		decls: map[*types.Func]*ast.FuncDecl{},
+		names: map[string]bool{},
+	}
+	for _, obj := range info.Defs {
+		if obj != nil {
+			p.names[obj.Name()] = true
+		}
+	}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			decl, ok := d.(*ast.FuncDecl)
+			if !ok || decl.Body == nil || decl.Type.TypeParams != nil {
+				continue
+			}
+			obj, ok := info.Defs[decl.Name].(*types.Func)
+			if !ok || obj.Type().(*types.Signature).RecvTypeParams().Len() != 0 {
+				continue
+			}
+			p.decls[obj] = decl
+		}
+	}
+	return p
+}
+
+// Calls specializes the calls that a function makes to the functions of a
+// package, where some of the arguments are known. A call is replaced by its
+// results if the specialized function does nothing but return them, and
+// otherwise calls the specialized function, which Funcs gives.
+func Calls(p *Package) Option {
+	return func(r *residual) {
+		r.calls = p
+	}
+}
+
+// Reserve keeps a name from being given to a specialized function.
+func (p *Package) Reserve(name string) {
+	p.names[name] = true
+}
+
+// Funcs gives the specialized functions that the functions specialized with
+// Calls(p) call, in the order they were created.
+func (p *Package) Funcs() []*ast.FuncDecl {
+	byName := map[string]*specialization{}
+	for _, s := range p.specs {
+		if s.res != nil {
+			byName[s.name] = s
+		}
+	}
+	used := map[*specialization]bool{}
+	var visit func(n ast.Node)
+	visit = func(n ast.Node) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if s := byName[id.Name]; s != nil && !used[s] {
+					used[s] = true
+					visit(s.res.Body)
+				}
+			}
+			return true
+		})
+	}
+	for _, decl := range p.roots {
+		visit(decl.Body)
+	}
+	var res []*ast.FuncDecl
+	for _, s := range p.specs {
+		if used[s] {
+			res = append(res, s.res)
+		}
+	}
+	return res
+}
+
+// FuncValue is a function declared in a package, or a method bound to its
+// receiver.
+type FuncValue struct {
+	baseValue
+	pkg  *Package
+	decl *ast.FuncDecl
+	typ  types.Type
+	recv Value // nil for functions
+}
+
+func (v *FuncValue) Expr() ast.Expr {
+	if v.recv == nil {
+		return &ast.Ident{Name: v.decl.Name.Name}
+	}
+	return selExpr(v.recv, v.decl.Name.Name).Expr()
+}
+
+func (v *FuncValue) Matches(w Value) bool {
+	if !v.Known() {
+		return !w.Known()
+	}
+	u, ok := w.(*FuncValue)
+	return ok && u.decl == v.decl && (v.recv == nil || v.recv.Matches(u.recv))
+}
+
+func (v *FuncValue) Known() bool {
+	return v.recv == nil || static(v.recv)
+}
+
+func (v *FuncValue) Hash() uint64 {
+	if !v.Known() {
+		return 0
+	}
+	return hashString(v.decl.Name.Name)
+}
+
+func (v *FuncValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *FuncValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *FuncValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+func (v *FuncValue) Call(args []Value) []Value {
+	return v.pkg.call(v, args)
+}
+
+// A callScope finds the functions whose calls can be specialized.
+type callScope interface {
+	function(id *ast.Ident, x ast.Expr, recv Value) *FuncValue
+}
+
+// function gives the function that an identifier refers to, or the method of
+// the receiver x if that is not nil, if calls to it can be specialized.
+func function(id *ast.Ident, x ast.Expr, recv Value, scope EvalScope) Value {
+	if s, ok := scope.(callScope); ok {
+		if f := s.function(id, x, recv); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// call specializes a call to a function for those of its arguments that are
+// known. It gives the results of the call, or a call in the residual program.
+func (p *Package) call(f *FuncValue, args []Value) []Value {
+	plain := []Value{callExpr(f, args)}
+	params := paramNames(f.decl.Recv, f.decl.Type.Params)
+	if f.recv != nil {
+		args = append([]Value{f.recv}, args...)
+	}
+	if f.typ.(*types.Signature).Variadic() || len(args) != len(params) || p.depth >= maxCallDepth {
+		return plain
+	}
+	known := make([]Value, len(args))
+	var dynamic []Value
+	for i, a := range args {
+		if params[i] == nil || params[i].Name == "_" || a.KnownRef() || !static(a) {
+			dynamic = append(dynamic, a)
+			continue
+		}
+		known[i] = assignable(a, p.info.TypeOf(params[i]), p.info.Defs[f.decl.Name].Pkg())
+	}
+	if len(dynamic) == len(args) {
+		return plain
+	}
+	s := p.specialize(f.decl, params, known)
+	if s == nil {
+		return plain
+	}
+	if results := p.inline(s, params, args); results != nil {
+		return results
+	}
+	return []Value{callExpr(&UnknownValue{&ast.Ident{Name: s.name}}, dynamic)}
+}
+
+// specialize specializes a function for the known values of some of its
+// parameters, unless it already has been. While a recursive function is being
+// specialized its residual version is nil. It gives nil if the function cannot
+// be specialized.
+func (p *Package) specialize(decl *ast.FuncDecl, params []*ast.Ident, known []Value) *specialization {
+	for _, s := range p.specs {
+		if s.decl == decl && sameArgs(s.static, known) {
+			if s.failed {
+				return nil
+			}
+			return s
+		}
+	}
+	s := &specialization{
+		decl:    decl,
+		static:  known,
+		name:    p.name(decl, known),
+		inlined: map[string][]Value{},
+	}
+	p.specs = append(p.specs, s)
+	values := map[string]Value{}
+	for i, v := range known {
+		if v != nil {
+			values[params[i].Name] = v
+		}
+	}
+	res, results, err := p.specializeCall(decl, values)
+	if err != nil {
+		s.failed = true
+		return nil
+	}
+	res.Name.Name = s.name
+	s.res, s.results = res, results
+	return s
+}
+
+// seed records that a function of the package is being specialized for static
+// values of its parameters, under a name, so that calls it makes to itself with
+// the same values are not specialized again. Methods, and functions given
+// values for fields of their parameters, are not recorded, as calls to them
+// could not be made to the residual function.
+func (p *Package) seed(decl *ast.FuncDecl, static map[string]Value, name string) *specialization {
+	obj, ok := p.info.Defs[decl.Name].(*types.Func)
+	if !ok || decl.Recv != nil || p.decls[obj] != decl {
+		return nil
+	}
+	params := paramNames(decl.Type.Params)
+	known := make([]Value, len(params))
+	for i, param := range params {
+		if param == nil {
+			continue
+		}
+		if v, ok := static[param.Name]; ok {
+			known[i] = assignable(v, p.info.TypeOf(param), obj.Pkg())
+		}
+	}
+	for path := range static {
+		if strings.Contains(path, ".") {
+			return nil
+		}
+	}
+	s := &specialization{
+		decl:    decl,
+		static:  known,
+		name:    name,
+		inlined: map[string][]Value{},
+	}
+	p.specs = append(p.specs, s)
+	return s
+}
+
+// specializeCall specializes a function as a call to it with some known
+// arguments, giving the results it returns if that is all it does. A method is
+// specialized as a function that takes its receiver as its first parameter.
+func (p *Package) specializeCall(decl *ast.FuncDecl, values map[string]Value) (*ast.FuncDecl, []Value, error) {
+	if decl.Recv != nil {
+		typ := *decl.Type
+		typ.Params = &ast.FieldList{List: append(append([]*ast.Field(nil), decl.Recv.List...), decl.Type.Params.List...)}
+		decl = &ast.FuncDecl{Name: decl.Name, Type: &typ, Body: decl.Body}
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	res, r, err := specializeDecl(decl, p.info, values, Calls(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(res.Body.List) != 1 || len(r.results) != 0 {
+		// Named results would be referred to by name.
+		return res, nil, nil
+	}
+	ret, _ := res.Body.List[0].(*ast.ReturnStmt)
+	return res, r.returns[ret], nil
+}
+
+// inline gives the results of a call to a specialized function that only
+// returns them, if the call can be replaced by them. The other arguments are
+// evaluated by the results rather than by the call, so they must be free of
+// effects.
+func (p *Package) inline(s *specialization, params []*ast.Ident, args []Value) []Value {
+	if s.results == nil {
+		return nil
+	}
+	values := map[string]Value{}
+	var key strings.Builder
+	referred := false
+	for i, a := range args {
+		if s.static[i] != nil {
+			values[params[i].Name] = s.static[i]
+			continue
+		}
+		if !pure(a.Expr()) {
+			return nil
+		}
+		if params[i] != nil && params[i].Name != "_" {
+			values[params[i].Name] = a
+			key.WriteString(types.ExprString(a.Expr()))
+			referred = true
+		}
+		key.WriteByte(0)
+	}
+	if !referred {
+		return s.results
+	}
+	results, ok := s.inlined[key.String()]
+	if !ok {
+		_, results, _ = p.specializeCall(s.decl, values)
+		s.inlined[key.String()] = results
+	}
+	return results
+}
+
+// name names a function specialized for some known arguments after the
+// function and the arguments, giving each a distinct name.
+func (p *Package) name(decl *ast.FuncDecl, known []Value) string {
+	name := decl.Name.Name
+	if decl.Recv != nil {
+		recv := p.info.Defs[decl.Name].Type().(*types.Signature).Recv().Type()
+		if ptr, ok := recv.(*types.Pointer); ok {
+			recv = ptr.Elem()
+		}
+		if named, ok := recv.(*types.Named); ok {
+			name = named.Obj().Name() + strings.ToUpper(name[:1]) + name[1:]
+		}
+	}
+	for _, v := range known {
+		if v == nil {
+			continue
+		}
+		if _, ok := v.(*ClosureValue); ok {
+			name += "Func"
+			continue
+		}
+		words := strings.FieldsFunc(types.ExprString(v.Expr()), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, w := range words {
+			name += strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+	for p.names[name] {
+		name += "_"
+	}
+	p.names[name] = true
+	return name
+}
+
+// paramNames gives the names of the parameters in some field lists, or nil for
+// those without names.
+func paramNames(lists ...*ast.FieldList) []*ast.Ident {
+	var names []*ast.Ident
+	for _, fields := range lists {
+		if fields == nil {
+			continue
+		}
+		for _, f := range fields.List {
+			if f.Names == nil {
+				names = append(names, nil)
+			}
+			names = append(names, f.Names...)
+		}
+	}
+	return names
+}
+
+func sameArgs(xs, ys []Value) bool {
+	for i := range xs {
+		if (xs[i] == nil) != (ys[i] == nil) || xs[i] != nil && !xs[i].Matches(ys[i]) {
+			return false
+		}
+	}
+	return true
+}
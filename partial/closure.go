@@ -0,0 +1,194 @@
+package partial
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// ClosureValue is a function literal, along with the scope it is evaluated in.
+// It is known if the variables of the enclosing function that it refers to are,
+// in which case the residual literal has their values in place of them.
+type ClosureValue struct {
+	baseValue
+	lit   *ast.FuncLit
+	typ   types.Type
+	scope *bindings
+	free  []string // variables of the enclosing function it refers to
+	res   *ast.FuncLit
+}
+
+// closure evaluates a function literal.
+func closure(lit *ast.FuncLit, scope EvalScope) Value {
+	b, ok := scope.(*bindings)
+	if !ok || b.res == nil {
+		return nil
+	}
+	var free []string
+	for _, id := range freeVars(lit, b.info) {
+		free = append(free, id.Name)
+	}
+	return &ClosureValue{lit: lit, typ: b.info.TypeOf(lit), scope: b, free: uniqueNames(free)}
+}
+
+func (v *ClosureValue) Expr() ast.Expr {
+	if v.res == nil {
+		v.res = v.lit
+		if lit, _, err := v.specialize(nil); err == nil {
+			v.res = lit
+		}
+	}
+	return v.res
+}
+
+func (v *ClosureValue) Matches(w Value) bool {
+	if !v.Known() {
+		return !w.Known()
+	}
+	u, ok := w.(*ClosureValue)
+	if !ok || u.lit != v.lit {
+		return false
+	}
+	for _, name := range v.free {
+		if !v.scope.Lookup(name).Matches(u.scope.Lookup(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *ClosureValue) Known() bool {
+	for _, name := range v.free {
+		if !static(v.scope.Lookup(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *ClosureValue) Hash() uint64 {
+	if !v.Known() {
+		return 0
+	}
+	h := uint64(v.lit.Pos())
+	for _, name := range v.free {
+		h = h*31 + v.scope.Lookup(name).Hash()
+	}
+	return h
+}
+
+func (v *ClosureValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *ClosureValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *ClosureValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+// Call gives the results of the closure in place of the call if that is all
+// the closure does. The arguments are then evaluated by the results, so they
+// must be free of effects.
+func (v *ClosureValue) Call(args []Value) []Value {
+	if pure(argsExpr(args)...) {
+		if _, results, err := v.specialize(args); err == nil && results != nil {
+			return results
+		}
+	}
+	return []Value{callExpr(v, args)}
+}
+
+// specialize generates the residual version of the closure, with its
+// parameters given values if args is not nil. It gives the results that the
+// closure returns if that is all it does.
+func (v *ClosureValue) specialize(args []Value) (*ast.FuncLit, []Value, error) {
+	scope := v.scope
+	r := scope.res.closure(v.lit, scope.info)
+	params := paramNames(v.lit.Type.Params)
+	if args != nil && (len(args) != len(params) || v.typ.(*types.Signature).Variadic()) {
+		return nil, nil, nil
+	}
+	for i, name := range params {
+		switch {
+		case name == nil || name.Name == "_":
+		case args != nil:
+			scope = scope.Bind(name.Name, args[i]).(*bindings)
+		default:
+			scope = scope.declare(name.Name)
+		}
+	}
+	for _, name := range r.results {
+		scope = scope.declare(name)
+	}
+	scope = scope.copy()
+	scope.allocs, scope.res = r.escapes(v.lit.Body, scope.info), r
+	body, _, err := r.block(newAnalyzer(v.lit.Body).analyze(v.lit.Body, nil), scope, path{})
+	if err != nil {
+		return nil, nil, err
+	}
+	lit := &ast.FuncLit{Type: v.lit.Type, Body: &ast.BlockStmt{List: prune(body)}}
+	if args == nil || len(lit.Body.List) != 1 || len(r.results) != 0 {
+		return lit, nil, nil
+	}
+	ret, _ := lit.Body.List[0].(*ast.ReturnStmt)
+	return lit, r.returns[ret], nil
+}
+
+// freeVars finds the references that a function literal makes to variables of
+// the enclosing function.
+func freeVars(lit *ast.FuncLit, info *types.Info) []*ast.Ident {
+	var refs []*ast.Ident
+	ast.Inspect(lit.Body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if v := variable(id, info); v != nil && (v.Pos() < lit.Pos() || v.Pos() >= lit.End()) {
+				refs = append(refs, id)
+			}
+		}
+		return true
+	})
+	return refs
+}
+
+// captured finds the variables that closures in a function body refer to and
+// that are assigned to after being declared. The closures could see them
+// change, so they are never known.
+func captured(body *ast.BlockStmt, info *types.Info) []string {
+	free := map[*types.Var]bool{}
+	ast.Inspect(body, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok {
+			for _, id := range freeVars(lit, info) {
+				free[variable(id, info)] = true
+			}
+		}
+		return true
+	})
+	var names []string
+	assigned := func(x ast.Expr) {
+		if id, ok := ast.Unparen(x).(*ast.Ident); ok {
+			if v, ok := info.Uses[id].(*types.Var); ok && free[v] {
+				names = append(names, id.Name)
+			}
+		}
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, x := range n.Lhs {
+				assigned(x)
+			}
+		case *ast.IncDecStmt:
+			assigned(n.X)
+		case *ast.RangeStmt:
+			for _, x := range []ast.Expr{n.Key, n.Value} {
+				if x != nil {
+					assigned(x)
+				}
+			}
+		}
+		return true
+	})
+	return uniqueNames(names)
+}
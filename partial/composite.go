@@ -0,0 +1,760 @@
+package partial
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+)
+
+// A compositeValue is a known value of a composite type. It refers to the
+// package being specialized so that it can name its type.
+type compositeValue struct {
+	baseValue
+	typ types.Type
+	pkg *types.Package
+}
+
+func (v *compositeValue) composite() *compositeValue {
+	return v
+}
+
+func (v *compositeValue) typeExpr() ast.Expr {
+	return typeExpr(v.typ, v.pkg)
+}
+
+// StructValue is a struct whose fields are each either known or not. Fields
+// that are not known refer to variables of the residual program, or to
+// expressions that can be evaluated any number of times.
+type StructValue struct {
+	compositeValue
+	fields []Value
+}
+
+func (v *StructValue) Matches(w Value) bool {
+	u, ok := w.(*StructValue)
+	return ok && types.Identical(v.typ, u.typ) && matchAll(v.fields, u.fields)
+}
+
+func (v *StructValue) Hash() uint64 {
+	return hashAll(v.fields)
+}
+
+func (v *StructValue) Expr() ast.Expr {
+	s := v.typ.Underlying().(*types.Struct)
+	lit := &ast.CompositeLit{Type: v.typeExpr()}
+	for i, f := range v.fields {
+		field := s.Field(i)
+		if zero := zeroValue(field.Type(), v.pkg); zero != nil && f.Matches(zero) {
+			continue
+		}
+		lit.Elts = append(lit.Elts, &ast.KeyValueExpr{
+			Key:   &ast.Ident{Name: field.Name()},
+			Value: valueExpr(f, field.Type()),
+		})
+	}
+	return lit
+}
+
+func (v *StructValue) Op(op token.Token, w Value) Value {
+	if !static(v) || !static(w) {
+		return opExpr(op, v, w)
+	}
+	return compareOp(v, op, w)
+}
+
+func (v *StructValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+// Member finds a field of the struct, including those promoted from embedded
+// structs. Methods are left to the residual program.
+func (v *StructValue) Member(name string) Value {
+	if f, ok := v.field(name); ok {
+		return f
+	}
+	return selExpr(v, name)
+}
+
+func (v *StructValue) field(name string) (Value, bool) {
+	s := v.typ.Underlying().(*types.Struct)
+	if i := fieldIndex(s, name); i >= 0 {
+		return v.fields[i], true
+	}
+	for i := 0; i < s.NumFields(); i++ {
+		if !s.Field(i).Embedded() {
+			continue
+		}
+		if e, ok := v.fields[i].(*StructValue); ok {
+			if f, ok := e.field(name); ok {
+				return f, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (v *StructValue) Call(args []Value) []Value {
+	return []Value{callExpr(v, args)}
+}
+
+// ArrayValue is an array whose elements are all known.
+type ArrayValue struct {
+	compositeValue
+	elems []Value
+}
+
+func (v *ArrayValue) Matches(w Value) bool {
+	u, ok := w.(*ArrayValue)
+	return ok && types.Identical(v.typ, u.typ) && matchAll(v.elems, u.elems)
+}
+
+func (v *ArrayValue) Hash() uint64 {
+	return hashAll(v.elems)
+}
+
+func (v *ArrayValue) Expr() ast.Expr {
+	elem := v.typ.Underlying().(*types.Array).Elem()
+	elems := v.elems
+	// Trailing zero elements are implied by the length of the array.
+	if zero := zeroValue(elem, v.pkg); zero != nil {
+		for len(elems) > 0 && elems[len(elems)-1].Matches(zero) {
+			elems = elems[:len(elems)-1]
+		}
+	}
+	return &ast.CompositeLit{Type: v.typeExpr(), Elts: elemExprs(elems, elem)}
+}
+
+func (v *ArrayValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *ArrayValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *ArrayValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+func (v *ArrayValue) Call(args []Value) []Value {
+	return []Value{callExpr(v, args)}
+}
+
+// SliceValue is a slice whose elements are all known. It holds the elements up
+// to its capacity.
+type SliceValue struct {
+	compositeValue
+	elems []Value
+	len   int
+}
+
+func (v *SliceValue) Matches(w Value) bool {
+	u, ok := w.(*SliceValue)
+	return ok && types.Identical(v.typ, u.typ) && v.len == u.len && matchAll(v.elems, u.elems)
+}
+
+func (v *SliceValue) Hash() uint64 {
+	return hashAll(v.elems)*31 + uint64(v.len)
+}
+
+// Expr gives the slice as a literal, sliced to its length if that is less than
+// its capacity.
+func (v *SliceValue) Expr() ast.Expr {
+	elem := v.typ.Underlying().(*types.Slice).Elem()
+	lit := &ast.CompositeLit{Type: v.typeExpr(), Elts: elemExprs(v.elems, elem)}
+	if v.len == len(v.elems) {
+		return lit
+	}
+	return &ast.SliceExpr{X: lit, High: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(v.len)}}
+}
+
+func (v *SliceValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *SliceValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *SliceValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+func (v *SliceValue) Call(args []Value) []Value {
+	return []Value{callExpr(v, args)}
+}
+
+// MapValue is a map whose keys and elements are all known. It holds them in
+// the order they were given, which is the order its literal lists them in.
+type MapValue struct {
+	compositeValue
+	keys, elems []Value
+}
+
+func (v *MapValue) Matches(w Value) bool {
+	u, ok := w.(*MapValue)
+	if !ok || !types.Identical(v.typ, u.typ) || len(v.keys) != len(u.keys) {
+		return false
+	}
+	for i, k := range v.keys {
+		if e, ok := u.lookup(k); !ok || !e.Matches(v.elems[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash does not depend on the order of the entries, as Matches does not.
+func (v *MapValue) Hash() uint64 {
+	var h uint64
+	for i, k := range v.keys {
+		h += k.Hash()*31 + v.elems[i].Hash()
+	}
+	return h
+}
+
+func (v *MapValue) Expr() ast.Expr {
+	m := v.typ.Underlying().(*types.Map)
+	keys := elemExprs(v.keys, m.Key())
+	elems := elemExprs(v.elems, m.Elem())
+	lit := &ast.CompositeLit{Type: v.typeExpr()}
+	for i, k := range keys {
+		lit.Elts = append(lit.Elts, &ast.KeyValueExpr{Key: k, Value: elems[i]})
+	}
+	return lit
+}
+
+func (v *MapValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *MapValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *MapValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+func (v *MapValue) Call(args []Value) []Value {
+	return []Value{callExpr(v, args)}
+}
+
+// lookup finds the element of the map with a key.
+func (v *MapValue) lookup(k Value) (Value, bool) {
+	k = assignable(k, v.typ.Underlying().(*types.Map).Key(), v.pkg)
+	for i, key := range v.keys {
+		if sameKey(key, k) {
+			return v.elems[i], true
+		}
+	}
+	return nil, false
+}
+
+// sorted gives the positions of the map's entries in order of their keys. Maps
+// whose keys are not all of basic type, or that cannot be compared with each
+// other, cannot be sorted.
+func (v *MapValue) sorted() ([]int, bool) {
+	var kind constant.Kind
+	for i, k := range v.keys {
+		c, ok := k.(basicValue)
+		if !ok {
+			return nil, false
+		}
+		ck := c.basic().value.Kind()
+		if ck == constant.Int || ck == constant.Float {
+			ck = constant.Float
+		}
+		if i > 0 && ck != kind || ck == constant.Complex {
+			return nil, false
+		}
+		kind = ck
+	}
+	order := make([]int, len(v.keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		x := v.keys[order[i]].(basicValue).basic().value
+		y := v.keys[order[j]].(basicValue).basic().value
+		if kind == constant.Bool {
+			return !constant.BoolVal(x) && constant.BoolVal(y)
+		}
+		return constant.Compare(x, token.LSS, y)
+	})
+	return order, true
+}
+
+// sameKey reports whether two keys pick out the same entry of a map. Keys held
+// in interfaces must also have the same type.
+func sameKey(k, l Value) bool {
+	if !k.Matches(l) {
+		return false
+	}
+	c, ok := k.(basicValue)
+	d, ok2 := l.(basicValue)
+	return !ok || !ok2 || types.Identical(c.basic().typ, d.basic().typ)
+}
+
+// nilValue is the zero value of pointers, slices, maps, channels, functions and
+// interfaces.
+type nilValue struct {
+	baseValue
+	typ types.Type
+}
+
+func (v *nilValue) Expr() ast.Expr {
+	return &ast.Ident{Name: "nil"}
+}
+
+func (v *nilValue) Matches(w Value) bool {
+	_, ok := w.(*nilValue)
+	return ok
+}
+
+func (v *nilValue) Hash() uint64 {
+	return 0
+}
+
+func (v *nilValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *nilValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *nilValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+func (v *nilValue) Call(args []Value) []Value {
+	return []Value{callExpr(v, args)}
+}
+
+// compareOp applies == and != to known composite values. Other operators are
+// left to the residual program.
+func compareOp(v Value, op token.Token, w Value) Value {
+	if !w.Known() || op != token.EQL && op != token.NEQ {
+		return opExpr(op, v, w)
+	}
+	return Bool(v.Matches(w) == (op == token.EQL))
+}
+
+// static reports whether a value is known throughout, rather than a struct with
+// some fields that are not known.
+func static(v Value) bool {
+	if v, ok := v.(*StructValue); ok {
+		for _, f := range v.fields {
+			if !static(f) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.Known()
+}
+
+// fieldVars finds the variables that hold the fields of a struct that are not
+// known.
+func fieldVars(v *StructValue) []string {
+	var names []string
+	for _, f := range v.fields {
+		switch f := f.(type) {
+		case *StructValue:
+			names = append(names, fieldVars(f)...)
+		case *UnknownValue:
+			if id, ok := f.expr.(*ast.Ident); ok {
+				names = append(names, id.Name)
+			}
+		}
+	}
+	return names
+}
+
+// withField gives a struct with a field, or a field of a field, replaced. It
+// gives nil if the field is not held as a StructValue.
+func withField(v *StructValue, path []string, w Value) *StructValue {
+	s := v.typ.Underlying().(*types.Struct)
+	i := fieldIndex(s, path[0])
+	if i < 0 {
+		return nil
+	}
+	if len(path) > 1 {
+		f, ok := v.fields[i].(*StructValue)
+		if !ok {
+			return nil
+		}
+		if w = withField(f, path[1:], w); w == nil {
+			return nil
+		}
+	}
+	fields := append([]Value(nil), v.fields...)
+	fields[i] = assignable(w, s.Field(i).Type(), v.pkg)
+	return &StructValue{v.compositeValue, fields}
+}
+
+// fieldPath finds the variable and fields that a selector expression refers
+// to, such as x, [a b] for x.a.b. The variable may be a pointer to the struct.
+func fieldPath(x ast.Expr) (string, []string, bool) {
+	var path []string
+	for {
+		switch y := ast.Unparen(x).(type) {
+		case *ast.SelectorExpr:
+			path = append([]string{y.Sel.Name}, path...)
+			x = y.X
+			continue
+		case *ast.StarExpr:
+			// The fields of a struct that a pointer points to.
+			x = y.X
+			continue
+		case *ast.Ident:
+			return y.Name, path, path != nil
+		}
+		return "", nil, false
+	}
+}
+
+func matchAll(xs, ys []Value) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i, x := range xs {
+		if !x.Matches(ys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hashAll(xs []Value) uint64 {
+	var h uint64
+	for _, x := range xs {
+		h = h*31 + x.Hash()
+	}
+	return h
+}
+
+// elemExprs gives the elements of an array or slice literal. The types of
+// composite elements are implied by the literal.
+func elemExprs(elems []Value, t types.Type) []ast.Expr {
+	res := make([]ast.Expr, len(elems))
+	for i, e := range elems {
+		res[i] = valueExpr(e, t)
+		if lit, ok := res[i].(*ast.CompositeLit); ok {
+			lit.Type = nil
+		}
+	}
+	return res
+}
+
+// zeroValue gives the zero value of a type, or nil if it has none that can be
+// known.
+func zeroValue(t types.Type, pkg *types.Package) Value {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch info := u.Info(); {
+		case info&types.IsBoolean != 0:
+			return inPackage(makeValue(constant.MakeBool(false), t), pkg)
+		case info&types.IsString != 0:
+			return inPackage(makeValue(constant.MakeString(""), t), pkg)
+		case info&types.IsNumeric != 0:
+			return inPackage(makeValue(constant.MakeInt64(0), t), pkg)
+		}
+
+	case *types.Struct:
+		fields := make([]Value, u.NumFields())
+		for i := range fields {
+			if fields[i] = zeroValue(u.Field(i).Type(), pkg); fields[i] == nil {
+				return nil
+			}
+		}
+		return &StructValue{compositeValue{typ: t, pkg: pkg}, fields}
+
+	case *types.Array:
+		zero := zeroValue(u.Elem(), pkg)
+		if zero == nil {
+			return nil
+		}
+		elems := make([]Value, u.Len())
+		for i := range elems {
+			elems[i] = zero
+		}
+		return &ArrayValue{compositeValue{typ: t, pkg: pkg}, elems}
+
+	case *types.Pointer, *types.Slice, *types.Map, *types.Chan, *types.Signature, *types.Interface:
+		return &nilValue{typ: t}
+	}
+	return nil
+}
+
+// composite evaluates a composite literal. Arrays and slices whose elements are
+// not all static, and structs with fields whose evaluation has effects, are
+// left to the residual program with the known elements in place.
+func composite(expr *ast.CompositeLit, scope EvalScope) Value {
+	tv, ok := typeOf(scope, expr)
+	if !ok {
+		return &UnknownValue{expr}
+	}
+	pkg := currentPackage(scope)
+	t := tv.Type
+	_, isStruct := t.Underlying().(*types.Struct)
+	var elems []Value
+	var residual []ast.Expr
+	known := true
+	for _, elt := range expr.Elts {
+		x := elt
+		kv, keyed := elt.(*ast.KeyValueExpr)
+		if keyed {
+			x = kv.Value
+		}
+		v := Eval(x, scope)[0]
+		elems = append(elems, v)
+		if isStruct {
+			known = known && (v.Known() || pure(v.Expr()))
+		} else {
+			known = known && static(v)
+		}
+		e := v.Expr()
+		if lit, ok := x.(*ast.CompositeLit); ok && lit.Type == nil {
+			// The type of the element is implied by the literal.
+			if res, ok := e.(*ast.CompositeLit); ok {
+				res.Type = nil
+			}
+		}
+		if keyed {
+			key := kv.Key
+			if !isStruct {
+				key = Eval(kv.Key, scope)[0].Expr()
+			}
+			e = &ast.KeyValueExpr{Key: key, Value: e}
+		}
+		residual = append(residual, e)
+	}
+	if known {
+		if v := knownComposite(expr, t, pkg, elems, scope); v != nil {
+			return v
+		}
+	}
+	return &UnknownValue{&ast.CompositeLit{Type: expr.Type, Elts: residual}}
+}
+
+// knownComposite builds the value of a composite literal, or gives nil if it
+// cannot.
+func knownComposite(expr *ast.CompositeLit, t types.Type, pkg *types.Package, elems []Value, scope EvalScope) Value {
+	base := compositeValue{typ: t, pkg: pkg}
+	switch u := t.Underlying().(type) {
+	case *types.Struct:
+		zero, ok := zeroValue(t, pkg).(*StructValue)
+		if !ok {
+			return nil
+		}
+		fields := append([]Value(nil), zero.fields...)
+		for i, elt := range expr.Elts {
+			j := i
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				j = fieldIndex(u, kv.Key.(*ast.Ident).Name)
+			}
+			fields[j] = assignable(elems[i], u.Field(j).Type(), pkg)
+		}
+		return &StructValue{base, fields}
+
+	case *types.Array:
+		zero := zeroValue(u.Elem(), pkg)
+		if zero == nil {
+			return nil
+		}
+		values, ok := indexed(expr, elems, u.Elem(), zero, int(u.Len()), scope)
+		if !ok {
+			return nil
+		}
+		return &ArrayValue{base, values}
+
+	case *types.Slice:
+		zero := zeroValue(u.Elem(), pkg)
+		if zero == nil {
+			return nil
+		}
+		values, ok := indexed(expr, elems, u.Elem(), zero, -1, scope)
+		if !ok {
+			return nil
+		}
+		return &SliceValue{base, values, len(values)}
+
+	case *types.Map:
+		m := &MapValue{compositeValue: base}
+		for i, elt := range expr.Elts {
+			k := Eval(elt.(*ast.KeyValueExpr).Key, scope)[0]
+			if !static(k) {
+				return nil
+			}
+			m.keys = append(m.keys, assignable(k, u.Key(), pkg))
+			m.elems = append(m.elems, assignable(elems[i], u.Elem(), pkg))
+		}
+		return m
+	}
+	return nil
+}
+
+// indexed places the elements of an array or slice literal at their indices.
+// Slices are as long as the highest index requires.
+func indexed(expr *ast.CompositeLit, elems []Value, t types.Type, zero Value, n int, scope EvalScope) ([]Value, bool) {
+	byIndex := map[int]Value{}
+	i, max := 0, 0
+	for k, elt := range expr.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			key, ok := Eval(kv.Key, scope)[0].(basicValue)
+			if !ok {
+				return nil, false
+			}
+			j, ok := constant.Int64Val(constant.ToInt(key.basic().value))
+			if !ok {
+				return nil, false
+			}
+			i = int(j)
+		}
+		byIndex[i] = assignable(elems[k], t, currentPackage(scope))
+		i++
+		if i > max {
+			max = i
+		}
+	}
+	if n < 0 {
+		n = max
+	}
+	values := make([]Value, n)
+	for i := range values {
+		values[i] = zero
+		if v, ok := byIndex[i]; ok {
+			values[i] = v
+		}
+	}
+	return values, true
+}
+
+func fieldIndex(s *types.Struct, name string) int {
+	for i := 0; i < s.NumFields(); i++ {
+		if s.Field(i).Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// index evaluates an index expression on a known array, slice, string or map.
+// It gives nil if the element cannot be known.
+func index(x, i Value) Value {
+	if m, ok := x.(*MapValue); ok {
+		if !static(i) {
+			return nil
+		}
+		if e, ok := m.lookup(i); ok {
+			return e
+		}
+		// Keys that are not in the map give the zero value.
+		return zeroValue(m.typ.Underlying().(*types.Map).Elem(), m.pkg)
+	}
+	c, ok := i.(basicValue)
+	if !ok {
+		return nil
+	}
+	n, ok := constant.Int64Val(constant.ToInt(c.basic().value))
+	if !ok || n < 0 {
+		return nil
+	}
+	var elems []Value
+	switch x := x.(type) {
+	case *ArrayValue:
+		elems = x.elems
+	case *SliceValue:
+		elems = x.elems[:x.len]
+	case basicValue:
+		if x.basic().value.Kind() != constant.String {
+			return nil
+		}
+		s := constant.StringVal(x.basic().value)
+		if n >= int64(len(s)) {
+			return nil
+		}
+		return makeValue(constant.MakeInt64(int64(s[n])), types.Universe.Lookup("byte").Type())
+	}
+	if n >= int64(len(elems)) {
+		return nil
+	}
+	return elems[n]
+}
+
+// slice evaluates a slice expression on a known slice or string. Arrays are not
+// sliced, as the result would share the array's storage. It gives nil if the
+// result cannot be known.
+func slice(x Value, bounds []Value) Value {
+	var length, capacity int
+	switch x := x.(type) {
+	case *SliceValue:
+		length, capacity = x.len, len(x.elems)
+	case basicValue:
+		if x.basic().value.Kind() != constant.String {
+			return nil
+		}
+		length = len(constant.StringVal(x.basic().value))
+		capacity = length
+	default:
+		return nil
+	}
+	// The bounds default to the start, the length and the capacity.
+	idx := []int{0, length, capacity}
+	for i, b := range bounds {
+		if b == nil {
+			continue
+		}
+		c, ok := b.(basicValue)
+		if !ok {
+			return nil
+		}
+		n, ok := constant.Int64Val(constant.ToInt(c.basic().value))
+		if !ok {
+			return nil
+		}
+		idx[i] = int(n)
+	}
+	lo, hi, max := idx[0], idx[1], idx[2]
+	if lo < 0 || lo > hi || hi > max || max > capacity {
+		return nil
+	}
+	switch x := x.(type) {
+	case *SliceValue:
+		return &SliceValue{x.compositeValue, x.elems[lo:max], hi - lo}
+	case basicValue:
+		s := constant.StringVal(x.basic().value)
+		return inPackage(makeValue(constant.MakeString(s[lo:hi]), x.basic().typ), x.basic().pkg)
+	}
+	return nil
+}
+
+// length gives the length or capacity of a known value, or nil if it is not
+// known.
+func length(name string, x Value) Value {
+	switch x := x.(type) {
+	case *ArrayValue:
+		return makeValue(constant.MakeInt64(int64(len(x.elems))), types.Typ[types.Int])
+	case *SliceValue:
+		if name == "cap" {
+			return makeValue(constant.MakeInt64(int64(len(x.elems))), types.Typ[types.Int])
+		}
+		return makeValue(constant.MakeInt64(int64(x.len)), types.Typ[types.Int])
+	case *MapValue:
+		if name == "len" {
+			return makeValue(constant.MakeInt64(int64(len(x.keys))), types.Typ[types.Int])
+		}
+	case *nilValue:
+		return makeValue(constant.MakeInt64(0), types.Typ[types.Int])
+	case basicValue:
+		if name == "len" && x.basic().value.Kind() == constant.String {
+			return makeValue(constant.MakeInt64(int64(len(constant.StringVal(x.basic().value)))), types.Typ[types.Int])
+		}
+	}
+	return nil
+}
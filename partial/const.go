@@ -0,0 +1,473 @@
+package partial
+
+import (
+	"go/constant"
+	"go/token"
+	"go/types"
+	"math"
+	"math/big"
+)
+
+// sizes gives the sizes of the types whose size depends on the platform, as
+// they are on 64 bit platforms. Values of those types are only computed where
+// they would be the same on 32 bit platforms, and otherwise left to the
+// residual program, as they depend on where it runs.
+var sizes = types.SizesFor("gc", "amd64")
+
+// portable reports whether an integer is in the range of its type on every
+// platform.
+func portable(c constant.Value, b *types.Basic) bool {
+	c = constant.ToInt(c)
+	if c.Kind() != constant.Int {
+		return true
+	}
+	switch b.Kind() {
+	case types.Int:
+		return constant.Compare(c, token.GEQ, constant.MakeInt64(math.MinInt32)) &&
+			constant.Compare(c, token.LEQ, constant.MakeInt64(math.MaxInt32))
+	case types.Uint, types.Uintptr:
+		return constant.Sign(c) >= 0 && constant.Compare(c, token.LEQ, constant.MakeUint64(math.MaxUint32))
+	}
+	return true
+}
+
+// makeValue creates the Value for a constant of the given type. Typed numbers
+// are reduced to what their type can hold: integers wrap around as they would
+// at run time, and floats are rounded to their precision. It gives nil if the
+// result cannot be represented.
+func makeValue(c constant.Value, t types.Type) Value {
+	b, _ := t.Underlying().(*types.Basic)
+	if b != nil && b.Info()&types.IsUntyped == 0 {
+		switch {
+		case b.Info()&types.IsInteger != 0:
+			if !portable(c, b) {
+				return nil
+			}
+			c = wrap(c, b)
+		case b.Info()&(types.IsFloat|types.IsComplex) != 0:
+			c = round(c, b)
+			if c == nil {
+				return nil
+			}
+		}
+	}
+	v := constValue{value: c, typ: t}
+	switch info := basicInfo(t); {
+	case info&types.IsInteger != 0:
+		return &IntValue{v}
+	case info&types.IsFloat != 0:
+		return &FloatValue{v}
+	case info&types.IsComplex != 0:
+		return &ComplexValue{v}
+	}
+	switch c.Kind() {
+	case constant.Int:
+		return &IntValue{v}
+	case constant.Float:
+		return &FloatValue{v}
+	case constant.Complex:
+		return &ComplexValue{v}
+	case constant.String:
+		return &StringValue{v}
+	case constant.Bool:
+		if types.Identical(t, True.typ) {
+			return Bool(constant.BoolVal(c))
+		}
+		return &BoolValue{v}
+	}
+	return nil
+}
+
+// round gives the nearest value that a float or complex type can hold, or nil
+// if it overflows.
+func round(c constant.Value, b *types.Basic) constant.Value {
+	part := func(c constant.Value) constant.Value {
+		c = constant.ToFloat(c)
+		if c.Kind() == constant.Unknown {
+			return nil
+		}
+		if b.Kind() == types.Float32 || b.Kind() == types.Complex64 {
+			f, _ := constant.Float32Val(c)
+			if math.IsInf(float64(f), 0) {
+				return nil
+			}
+			return constant.MakeFloat64(float64(f))
+		}
+		f, _ := constant.Float64Val(c)
+		if math.IsInf(f, 0) {
+			return nil
+		}
+		return constant.MakeFloat64(f)
+	}
+	if b.Info()&types.IsFloat != 0 {
+		return part(c)
+	}
+	c = constant.ToComplex(c)
+	if c.Kind() != constant.Complex {
+		return nil
+	}
+	re, im := part(constant.Real(c)), part(constant.Imag(c))
+	if re == nil || im == nil {
+		return nil
+	}
+	return constant.BinaryOp(re, token.ADD, constant.MakeImag(im))
+}
+
+// wrap reduces an integer to the range of a sized integer type.
+func wrap(c constant.Value, b *types.Basic) constant.Value {
+	c = constant.ToInt(c)
+	if c.Kind() != constant.Int {
+		return c
+	}
+	if _, ok := constant.Int64Val(c); ok && representable(c, b) {
+		return c
+	}
+	i := new(big.Int)
+	switch x := constant.Val(c).(type) {
+	case int64:
+		i.SetInt64(x)
+	case *big.Int:
+		i.Set(x)
+	}
+	bits := uint(sizes.Sizeof(b) * 8)
+	mod := new(big.Int).Lsh(big.NewInt(1), bits)
+	i.Mod(i, mod)
+	if b.Info()&types.IsUnsigned == 0 && i.Cmp(new(big.Int).Rsh(mod, 1)) >= 0 {
+		i.Sub(i, mod)
+	}
+	return constant.Make(i)
+}
+
+func representable(c constant.Value, b *types.Basic) bool {
+	i, ok := constant.Int64Val(c)
+	if !ok || !portable(c, b) {
+		return false
+	}
+	bits := sizes.Sizeof(b) * 8
+	if b.Info()&types.IsUnsigned != 0 {
+		return i >= 0 && (bits == 64 || i < 1<<bits)
+	}
+	return bits == 64 || i >= -1<<(bits-1) && i < 1<<(bits-1)
+}
+
+// untypedOf gives the untyped type of a constant, by its kind.
+func untypedOf(c constant.Value) types.Type {
+	switch c.Kind() {
+	case constant.Bool:
+		return types.Typ[types.UntypedBool]
+	case constant.String:
+		return types.Typ[types.UntypedString]
+	case constant.Int:
+		return types.Typ[types.UntypedInt]
+	case constant.Float:
+		return types.Typ[types.UntypedFloat]
+	case constant.Complex:
+		return types.Typ[types.UntypedComplex]
+	}
+	return types.Typ[types.Invalid]
+}
+
+func isUntyped(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Info()&types.IsUntyped != 0
+}
+
+// basicInfo gives the properties of the basic type underlying a type.
+func basicInfo(t types.Type) types.BasicInfo {
+	if b, ok := t.Underlying().(*types.Basic); ok {
+		return b.Info()
+	}
+	return 0
+}
+
+// constOp applies a binary operator to constants, following the rules for
+// operands in the spec. It gives nil if the result cannot be determined.
+func constOp(x *constValue, op token.Token, y *constValue) Value {
+	switch op {
+	case token.SHL, token.SHR:
+		s := constant.ToInt(y.value)
+		n, ok := constant.Uint64Val(s)
+		if !ok || s.Kind() != constant.Int {
+			return nil
+		}
+		c, t := constant.ToInt(x.value), x.typ
+		if c.Kind() != constant.Int || basicInfo(t)&types.IsInteger == 0 && !isUntyped(t) {
+			return nil
+		}
+		if isUntyped(t) {
+			// As go/types does, refuse shifts that make untyped constants
+			// too large to be represented.
+			if op == token.SHL && n > 1023-1+52 {
+				return nil
+			}
+			t = types.Typ[types.UntypedInt]
+		} else if n > 64 {
+			// Shifting a typed integer by its size or more gives the same
+			// result as shifting by exactly 64.
+			n = 64
+		}
+		return makeValue(constant.Shift(c, op, uint(n)), t)
+	}
+
+	xv, yv, t, ok := unify(x, y)
+	if !ok {
+		return nil
+	}
+	info := basicInfo(t)
+	switch op {
+	case token.EQL, token.NEQ:
+		return Bool(constant.Compare(xv, op, yv))
+
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		if info&types.IsOrdered == 0 {
+			return nil
+		}
+		return Bool(constant.Compare(xv, op, yv))
+
+	case token.LAND, token.LOR:
+		if info&types.IsBoolean == 0 {
+			return nil
+		}
+
+	case token.ADD:
+		if info&(types.IsNumeric|types.IsString) == 0 {
+			return nil
+		}
+
+	case token.SUB, token.MUL:
+		if info&types.IsNumeric == 0 {
+			return nil
+		}
+
+	case token.QUO:
+		if info&types.IsNumeric == 0 || constant.Sign(yv) == 0 {
+			return nil
+		}
+		if info&types.IsInteger != 0 {
+			op = token.QUO_ASSIGN
+		}
+
+	case token.REM:
+		if info&types.IsInteger == 0 || constant.Sign(yv) == 0 {
+			return nil
+		}
+
+	case token.AND, token.OR, token.XOR, token.AND_NOT:
+		if info&types.IsInteger == 0 {
+			return nil
+		}
+
+	default:
+		return nil
+	}
+	return makeValue(constant.BinaryOp(xv, op, yv), t)
+}
+
+// constUnary applies a unary operator to a constant. It gives nil if the
+// result cannot be determined.
+func constUnary(op token.Token, x *constValue) Value {
+	info := basicInfo(x.typ)
+	var prec uint
+	switch op {
+	case token.ADD, token.SUB:
+		if info&types.IsNumeric == 0 {
+			return nil
+		}
+	case token.XOR:
+		if info&types.IsInteger == 0 {
+			return nil
+		}
+		// The complement of an unsigned integer has the bits of its type.
+		if info&types.IsUnsigned != 0 && !isUntyped(x.typ) {
+			prec = uint(sizes.Sizeof(x.typ.Underlying()) * 8)
+		}
+	case token.NOT:
+		if info&types.IsBoolean == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return makeValue(constant.UnaryOp(op, x.value, prec), x.typ)
+}
+
+// unify finds the type that the operands of a binary operator have in common,
+// converting them to it.
+func unify(x, y *constValue) (xv, yv constant.Value, t types.Type, ok bool) {
+	switch {
+	case !isUntyped(x.typ) && !isUntyped(y.typ):
+		if !types.Identical(x.typ, y.typ) {
+			return nil, nil, nil, false
+		}
+		t = x.typ
+	case !isUntyped(x.typ):
+		t = x.typ
+	case !isUntyped(y.typ):
+		t = y.typ
+	default:
+		// The larger kind of untyped number is used, in the order int,
+		// rune, float, complex.
+		t = x.typ
+		if x.typ.(*types.Basic).Kind() < y.typ.(*types.Basic).Kind() {
+			t = y.typ
+		}
+	}
+	xv, ok = toKind(x.value, t)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	yv, ok = toKind(y.value, t)
+	return xv, yv, t, ok
+}
+
+// toKind represents a constant as the kind of constant that a type holds.
+func toKind(c constant.Value, t types.Type) (constant.Value, bool) {
+	info := basicInfo(t)
+	switch {
+	case info&types.IsInteger != 0:
+		c = constant.ToInt(c)
+		return c, c.Kind() == constant.Int
+	case info&types.IsFloat != 0:
+		c = constant.ToFloat(c)
+		return c, c.Kind() == constant.Float || c.Kind() == constant.Int
+	case info&types.IsComplex != 0:
+		c = constant.ToComplex(c)
+		return c, c.Kind() == constant.Complex
+	case info&types.IsString != 0:
+		return c, c.Kind() == constant.String
+	case info&types.IsBoolean != 0:
+		return c, c.Kind() == constant.Bool
+	}
+	return c, false
+}
+
+// convert applies a conversion to a type to a constant. It gives nil if the
+// result cannot be determined.
+func convert(v *constValue, t types.Type) Value {
+	info := basicInfo(t)
+	switch {
+	case info&types.IsInteger != 0:
+		c := constant.ToInt(v.value)
+		if c.Kind() != constant.Int {
+			c = truncate(v.value)
+		}
+		if c == nil || !isUntyped(v.typ) && basicInfo(v.typ)&types.IsFloat != 0 && !fits(c, t) {
+			return nil
+		}
+		return makeValue(c, t)
+
+	case info&(types.IsFloat|types.IsComplex) != 0:
+		if basicInfo(v.typ)&types.IsComplex != 0 && !isUntyped(v.typ) && info&types.IsComplex == 0 {
+			return nil
+		}
+		c, ok := toKind(v.value, t)
+		if !ok {
+			return nil
+		}
+		return makeValue(c, t)
+
+	case info&types.IsString != 0:
+		switch v.value.Kind() {
+		case constant.String:
+			return makeValue(v.value, t)
+		case constant.Int:
+			r := '\uFFFD'
+			if i, ok := constant.Int64Val(v.value); ok && i >= 0 && i <= 0x10FFFF {
+				r = rune(i)
+			}
+			return makeValue(constant.MakeString(string(r)), t)
+		}
+
+	case info&types.IsBoolean != 0:
+		if v.value.Kind() == constant.Bool {
+			return makeValue(v.value, t)
+		}
+	}
+	return nil
+}
+
+// truncate rounds a float towards zero, or gives nil if it is not a real
+// number.
+func truncate(c constant.Value) constant.Value {
+	c = constant.ToFloat(c)
+	if c.Kind() != constant.Float {
+		return nil
+	}
+	f, _ := constant.Float64Val(c)
+	if math.IsInf(f, 0) {
+		return nil
+	}
+	i, _ := new(big.Float).SetFloat64(math.Trunc(f)).Int(nil)
+	return constant.Make(i)
+}
+
+// fits reports whether an integer is in the range of an integer type, so that
+// converting a float to the type is defined.
+func fits(c constant.Value, t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	if !ok {
+		return false
+	}
+	return representable(c, b)
+}
+
+// assignable gives the value that a variable of a given type takes when
+// assigned a value. Untyped constants take the type of the variable, or their
+// default type if the variable is an interface, named as the given package
+// names it.
+func assignable(v Value, t types.Type, pkg *types.Package) Value {
+	c, ok := v.(basicValue)
+	if !ok || t == nil || !isUntyped(c.basic().typ) {
+		return v
+	}
+	if types.IsInterface(t) {
+		t = types.Default(c.basic().typ)
+	}
+	if w := convert(c.basic(), t); w != nil {
+		return inPackage(w, pkg)
+	}
+	return v
+}
+
+// assignableTo reports whether a value can be assigned to a variable of a
+// given type, as Go allows. An untyped constant must be representable by the
+// type, or by its default type if the type is an interface.
+func assignableTo(v Value, t types.Type) bool {
+	if c, ok := v.(basicValue); ok && isUntyped(c.basic().typ) {
+		if types.IsInterface(t) {
+			return types.AssignableTo(types.Default(c.basic().typ), t)
+		}
+		b, ok := t.Underlying().(*types.Basic)
+		if !ok {
+			return false
+		}
+		x, ok := toKind(c.basic().value, t)
+		switch {
+		case !ok:
+			return false
+		case b.Info()&types.IsInteger != 0:
+			return representable(x, b)
+		case b.Info()&(types.IsFloat|types.IsComplex) != 0:
+			return round(x, b) != nil
+		}
+		return true
+	}
+	if n, ok := v.(*nilValue); ok && (n.typ == nil || isUntyped(n.typ)) {
+		return types.AssignableTo(types.Typ[types.UntypedNil], t)
+	}
+	if u := defaultType(v); u != nil {
+		return types.AssignableTo(u, t)
+	}
+	return true
+}
+
+// inPackage records the package that a constant of named type is used in,
+// which the name of its type is relative to.
+func inPackage(v Value, pkg *types.Package) Value {
+	if c, ok := v.(basicValue); ok {
+		if _, named := types.Unalias(c.basic().typ).(*types.Named); named {
+			c.basic().pkg = pkg
+		}
+	}
+	return v
+}
@@ -0,0 +1,385 @@
+package partial
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"math"
+	"math/cmplx"
+	"reflect"
+	"testing"
+)
+
+type integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+type float interface {
+	~float32 | ~float64
+}
+
+var (
+	arithOps   = []token.Token{token.ADD, token.SUB, token.MUL, token.QUO, token.EQL, token.NEQ}
+	orderedOps = []token.Token{token.LSS, token.LEQ, token.GTR, token.GEQ}
+	integerOps = []token.Token{token.REM, token.AND, token.OR, token.XOR, token.AND_NOT}
+)
+
+// TestOperators checks the operators that are folded for each basic type
+// against the results that Go gives for them at run time.
+func TestOperators(t *testing.T) {
+	intOps := append(append(append([]token.Token{}, arithOps...), orderedOps...), integerOps...)
+	floatOps := append(append([]token.Token{}, arithOps...), orderedOps...)
+
+	conform(t, types.Typ[types.Int], intOps, intOp[int], []int{math.MinInt32, -7, -1, 0, 2, 3, 1 << 20, math.MaxInt32})
+	conform(t, types.Typ[types.Int8], intOps, intOp[int8], []int8{-128, -7, -1, 0, 1, 7, 127})
+	conform(t, types.Typ[types.Int16], intOps, intOp[int16], []int16{-32768, -300, 0, 5, 32767})
+	conform(t, types.Typ[types.Int32], intOps, intOp[int32], []int32{math.MinInt32, -1, 0, 'a', math.MaxInt32})
+	conform(t, types.Typ[types.Int64], intOps, intOp[int64], []int64{math.MinInt64, -5, 0, 9, math.MaxInt64})
+	conform(t, types.Typ[types.Uint], intOps, intOp[uint], []uint{0, 1, 3, 1 << 31, math.MaxUint32})
+	conform(t, types.Typ[types.Uint8], intOps, intOp[uint8], []uint8{0, 1, 7, 200, 255})
+	conform(t, types.Typ[types.Uint16], intOps, intOp[uint16], []uint16{0, 3, 40000, 65535})
+	conform(t, types.Typ[types.Uint32], intOps, intOp[uint32], []uint32{0, 9, 1 << 31, math.MaxUint32})
+	conform(t, types.Typ[types.Uint64], intOps, intOp[uint64], []uint64{0, 2, 1 << 63, math.MaxUint64})
+	conform(t, types.Typ[types.Uintptr], intOps, intOp[uintptr], []uintptr{0, 6, 1 << 30})
+
+	conform(t, types.Typ[types.Float32], floatOps, floatOp[float32], []float32{-1.5, 0, 0.1, 3, 1e38, math.MaxFloat32})
+	conform(t, types.Typ[types.Float64], floatOps, floatOp[float64], []float64{-2.5, 0, 0.1, 3, 1e300, math.SmallestNonzeroFloat64})
+
+	conform(t, types.Typ[types.Complex64], arithOps, complexOp[complex64], []complex64{0, 1 + 1i, 2 + 4i, -3, 0.5i})
+	conform(t, types.Typ[types.Complex128], arithOps, complexOp[complex128], []complex128{0, 1 + 1i, 2 + 4i, -3, 0.1 - 2i})
+
+	stringOps := append([]token.Token{token.ADD, token.EQL, token.NEQ}, orderedOps...)
+	conform(t, types.Typ[types.String], stringOps, stringOp, []string{"", "a", "ab", "b", "é"})
+
+	boolOps := []token.Token{token.EQL, token.NEQ, token.LAND, token.LOR}
+	conform(t, types.Typ[types.Bool], boolOps, boolOp, []bool{false, true})
+
+	shifts := []uint{0, 1, 7, 31, 63, 64, 200}
+	conformShift(t, types.Typ[types.Int8], []int8{-128, -3, 0, 1, 127}, shifts)
+	conformShift(t, types.Typ[types.Int], []int{math.MinInt32, -3, 0, 5, math.MaxInt32}, shifts)
+	conformShift(t, types.Typ[types.Uint16], []uint16{0, 3, 65535}, shifts)
+	conformShift(t, types.Typ[types.Uint64], []uint64{0, 1, math.MaxUint64}, shifts)
+}
+
+// conform checks every combination of operator and operands. Where Go panics
+// or the result is not finite, the operation must be left to the residual
+// program.
+func conform[T any](t *testing.T, typ types.Type, ops []token.Token, op func(token.Token, T, T) (any, bool), values []T) {
+	t.Helper()
+	for _, o := range ops {
+		for _, x := range values {
+			for _, y := range values {
+				want, ok := op(o, x, y)
+				check(t, typ, o, x, y, constOf(y), typ, want, ok)
+			}
+		}
+	}
+}
+
+func conformShift[T integer](t *testing.T, typ types.Type, values []T, counts []uint) {
+	t.Helper()
+	for _, o := range []token.Token{token.SHL, token.SHR} {
+		for _, x := range values {
+			for _, n := range counts {
+				want := x << n
+				if o == token.SHR {
+					want = x >> n
+				}
+				check(t, typ, o, x, n, constOf(n), types.Typ[types.Uint], want, true)
+			}
+		}
+	}
+}
+
+func byZero(op token.Token, y constant.Value) bool {
+	return (op == token.QUO || op == token.REM) && constant.Sign(y) == 0
+}
+
+func check(t *testing.T, typ types.Type, op token.Token, x, y any, yc constant.Value, ytyp types.Type, want any, ok bool) {
+	t.Helper()
+	got := makeValue(constOf(x), typ).Op(op, makeValue(yc, ytyp))
+	c, folded := got.(basicValue)
+	if dependent(typ) {
+		// Results outside the range that the type has on every platform
+		// must be left to a residual program that every platform accepts.
+		if !folded {
+			check32(t, got.Expr())
+			return
+		}
+		if !portable(c.basic().value, typ.Underlying().(*types.Basic)) {
+			t.Errorf("%s %v %s %v: expected residual, got %s", typ, x, op, y, c.basic().value)
+		}
+	}
+	if !ok || !finite(want) {
+		if folded {
+			t.Errorf("%s %v %s %v: expected residual, got %s", typ, x, op, y, c.basic().value)
+		}
+		if !byZero(op, yc) {
+			return
+		}
+		// Go rejects division by a constant zero, so the residual must
+		// divide by one that is not constant.
+		if _, err := types.Eval(token.NewFileSet(), nil, token.NoPos, types.ExprString(got.Expr())); err != nil {
+			t.Errorf("%s %v %s %v: residual %s: %s", typ, x, op, y, types.ExprString(got.Expr()), err)
+		}
+		return
+	}
+	if !folded {
+		t.Errorf("%s %v %s %v: expected %v, got residual", typ, x, op, y, want)
+		return
+	}
+	v := c.basic()
+	wantType := typ
+	if _, ok := want.(bool); ok && op != token.LAND && op != token.LOR {
+		wantType = types.Typ[types.UntypedBool]
+	}
+	if !types.Identical(v.typ, wantType) {
+		t.Errorf("%s %v %s %v: expected type %s, got %s", typ, x, op, y, wantType, v.typ)
+	}
+	if !sameConst(v.value, constOf(want), typ, op) {
+		t.Errorf("%s %v %s %v: expected %v, got %s", typ, x, op, y, want, v.value)
+	}
+}
+
+// dependent reports whether the size of a type depends on the platform.
+func dependent(typ types.Type) bool {
+	switch typ {
+	case types.Typ[types.Int], types.Typ[types.Uint], types.Typ[types.Uintptr]:
+		return true
+	}
+	return false
+}
+
+// check32 checks that an expression is valid on 32 bit platforms.
+func check32(t *testing.T, expr ast.Expr) {
+	t.Helper()
+	src := "package p\n\nvar _ = " + types.ExprString(expr)
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{Sizes: types.SizesFor("gc", "386")}
+	if _, err := conf.Check("p", fset, []*ast.File{f}, nil); err != nil {
+		t.Errorf("%s: %s", types.ExprString(expr), err)
+	}
+}
+
+// sameConst compares a folded result with the one Go gives. Go computes
+// complex quotients in a way that need not be exact, so they are compared to
+// within rounding.
+func sameConst(got, want constant.Value, typ types.Type, op token.Token) bool {
+	if op == token.QUO && basicInfo(typ)&types.IsComplex != 0 {
+		g := complex(toFloat64(constant.Real(got)), toFloat64(constant.Imag(got)))
+		w := complex(toFloat64(constant.Real(want)), toFloat64(constant.Imag(want)))
+		tolerance := 1e-15
+		if typ == types.Typ[types.Complex64] {
+			tolerance = 1e-6
+		}
+		return cmplx.Abs(g-w) <= tolerance*cmplx.Abs(w)
+	}
+	return constant.Compare(got, token.EQL, want)
+}
+
+func toFloat64(c constant.Value) float64 {
+	f, _ := constant.Float64Val(constant.ToFloat(c))
+	return f
+}
+
+func finite(v any) bool {
+	switch r := reflect.ValueOf(v); r.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return !math.IsInf(r.Float(), 0) && !math.IsNaN(r.Float())
+	case reflect.Complex64, reflect.Complex128:
+		return !cmplx.IsInf(r.Complex()) && !cmplx.IsNaN(r.Complex())
+	}
+	return true
+}
+
+// constOf gives the constant for a Go value of a basic type.
+func constOf(v any) constant.Value {
+	switch r := reflect.ValueOf(v); r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return constant.MakeInt64(r.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return constant.MakeUint64(r.Uint())
+	case reflect.Float32, reflect.Float64:
+		return constant.MakeFloat64(r.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := r.Complex()
+		return constant.BinaryOp(constant.MakeFloat64(real(c)), token.ADD, constant.MakeImag(constant.MakeFloat64(imag(c))))
+	case reflect.String:
+		return constant.MakeString(r.String())
+	case reflect.Bool:
+		return constant.MakeBool(r.Bool())
+	}
+	panic("not a basic value")
+}
+
+func intOp[T integer](op token.Token, x, y T) (any, bool) {
+	switch op {
+	case token.QUO, token.REM:
+		if y == 0 {
+			return nil, false
+		}
+		if op == token.QUO {
+			return x / y, true
+		}
+		return x % y, true
+	case token.AND:
+		return x & y, true
+	case token.OR:
+		return x | y, true
+	case token.XOR:
+		return x ^ y, true
+	case token.AND_NOT:
+		return x &^ y, true
+	}
+	return orderedOp(op, x, y)
+}
+
+func floatOp[T float](op token.Token, x, y T) (any, bool) {
+	if op == token.QUO {
+		return x / y, true
+	}
+	return orderedOp(op, x, y)
+}
+
+func orderedOp[T integer | float](op token.Token, x, y T) (any, bool) {
+	switch op {
+	case token.ADD:
+		return x + y, true
+	case token.SUB:
+		return x - y, true
+	case token.MUL:
+		return x * y, true
+	case token.EQL:
+		return x == y, true
+	case token.NEQ:
+		return x != y, true
+	case token.LSS:
+		return x < y, true
+	case token.LEQ:
+		return x <= y, true
+	case token.GTR:
+		return x > y, true
+	case token.GEQ:
+		return x >= y, true
+	}
+	return nil, false
+}
+
+func complexOp[T complex64 | complex128](op token.Token, x, y T) (any, bool) {
+	switch op {
+	case token.ADD:
+		return x + y, true
+	case token.SUB:
+		return x - y, true
+	case token.MUL:
+		return x * y, true
+	case token.QUO:
+		return x / y, true
+	case token.EQL:
+		return x == y, true
+	case token.NEQ:
+		return x != y, true
+	}
+	return nil, false
+}
+
+func stringOp(op token.Token, x, y string) (any, bool) {
+	switch op {
+	case token.ADD:
+		return x + y, true
+	case token.EQL:
+		return x == y, true
+	case token.NEQ:
+		return x != y, true
+	case token.LSS:
+		return x < y, true
+	case token.LEQ:
+		return x <= y, true
+	case token.GTR:
+		return x > y, true
+	case token.GEQ:
+		return x >= y, true
+	}
+	return nil, false
+}
+
+func boolOp(op token.Token, x, y bool) (any, bool) {
+	switch op {
+	case token.EQL:
+		return x == y, true
+	case token.NEQ:
+		return x != y, true
+	case token.LAND:
+		return x && y, true
+	case token.LOR:
+		return x || y, true
+	}
+	return nil, false
+}
+
+func TestUnaryOperators(t *testing.T) {
+	// Variables, so that Go computes the results at run time.
+	minInt8, one := int8(-128), uint8(1)
+	for _, test := range []struct {
+		typ       types.Type
+		op        token.Token
+		x, result any
+	}{
+		{types.Typ[types.Int8], token.SUB, minInt8, -minInt8},
+		{types.Typ[types.Int8], token.XOR, int8(5), ^int8(5)},
+		{types.Typ[types.Int], token.ADD, -7, -7},
+		{types.Typ[types.Uint8], token.XOR, uint8(5), ^uint8(5)},
+		{types.Typ[types.Uint8], token.SUB, one, -one},
+		{types.Typ[types.Uint64], token.XOR, uint64(0), ^uint64(0)},
+		{types.Typ[types.Float32], token.SUB, float32(0.1), -float32(0.1)},
+		{types.Typ[types.Complex128], token.SUB, 1 + 2i, -(1 + 2i)},
+		{types.Typ[types.Bool], token.NOT, true, false},
+	} {
+		got := makeValue(constOf(test.x), test.typ).UnaryOp(test.op)
+		c, ok := got.(basicValue)
+		if !ok {
+			t.Errorf("%s%v: expected %v, got residual", test.op, test.x, test.result)
+			continue
+		}
+		if !types.Identical(c.basic().typ, test.typ) || !constant.Compare(c.basic().value, token.EQL, constOf(test.result)) {
+			t.Errorf("%s%v: expected %v, got %s", test.op, test.x, test.result, c.basic().value)
+		}
+	}
+}
+
+func TestPlatformDependent(t *testing.T) {
+	maxInt32 := makeValue(constant.MakeInt64(math.MaxInt32), types.Typ[types.Int])
+	if v := makeValue(constant.MakeInt64(math.MaxInt32+1), types.Typ[types.Int]); v != nil {
+		t.Errorf("expected no value, got %s", types.ExprString(v.Expr()))
+	}
+	if assignableTo(Int(1<<40), types.Typ[types.Int]) {
+		t.Error("expected 1 << 40 not to be assignable to int")
+	}
+	bigInt64 := makeValue(constant.MakeInt64(1<<40), types.Typ[types.Int64])
+	for _, test := range []struct {
+		name     string
+		v        Value
+		expected string
+	}{
+		{"Sum", maxInt32.Op(token.ADD, Int(1)), "((*new(int)) + 2147483647) + 1"},
+		{"Shift", makeValue(constant.MakeInt64(1), types.Typ[types.Int]).Op(token.SHL, Int(40)), "((*new(int)) + 1) << 40"},
+		{"Complement", makeValue(constant.MakeInt64(0), types.Typ[types.Uint]).UnaryOp(token.XOR), "^((*new(uint)) + 0)"},
+		{"Conversion", conversion(types.Typ[types.Int], &ast.Ident{Name: "int"}, bigInt64, nil), "int((*new(int64)) + 1099511627776)"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, folded := test.v.(basicValue); folded {
+				t.Fatalf("expected residual, got %s", types.ExprString(test.v.Expr()))
+			}
+			if got := types.ExprString(test.v.Expr()); got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+			check32(t, test.v.Expr())
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package partial
 
 import (
+	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/token"
-	"strconv"
+	"go/types"
 )
 
 type EvalScope interface {
@@ -11,34 +13,124 @@ type EvalScope interface {
 }
 
 func Eval(expr ast.Expr, scope EvalScope) []Value {
+	tv, typed := typeOf(scope, expr)
+	if typed && tv.Value != nil {
+		if v := makeValue(tv.Value, tv.Type); v != nil {
+			return []Value{inPackage(v, currentPackage(scope))}
+		}
+	}
 	switch expr := expr.(type) {
 	case *ast.BasicLit:
-		switch expr.Kind {
-		case token.STRING:
-			v, _ := strconv.Unquote(expr.Value)
-			return []Value{String(v)}
-		case token.INT:
-			v, _ := strconv.ParseInt(expr.Value, 0, 64)
-			return []Value{Int(v)}
+		c := constant.MakeFromLiteral(expr.Value, expr.Kind, 0)
+		if v := makeValue(c, untypedOf(c)); v != nil {
+			return []Value{v}
 		}
 
 	case *ast.Ident:
+		if typed && tv.IsNil() {
+			return []Value{&nilValue{typ: tv.Type}}
+		}
 		switch expr.Name {
 		case "true":
 			return []Value{True}
 		case "false":
 			return []Value{False}
 		}
+		if f := function(expr, nil, nil, scope); f != nil {
+			return []Value{f}
+		}
 		return []Value{scope.Lookup(expr.Name)}
 
 	case *ast.BinaryExpr:
+		if expr.Op == token.LAND || expr.Op == token.LOR {
+			return []Value{shortCircuit(expr, scope)}
+		}
 		left := Eval(expr.X, scope)
 		right := Eval(expr.Y, scope)
 		return []Value{left[0].Op(expr.Op, right[0])}
 
+	case *ast.UnaryExpr:
+		if expr.Op == token.AND {
+			if v := pointer(expr, scope); v != nil {
+				return []Value{v}
+			}
+			return []Value{address(expr.X, scope)}
+		}
+		return []Value{Eval(expr.X, scope)[0].UnaryOp(expr.Op)}
+
+	case *ast.FuncLit:
+		if v := closure(expr, scope); v != nil {
+			return []Value{v}
+		}
+
+	case *ast.CompositeLit:
+		return []Value{composite(expr, scope)}
+
+	case *ast.IndexExpr:
+		if x, ok := typeOf(scope, expr.X); ok && !x.IsValue() {
+			// An instantiation of a generic function or type.
+			break
+		}
+		x := Eval(expr.X, scope)[0]
+		i := Eval(expr.Index, scope)[0]
+		if v := index(x, i); v != nil {
+			if _, commaOk := tv.Type.(*types.Tuple); commaOk {
+				// The form v, ok := m[k] also reports whether the key is
+				// in the map.
+				_, found := x.(*MapValue).lookup(i)
+				return []Value{v, Bool(found)}
+			}
+			return []Value{v}
+		}
+		return []Value{indexExpr(x, i)}
+
+	case *ast.SliceExpr:
+		x := Eval(expr.X, scope)[0]
+		bounds := make([]Value, 3)
+		exprs := make([]ast.Expr, 3)
+		for i, b := range []ast.Expr{expr.Low, expr.High, expr.Max} {
+			if b != nil {
+				bounds[i] = Eval(b, scope)[0]
+				exprs[i] = bounds[i].Expr()
+			}
+		}
+		if v := slice(x, bounds); v != nil {
+			return []Value{v}
+		}
+		return []Value{&UnknownValue{&ast.SliceExpr{
+			X:      x.Expr(),
+			Low:    exprs[0],
+			High:   exprs[1],
+			Max:    exprs[2],
+			Slice3: expr.Slice3,
+		}}}
+
 	case *ast.CallExpr:
-		f := Eval(expr.Fun, scope)[0]
-		return f.Call(evalArgs(expr.Args, scope))
+		fun, ok := typeOf(scope, expr.Fun)
+		if ok && fun.IsType() && len(expr.Args) == 1 {
+			return []Value{conversion(fun.Type, expr.Fun, Eval(expr.Args[0], scope)[0], currentPackage(scope))}
+		}
+		if ok && fun.IsBuiltin() {
+			if v := pointer(expr, scope); v != nil {
+				return []Value{v}
+			}
+			args := evalArgs(expr.Args, scope)
+			if id, ok := ast.Unparen(expr.Fun).(*ast.Ident); ok {
+				b := &BuiltinValue{
+					name:   id.Name,
+					typ:    tv.Type,
+					pkg:    currentPackage(scope),
+					spread: expr.Ellipsis.IsValid(),
+				}
+				return b.Call(args)
+			}
+			return []Value{callExpr(&UnknownValue{expr.Fun}, args)}
+		}
+		args := evalArgs(expr.Args, scope)
+		if results := callHost(expr, args, scope); results != nil {
+			return results
+		}
+		return Eval(expr.Fun, scope)[0].Call(args)
 
 	case *ast.ParenExpr:
 		inner := Eval(expr.X, scope)[0]
@@ -47,13 +139,222 @@ func Eval(expr ast.Expr, scope EvalScope) []Value {
 		}
 		return []Value{&UnknownValue{&ast.ParenExpr{X: inner.Expr()}}}
 
+	case *ast.StarExpr:
+		if typed && tv.IsType() {
+			break
+		}
+		if cell, ok := deref(expr.X, scope); ok {
+			return []Value{scope.Lookup(cell)}
+		}
+		return []Value{&UnknownValue{&ast.StarExpr{X: Eval(expr.X, scope)[0].Expr()}}}
+
+	case *ast.TypeAssertExpr:
+		if expr.Type != nil {
+			_, commaOk := tv.Type.(*types.Tuple)
+			return assertion(expr, commaOk, scope)
+		}
+
 	case *ast.SelectorExpr:
 		recv := Eval(expr.X, scope)
-		return []Value{recv[0].Member(expr.Sel.Name)}
+		if f := function(expr.Sel, expr.X, recv[0], scope); f != nil {
+			return []Value{f}
+		}
+		return []Value{member(recv[0], expr.Sel.Name, scope)}
 	}
 	return []Value{&UnknownValue{expr}}
 }
 
+// shortCircuit evaluates && and ||, which only evaluate their right operand if
+// the left does not decide the result.
+func shortCircuit(expr *ast.BinaryExpr, scope EvalScope) Value {
+	// The value of the left operand that decides the result.
+	decides := Value(False)
+	if expr.Op == token.LOR {
+		decides = True
+	}
+	left := Eval(expr.X, scope)[0]
+	if left.Known() {
+		if left.Matches(decides) {
+			return left
+		}
+		right := Eval(expr.Y, scope)[0]
+		if right.Known() {
+			return left.Op(expr.Op, right)
+		}
+		return right
+	}
+	right := Eval(expr.Y, scope)[0]
+	if right.Known() {
+		if !right.Matches(decides) {
+			return left
+		}
+		// The left operand must still be evaluated for its effects.
+		if pure(expr.X) {
+			return right
+		}
+	}
+	return opExpr(expr.Op, left, right)
+}
+
+// A typedScope knows the types that the type checker found for the
+// expressions being evaluated.
+type typedScope interface {
+	typeOf(x ast.Expr) (types.TypeAndValue, bool)
+	currentPackage() *types.Package
+}
+
+func typeOf(scope EvalScope, x ast.Expr) (types.TypeAndValue, bool) {
+	if s, ok := scope.(typedScope); ok {
+		return s.typeOf(x)
+	}
+	return types.TypeAndValue{}, false
+}
+
+// address takes the address of an expression. Variables in the expression are
+// referred to rather than replaced by their values, as it is the variable that
+// is being addressed.
+func address(x ast.Expr, scope EvalScope) Value {
+	if ref := reference(x, scope); ref != nil {
+		return &UnknownValue{&ast.UnaryExpr{Op: token.AND, X: ref}}
+	}
+	return Eval(x, scope)[0].UnaryOp(token.AND)
+}
+
+func reference(x ast.Expr, scope EvalScope) ast.Expr {
+	switch x := x.(type) {
+	case *ast.Ident:
+		return &ast.Ident{Name: x.Name}
+
+	case *ast.ParenExpr:
+		if ref := reference(x.X, scope); ref != nil {
+			return &ast.ParenExpr{X: ref}
+		}
+
+	case *ast.SelectorExpr:
+		if ref := reference(x.X, scope); ref != nil {
+			return &ast.SelectorExpr{X: ref, Sel: x.Sel}
+		}
+		return &ast.SelectorExpr{X: Eval(x.X, scope)[0].Expr(), Sel: x.Sel}
+
+	case *ast.IndexExpr:
+		base := reference(x.X, scope)
+		if base == nil {
+			base = Eval(x.X, scope)[0].Expr()
+		}
+		return &ast.IndexExpr{X: base, Index: Eval(x.Index, scope)[0].Expr()}
+
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: Eval(x.X, scope)[0].Expr()}
+	}
+	return nil
+}
+
+// currentPackage gives the package of the code being evaluated, relative to
+// which types are named.
+func currentPackage(scope EvalScope) *types.Package {
+	if s, ok := scope.(typedScope); ok {
+		return s.currentPackage()
+	}
+	return nil
+}
+
+// conversion converts a value to a type.
+func conversion(t types.Type, fun ast.Expr, v Value, pkg *types.Package) Value {
+	switch v := v.(type) {
+	case basicValue:
+		if w := convert(v.basic(), t); w != nil {
+			return inPackage(w, pkg)
+		}
+		if basicInfo(t)&basicInfo(v.basic().typ)&types.IsNumeric != 0 && !isUntyped(v.basic().typ) {
+			// A result that depends on the platform is left to run time.
+			return &UnknownValue{&ast.CallExpr{Fun: fun, Args: []ast.Expr{dynamicExpr(v)}}}
+		}
+	case *nilValue:
+		if !types.IsInterface(t) {
+			return &nilValue{typ: t}
+		}
+	}
+	return &UnknownValue{&ast.CallExpr{Fun: fun, Args: []ast.Expr{v.Expr()}}}
+}
+
+// assertion evaluates a type assertion, which holds or not according to the
+// dynamic type of the value being asserted on if that is known.
+func assertion(expr *ast.TypeAssertExpr, commaOk bool, scope EvalScope) []Value {
+	x := Eval(expr.X, scope)[0]
+	iface, typed := typeOf(scope, expr.X)
+	t, _ := typeOf(scope, expr.Type)
+	dyn, known := dynamicType(x)
+	if !typed || !known {
+		return []Value{&UnknownValue{&ast.TypeAssertExpr{X: x.Expr(), Type: expr.Type}}}
+	}
+	ok := holds(dyn, t)
+	switch {
+	case ok && commaOk:
+		return []Value{x, True}
+	case ok:
+		return []Value{x}
+	case commaOk:
+		if zero := zeroValue(t.Type, currentPackage(scope)); zero != nil {
+			return []Value{zero, False}
+		}
+	}
+	// The assertion fails, which the residual program must do too. The value
+	// is converted back to the interface type for it to be asserted on.
+	conv := &ast.CallExpr{Fun: typeExpr(iface.Type, currentPackage(scope)), Args: []ast.Expr{x.Expr()}}
+	return []Value{&UnknownValue{&ast.TypeAssertExpr{X: conv, Type: expr.Type}}}
+}
+
+// dynamicType gives the type of the value that an interface holds, which is
+// nil if it holds nothing. It reports whether the type is known.
+func dynamicType(v Value) (types.Type, bool) {
+	if n, ok := v.(*nilValue); ok {
+		if n.typ == nil || isUntyped(n.typ) || types.IsInterface(n.typ) {
+			return nil, true
+		}
+		return n.typ, true
+	}
+	t := defaultType(v)
+	return t, t != nil
+}
+
+// holds reports whether an interface whose value has the given dynamic type
+// holds a value of type t, as a type assertion or type switch case sees it.
+func holds(dyn types.Type, t types.TypeAndValue) bool {
+	if t.IsNil() {
+		return dyn == nil
+	}
+	if dyn == nil || t.Type == nil {
+		return false
+	}
+	if iface, ok := t.Type.Underlying().(*types.Interface); ok {
+		return types.Implements(dyn, iface)
+	}
+	return types.Identical(dyn, t.Type)
+}
+
+// Constant evaluates an expression that does not refer to any variables.
+func Constant(expr ast.Expr) (Value, error) {
+	return constantIn(expr, newBindings())
+}
+
+// ConstantIn evaluates an expression that does not refer to any variables, as
+// though it appeared in a package. Info must hold the types of the
+// expression, as types.CheckExpr records them, so that it may convert values
+// and build composite literals of the package's types.
+func ConstantIn(expr ast.Expr, info *types.Info, pkg *types.Package) (Value, error) {
+	scope := newBindings()
+	scope.info, scope.pkg = info, pkg
+	return constantIn(expr, scope)
+}
+
+func constantIn(expr ast.Expr, scope *bindings) (Value, error) {
+	v := Eval(expr, scope)[0]
+	if !static(v) {
+		return nil, fmt.Errorf("%s is not constant", types.ExprString(expr))
+	}
+	return v, nil
+}
+
 func evalArgs(args []ast.Expr, scope EvalScope) []Value {
 	if len(args) == 1 {
 		return Eval(args[0], scope)
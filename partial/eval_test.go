@@ -6,6 +6,7 @@ import (
 	"go/format"
 	"go/parser"
 	"go/token"
+	"strings"
 	"testing"
 )
 
@@ -152,6 +153,81 @@ func TestEval(t *testing.T) {
 			`true&&false`,
 			`false`,
 		},
+		{
+			"Negate",
+			`-a`,
+			`-1`,
+		},
+		{
+			"NegateIdent",
+			`-x`,
+			`-x`,
+		},
+		{
+			"Complement",
+			`^a`,
+			`-2`,
+		},
+		{
+			"Not",
+			`!(a == 1)`,
+			`false`,
+		},
+		{
+			"NotIdent",
+			`!(x == a)`,
+			`!(x == 1)`,
+		},
+		{
+			"Address",
+			`&a`,
+			`&a`,
+		},
+		{
+			"AddressIndex",
+			`&x[a]`,
+			`&x[1]`,
+		},
+		{
+			"Receive",
+			`<-x`,
+			`<-x`,
+		},
+		{
+			"ShortCircuitAnd",
+			`false && f(x)`,
+			`false`,
+		},
+		{
+			"ShortCircuitOr",
+			`a == 1 || f(x)`,
+			`true`,
+		},
+		{
+			"LeftNeutral",
+			`a == 1 && f(x)`,
+			`f(x)`,
+		},
+		{
+			"RightNeutral",
+			`f(x) && a == 1`,
+			`f(x)`,
+		},
+		{
+			"RightNeutralOr",
+			`x || a == 2`,
+			`x`,
+		},
+		{
+			"RightDecides",
+			`x && a == 2`,
+			`false`,
+		},
+		{
+			"RightDecidesEffect",
+			`f(x) && a == 2`,
+			`f(x) && false`,
+		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			in, _ := parser.ParseExpr(test.in)
@@ -163,3 +239,156 @@ func TestEval(t *testing.T) {
 		})
 	}
 }
+
+func TestTypedEval(t *testing.T) {
+	for _, test := range []struct {
+		name, in, out string
+	}{
+		{"Wraparound", `b + 10`, `uint8(4)`},
+		{"WraparoundSigned", `int8(b)`, `int8(-6)`},
+		{"Unsigned", `u - 1`, `((*new(uint)) + 0) - uint(1)`},
+		{"IntegerDivision", `i / 2`, `-3`},
+		{"Remainder", `i % 2`, `-1`},
+		{"UntypedPrecision", `1 << 100 >> 98`, `4`},
+		{"Conversion", `uint16(i)`, `uint16(65529)`},
+		{"RuneConversion", `string(rune(r))`, `"A"`},
+		{"Compare", `b > 200`, `true`},
+		{"StringCompare", `"a" < "b"`, `true`},
+		{"Mixed", `x + b`, `x + 250`},
+		{"DivideByZero", `i / (r - 65)`, `-7 / (*new(int))`},
+		{"NegateWraparound", `-int8(b - 122)`, `int8(-128)`},
+		{"ComplementUnsigned", `^b`, `uint8(5)`},
+		{"ComplementMixed", `^x`, `^x`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := "func f(b uint8, i, r int, u uint, x uint8) { _ = " + test.in + " }"
+			decl, info := parseFunc(t, src, "f")
+			scope := newBindings()
+			scope.info, scope.vars = info, varTypes(decl, info)
+			scope = scope.Bind("b", Int(250)).Bind("i", Int(-7)).Bind("r", Int(65)).Bind("u", Int(0)).(*bindings)
+			scope = scope.declare("x")
+			in := decl.Body.List[0].(*ast.AssignStmt).Rhs[0]
+			expected := nodeString(stringNode(test.out))
+			out := nodeString(Eval(in, scope)[0].Expr())
+			if out != expected {
+				t.Errorf("\nexpected\n\t%s\ngot\n\t%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestFloatEval(t *testing.T) {
+	for _, test := range []struct {
+		name, in, out string
+	}{
+		{"Float", `f + 1`, `2.5`},
+		{"Integral", `f * 2`, `3.0`},
+		{"Float32", `g`, `float32(0.1)`},
+		{"Float32Rounding", `g * 3`, `float32(0.3)`},
+		{"Float32Conversion", `float32(f)`, `float32(1.5)`},
+		{"Truncate", `int(f)`, `1`},
+		{"IntToFloat", `float64(n)`, `97.0`},
+		{"UntypedFloat", `1.5 * 2`, `3.0`},
+		{"DivideByZero", `f / (f - f)`, `1.5 / (*new(float64))`},
+		{"Complex", `c * c`, `(-3 + 4i)`},
+		{"Imaginary", `c - 1`, `2i`},
+		{"ComplexCompare", `c == 1+2i`, `true`},
+		{"Rune", `n + 1`, `'b'`},
+		{"RuneLiteral", `'x'`, `'x'`},
+		{"UnprintableRune", `n - 97`, `int32(0)`},
+		{"NegateFloat", `-f`, `-1.5`},
+		{"NegateComplex", `-c`, `(-1 - 2i)`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := "func f(f float64, g float32, c complex128, n int32) { _ = " + test.in + " }"
+			decl, info := parseFunc(t, src, "f")
+			scope := newBindings()
+			scope.info, scope.vars = info, varTypes(decl, info)
+			scope = scope.Bind("f", Float(1.5)).Bind("g", Float(0.1)).Bind("c", Complex(1+2i)).Bind("n", Rune('a')).(*bindings)
+			in := decl.Body.List[0].(*ast.AssignStmt).Rhs[0]
+			expected := nodeString(stringNode(test.out))
+			out := nodeString(Eval(in, scope)[0].Expr())
+			if out != expected {
+				t.Errorf("\nexpected\n\t%s\ngot\n\t%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestCompositeEval(t *testing.T) {
+	for _, test := range []struct {
+		name, in, out string
+	}{
+		{"Field", `Point{X: 1, Y: 2}.X`, `1`},
+		{"Positional", `Point{3, 4}.Y`, `4`},
+		{"ZeroField", `Point{X: 1}.Y`, `0`},
+		{"Struct", `Point{X: i}`, `Point{X: 1}`},
+		{"Zero", `Point{}`, `Point{}`},
+		{"PartlyKnown", `Point{X: x, Y: i}`, `Point{X: x, Y: 1}`},
+		{"Promoted", `Line{Point: Point{1, 2}}.X`, `1`},
+		{"Method", `Point{1, 2}.Len()`, `Point{X: 1, Y: 2}.Len()`},
+		{"Index", `[]int{1, 2, 3}[i]`, `2`},
+		{"DynamicIndex", `[]int{1, 2, 3}[x]`, `[]int{1, 2, 3}[x]`},
+		{"OutOfRange", `[]int{1, 2, 3}[i+5]`, `[]int{1, 2, 3}[6]`},
+		{"Array", `[4]int{2: i}`, `[4]int{0, 0, 1}`},
+		{"Slice", `[]int{1, 2, 3}[:i]`, `[]int{1, 2, 3}[:1]`},
+		{"SliceLen", `len([]int{1, 2, 3}[i:])`, `2`},
+		{"SliceCap", `cap([]int{1, 2, 3}[:i])`, `3`},
+		{"StringIndex", `"abc"[i]`, `byte(98)`},
+		{"StringSlice", `"hello"[i:3]`, `"el"`},
+		{"Nested", `[]Point{{1, 2}, {3, 4}}[i].Y`, `4`},
+		{"NestedLiteral", `[]Point{{X: i}}`, `[]Point{{X: 1}}`},
+		{"Equal", `Point{1, 2} == Point{X: 1, Y: i + 1}`, `true`},
+		{"String", `Line{}.Label`, `""`},
+		{"Map", `map[string]int{"a": i, "b": 2}["a"]`, `1`},
+		{"MapMissing", `map[string]int{"a": i}["b"]`, `0`},
+		{"MapDynamicKey", `map[string]int{"a": i}[s]`, `map[string]int{"a": 1}[s]`},
+		{"MapLen", `len(map[int]bool{i: true, 2: false})`, `2`},
+		{"MapStructKey", `map[Point]string{{i, 2}: "p"}[Point{1, 2}]`, `"p"`},
+		{"MapInterfaceKey", `map[any]int{1: 1, 1.0: 2}[i]`, `1`},
+		{"MapNil", `map[string]int(nil) == nil`, `true`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			src := `type Point struct{ X, Y int }
+				func (p Point) Len() int { return p.X + p.Y }
+				type Line struct {
+					Point
+					End   Point
+					Label string
+				}
+				func f(i, x int, s string) { _ = ` + test.in + ` }`
+			decl, info := parseFunc(t, src, "f")
+			_, scope, err := bindParams(decl, info, map[string]Value{"i": Int(1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := decl.Body.List[0].(*ast.AssignStmt).Rhs[0]
+			expected := nodeString(stringNode(test.out))
+			out := nodeString(Eval(in, scope)[0].Expr())
+			if out != expected {
+				t.Errorf("\nexpected\n\t%s\ngot\n\t%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestSortedMap(t *testing.T) {
+	src := `func f() { _ = map[string]int{"b": 1, "c": 2, "a": 3} }`
+	decl, info := parseFunc(t, src, "f")
+	_, scope, err := bindParams(decl, info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Eval(decl.Body.List[0].(*ast.AssignStmt).Rhs[0], scope)[0].(*MapValue)
+	order, ok := m.sorted()
+	if !ok {
+		t.Fatal("expected the keys to be sorted")
+	}
+	var keys []string
+	for _, i := range order {
+		keys = append(keys, nodeString(m.keys[i].Expr()))
+	}
+	if got := strings.Join(keys, " "); got != `"a" "b" "c"` {
+		t.Errorf(`expected "a" "b" "c", got %s`, got)
+	}
+}
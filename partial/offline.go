@@ -0,0 +1,201 @@
+package partial
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"sort"
+
+	"github.com/bobappleyard/deflect/bta"
+)
+
+// A Division records the binding times that binding time analysis finds for
+// the variables of a function. Specializing the function offline with it
+// residualizes whatever the division finds to be dynamic, even where the
+// value is known.
+type Division struct {
+	decl  *ast.FuncDecl
+	src   *ast.FuncDecl // decl with shadowing variables renamed
+	info  *types.Info   // for src
+	names map[types.Object]string
+	entry Point
+	fn    *bta.Func
+	stmts map[Point]ast.Stmt // that the points are made from
+	times map[bta.Point]bta.Division
+	loops map[Point][]string // variables that are dynamic somewhere in a loop
+}
+
+// Divide performs binding time analysis on a function, given the names of its
+// static parameters. The other parameters, the receiver and any named results
+// are dynamic. Info must hold the Types, Defs, Uses and Implicits of decl.
+func Divide(decl *ast.FuncDecl, info *types.Info, static []string) (*Division, error) {
+	var params []types.Object
+	for _, name := range static {
+		obj := paramObject(decl, info, name)
+		if obj == nil {
+			return nil, fmt.Errorf("%s has no parameter %s", decl.Name.Name, name)
+		}
+		params = append(params, obj)
+	}
+	src, info, names := unshadow(decl, info)
+	a := newAnalyzer(src.Body)
+	d := &Division{
+		decl:  decl,
+		src:   src,
+		info:  info,
+		names: names,
+		entry: a.analyze(src.Body, nil),
+		fn:    bta.FromFunc(src, info),
+		stmts: a.stmts,
+		loops: map[Point][]string{},
+	}
+	if d.entry == nil || d.fn.Entry == nil {
+		return d, nil
+	}
+	d.times = bta.NewGraph(d.fn.Entry).Division(d.fn.Initial(params...))
+	d.findLoops()
+	return d, nil
+}
+
+func paramObject(decl *ast.FuncDecl, info *types.Info, name string) types.Object {
+	for _, f := range decl.Type.Params.List {
+		for _, id := range f.Names {
+			if id.Name == name {
+				return info.Defs[id]
+			}
+		}
+	}
+	return nil
+}
+
+// Dynamic lists the variables that are dynamic at some point in the function,
+// in the order they are declared.
+func (d *Division) Dynamic() []types.Object {
+	seen := map[types.Object]bool{}
+	var res []types.Object
+	add := func(obj types.Object) {
+		if obj != nil && !seen[obj] {
+			seen[obj] = true
+			res = append(res, obj)
+		}
+	}
+	for n, times := range d.times {
+		if def := n.Defs(); def != nil && !times[def] {
+			add(def)
+		}
+		for _, obj := range n.Uses() {
+			if !times[obj] {
+				add(obj)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Pos() < res[j].Pos()
+	})
+	return res
+}
+
+// nodes gives the points of the analysed graph that a point is made from.
+func (d *Division) nodes(p Point) []bta.Point {
+	stmt, ok := d.stmts[p]
+	if !ok {
+		return nil
+	}
+	return d.fn.Points(stmt)
+}
+
+// dynamic lists the variables that are dynamic where a point uses them. At a
+// loop header this includes the variables that are dynamic anywhere in the
+// loop.
+func (d *Division) dynamic(p Point) []string {
+	if d == nil {
+		return nil
+	}
+	var names []string
+	for _, n := range d.nodes(p) {
+		for _, obj := range n.Uses() {
+			if !d.times[n][obj] {
+				names = append(names, d.name(obj))
+			}
+		}
+	}
+	return uniqueNames(append(names, d.loops[p]...))
+}
+
+// dynamicDefs lists the variables that a point defines that are dynamic
+// afterwards.
+func (d *Division) dynamicDefs(p Point) []string {
+	if d == nil {
+		return nil
+	}
+	var names []string
+	for _, n := range d.nodes(p) {
+		if def := n.Defs(); def != nil && !d.times[n][def] {
+			names = append(names, d.name(def))
+		}
+	}
+	return uniqueNames(names)
+}
+
+// findLoops records the variables that are defined to be dynamic by the points
+// in each loop, so that they can be made dynamic on entering the loop.
+func (d *Division) findLoops() {
+	reach := map[bta.Point]map[bta.Point]bool{}
+	for n := range d.times {
+		reach[n] = reachable(n)
+	}
+	for p := range d.stmts {
+		switch p.(type) {
+		case *loop, *rangeLoop:
+		default:
+			continue
+		}
+		nodes := d.nodes(p)
+		if len(nodes) == 0 {
+			continue
+		}
+		header := nodes[0]
+		var names []string
+		for n := range reach[header] {
+			if def := n.Defs(); reach[n][header] && def != nil && !d.times[n][def] {
+				names = append(names, d.name(def))
+			}
+		}
+		d.loops[p] = uniqueNames(names)
+	}
+}
+
+// name gives the name of a variable in the function as it is specialized.
+func (d *Division) name(obj types.Object) string {
+	if name, ok := d.names[obj]; ok {
+		return name
+	}
+	return obj.Name()
+}
+
+func uniqueNames(names []string) []string {
+	sort.Strings(names)
+	var res []string
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// reachable finds the points that control can pass to from a point.
+func reachable(p bta.Point) map[bta.Point]bool {
+	seen := map[bta.Point]bool{}
+	var visit func(p bta.Point)
+	visit = func(p bta.Point) {
+		for _, q := range p.Next() {
+			if !seen[q] {
+				seen[q] = true
+				visit(q)
+			}
+		}
+	}
+	visit(p)
+	return seen
+}
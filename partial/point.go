@@ -2,7 +2,9 @@ package partial
 
 import (
 	"go/ast"
+	"go/constant"
 	"go/token"
+	"go/types"
 )
 
 type Point interface {
@@ -28,7 +30,7 @@ type evalExpr struct {
 }
 
 func (p *evalExpr) Successors(scope ExecScope) []State {
-	return []State{{p.cont, scope}}
+	return []State{{p.cont, mutate(p.expr, scope)}}
 }
 
 type returnValues struct {
@@ -42,9 +44,13 @@ func (p *returnValues) Successors(scope ExecScope) []State {
 type branch struct {
 	condition              ast.Expr
 	consequent, antecedent Point
+	join                   Point
 }
 
 func (p *branch) Successors(scope ExecScope) []State {
+	if p.condition == nil {
+		return []State{{p.consequent, scope}}
+	}
 	v := Eval(p.condition, scope)[0]
 	if v.Matches(True) {
 		return []State{{p.consequent, bindKnownValues(p.condition, scope)}}
@@ -58,6 +64,11 @@ func (p *branch) Successors(scope ExecScope) []State {
 	}
 }
 
+// A loop is a branch that control returns to.
+type loop struct {
+	branch
+}
+
 func bindKnownValues(e ast.Expr, scope ExecScope) ExecScope {
 	bin, ok := e.(*ast.BinaryExpr)
 	if !ok {
@@ -66,14 +77,28 @@ func bindKnownValues(e ast.Expr, scope ExecScope) ExecScope {
 	switch bin.Op {
 	case token.EQL:
 		if id, ok := bin.X.(*ast.Ident); ok {
-			return scope.Bind(id.Name, Eval(bin.Y, scope)[0])
+			if v := Eval(bin.Y, scope)[0]; static(v) {
+				return refine(scope, id.Name, v)
+			}
 		}
-	case token.AND:
+	case token.LAND:
 		return bindKnownValues(bin.X, bindKnownValues(bin.Y, scope))
 	}
 	return scope
 }
 
+type refiner interface {
+	refine(name string, value Value) ExecScope
+}
+
+// refine binds a variable to a value it is known to have.
+func refine(scope ExecScope, name string, value Value) ExecScope {
+	if r, ok := scope.(refiner); ok {
+		return r.refine(name, value)
+	}
+	return scope.Bind(name, value)
+}
+
 type assign struct {
 	lhs, rhs []ast.Expr
 	define   bool
@@ -81,12 +106,292 @@ type assign struct {
 }
 
 func (p *assign) Successors(scope ExecScope) []State {
-	rhs := evalArgs(p.lhs, scope)
+	return []State{{p.cont, p.bind(scope, evalArgs(p.rhs, scope))}}
+}
+
+// bind associates the variables being assigned to with their new values.
+// Variables given unknown values refer to themselves from then on, as do
+// those assigned to through known pointers.
+func (p *assign) bind(scope ExecScope, rhs []Value) ExecScope {
 	for i, lhs := range p.lhs {
-		rhs := rhs[i]
-		if ref, ok := lhs.(*ast.Ident); ok {
-			scope = scope.Bind(ref.Name, rhs)
+		v := Value(&UnknownValue{lhs})
+		if len(rhs) == len(p.lhs) {
+			v = rhs[i]
+		}
+		switch lhs := ast.Unparen(lhs).(type) {
+		case *ast.Ident:
+			if lhs.Name == "_" {
+				continue
+			}
+			if !v.Known() {
+				v = &UnknownValue{&ast.Ident{Name: lhs.Name}}
+			}
+			scope = scope.Bind(lhs.Name, v)
+			if ptr, ok := v.(*PointerValue); ok && len(p.rhs) == len(p.lhs) && allocates(p.rhs[i], scope) {
+				// The variable that new allocates starts with its zero
+				// value.
+				scope = ptr.Update(scope, zeroValue(ptr.elem(), currentPackage(scope)))
+			}
+
+		case *ast.StarExpr:
+			if ref := Eval(lhs.X, scope)[0]; ref.KnownRef() {
+				scope = ref.Update(scope, v)
+			}
+		}
+	}
+	return scope
+}
+
+// A rangeLoop is a range statement. Its body is entered with the key and value
+// of each element of the collection in turn, and continuing the loop passes
+// control to its next point.
+type rangeLoop struct {
+	stmt    *ast.RangeStmt
+	bind    *assign // assigns the key and value, if there are any
+	body    Point
+	next    *rangeNext
+	exit    Point
+	mutated bool // the body changes the elements of the collection
+}
+
+func (p *rangeLoop) Successors(scope ExecScope) []State {
+	entered := scope
+	if p.bind != nil {
+		entered = p.bind.bind(scope, nil)
+	}
+	return []State{{p.body, entered}, {p.exit, scope}}
+}
+
+// maxRange bounds the number of iterations of a range that are unrolled.
+const maxRange = 1 << 12
+
+// items lists the keys and values that a range visits, if the collection is
+// known. Known maps are only visited in the order of their keys if sorted is
+// set, as Go leaves their order unspecified. Collections that the body
+// changes are not visited, as their elements are not known in advance.
+func (p *rangeLoop) items(scope ExecScope, sorted bool) ([][]Value, bool) {
+	tv, ok := typeOf(scope, p.stmt.X)
+	if !ok {
+		return nil, false
+	}
+	index := func(i int) Value {
+		return makeValue(constant.MakeInt64(int64(i)), types.Typ[types.Int])
+	}
+	var items [][]Value
+	switch x := Eval(p.stmt.X, scope)[0].(type) {
+	case *nilValue:
+		switch tv.Type.Underlying().(type) {
+		case *types.Slice, *types.Map:
+			return nil, true
+		}
+		return nil, false
+
+	case *ArrayValue:
+		for i, e := range x.elems {
+			items = append(items, []Value{index(i), e})
+		}
+
+	case *SliceValue:
+		if p.mutated {
+			return nil, false
+		}
+		for i, e := range x.elems[:x.len] {
+			items = append(items, []Value{index(i), e})
 		}
+
+	case *MapValue:
+		order, ok := x.sorted()
+		if !sorted || !ok || p.mutated {
+			return nil, false
+		}
+		for _, i := range order {
+			items = append(items, []Value{x.keys[i], x.elems[i]})
+		}
+
+	case basicValue:
+		c := x.basic().value
+		switch c.Kind() {
+		case constant.String:
+			for i, r := range constant.StringVal(c) {
+				items = append(items, []Value{index(i), makeValue(constant.MakeInt64(int64(r)), types.Typ[types.Int32])})
+			}
+		case constant.Int:
+			n, ok := constant.Int64Val(c)
+			if !ok || n > maxRange {
+				return nil, false
+			}
+			t := types.Default(tv.Type)
+			for i := int64(0); i < n; i++ {
+				items = append(items, []Value{inPackage(makeValue(constant.MakeInt64(i), t), currentPackage(scope))})
+			}
+		default:
+			return nil, false
+		}
+
+	default:
+		return nil, false
+	}
+	return items, len(items) <= maxRange
+}
+
+// A rangeNext is where a range continues with the next element.
+type rangeNext struct {
+	loop *rangeLoop
+}
+
+func (p *rangeNext) Successors(scope ExecScope) []State {
+	return []State{{p.loop, scope}}
+}
+
+type declare struct {
+	spec *ast.ValueSpec
+	cont Point
+}
+
+func (p *declare) Successors(scope ExecScope) []State {
+	for _, name := range p.spec.Names {
+		scope = scope.Bind(name.Name, &UnknownValue{&ast.Ident{Name: name.Name}})
 	}
 	return []State{{p.cont, scope}}
 }
+
+// A choice is a switch statement. Its tag is compared with the values of each
+// case in turn, and control passes to the body of the first that it equals.
+// In a type switch the dynamic type of the tag is compared with the types of
+// each case instead.
+type choice struct {
+	tag     ast.Expr // nil to compare with true
+	clauses []clause
+	def     *clause // the default clause, if any
+	join    Point
+
+	typed bool       // a type switch
+	bind  *ast.Ident // the variable a type switch binds, if any
+}
+
+type clause struct {
+	values []ast.Expr
+	body   Point
+	bound  Point // binds the variable of a type switch to the tag
+}
+
+// An arm is a case of a switch that could be taken, with the values that
+// cannot be ruled out. An arm without values is taken when no other is.
+type arm struct {
+	values []ast.Expr
+	State
+}
+
+func (p *choice) Successors(scope ExecScope) []State {
+	_, arms := p.arms(scope)
+	next := make([]State, len(arms))
+	for i, a := range arms {
+		next[i] = a.State
+	}
+	return next
+}
+
+// arms finds the cases that could be taken, given the value of the tag.
+// Cases after one that is known to be taken are not reachable.
+func (p *choice) arms(scope ExecScope) (Value, []arm) {
+	if p.typed {
+		return p.typeArms(scope)
+	}
+	tag := Value(True)
+	if p.tag != nil {
+		tag = Eval(p.tag, scope)[0]
+	}
+	var arms []arm
+	var seen []Value // values that earlier cases are taken for
+	for _, c := range p.clauses {
+		var values []ast.Expr
+		var lastX ast.Expr
+		var last Value
+		for _, x := range c.values {
+			v := Eval(x, scope)[0]
+			if static(v) && matchAny(v, seen) {
+				continue
+			}
+			eq := tag.Op(token.EQL, v)
+			if eq.Matches(True) {
+				return tag, append(arms, arm{nil, State{c.body, p.enter(x, v, scope)}})
+			}
+			if !eq.Matches(False) {
+				values = append(values, v.Expr())
+				lastX, last = x, v
+				if static(v) {
+					seen = append(seen, v)
+				}
+			}
+		}
+		if len(values) == 1 {
+			arms = append(arms, arm{values, State{c.body, p.enter(lastX, last, scope)}})
+		} else if values != nil {
+			arms = append(arms, arm{values, State{c.body, scope}})
+		}
+	}
+	if p.def == nil {
+		return tag, append(arms, arm{nil, State{p.join, scope}})
+	}
+	return tag, append(arms, arm{nil, State{p.def.body, scope}})
+}
+
+// typeArms finds the cases of a type switch that could be taken. If the
+// dynamic type of the tag is known, only one of them can be.
+func (p *choice) typeArms(scope ExecScope) (Value, []arm) {
+	tag := Eval(p.tag, scope)[0]
+	dyn, known := dynamicType(tag)
+	_, typed := typeOf(scope, p.tag)
+	known = known && typed
+	var arms []arm
+	for i := range p.clauses {
+		c := &p.clauses[i]
+		if !known {
+			if c.values != nil {
+				arms = append(arms, arm{c.values, p.enterType(c, false, scope)})
+			}
+			continue
+		}
+		for _, x := range c.values {
+			if t, _ := typeOf(scope, x); holds(dyn, t) {
+				return tag, []arm{{nil, p.enterType(c, true, scope)}}
+			}
+		}
+	}
+	if p.def == nil {
+		return tag, append(arms, arm{nil, State{p.join, scope}})
+	}
+	return tag, append(arms, arm{nil, p.enterType(p.def, known, scope)})
+}
+
+// enterType binds the variable of a type switch on taking a case. It has the
+// value of the tag if its dynamic type is known.
+func (p *choice) enterType(c *clause, known bool, scope ExecScope) State {
+	switch {
+	case p.bind == nil:
+		return State{c.body, scope}
+	case known:
+		return State{c.bound, scope}
+	}
+	return State{c.body, scope.Bind(p.bind.Name, &UnknownValue{&ast.Ident{Name: p.bind.Name}})}
+}
+
+// enter binds the values that are known on taking a case with a single value.
+func (p *choice) enter(x ast.Expr, v Value, scope ExecScope) ExecScope {
+	if p.tag == nil {
+		return bindKnownValues(x, scope)
+	}
+	if id, ok := p.tag.(*ast.Ident); ok && static(v) {
+		return refine(scope, id.Name, v)
+	}
+	return scope
+}
+
+func matchAny(v Value, ws []Value) bool {
+	for _, w := range ws {
+		if v.Matches(w) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package partial
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// PointerValue is a pointer to a variable of the function being specialized,
+// or to one that a call to new allocates. Reading and writing through the
+// pointer reads and writes the variable, whose value can remain known.
+type PointerValue struct {
+	baseValue
+	typ  types.Type
+	cell string
+}
+
+func (v *PointerValue) Expr() ast.Expr {
+	return &ast.UnaryExpr{Op: token.AND, X: &ast.Ident{Name: v.cell}}
+}
+
+func (v *PointerValue) Matches(w Value) bool {
+	u, ok := w.(*PointerValue)
+	return ok && u.cell == v.cell
+}
+
+func (v *PointerValue) KnownRef() bool {
+	return true
+}
+
+func (v *PointerValue) Hash() uint64 {
+	return hashString(v.cell)
+}
+
+func (v *PointerValue) Op(op token.Token, w Value) Value {
+	return compareOp(v, op, w)
+}
+
+func (v *PointerValue) UnaryOp(op token.Token) Value {
+	return unaryExpr(op, v)
+}
+
+func (v *PointerValue) Member(name string) Value {
+	return selExpr(v, name)
+}
+
+func (v *PointerValue) Call(args []Value) []Value {
+	return []Value{callExpr(v, args)}
+}
+
+// Update stores a value in the variable that the pointer points to. The
+// variable refers to itself if the value is not known.
+func (v *PointerValue) Update(scope ExecScope, w Value) ExecScope {
+	if !w.Known() {
+		w = &UnknownValue{&ast.Ident{Name: v.cell}}
+	}
+	return scope.Bind(v.cell, assignable(w, v.elem(), currentPackage(scope)))
+}
+
+func (v *PointerValue) elem() types.Type {
+	return v.typ.Underlying().(*types.Pointer).Elem()
+}
+
+// A heapScope knows which variables pointers can be followed to.
+type heapScope interface {
+	variable(name string) bool
+	allocation(call *ast.CallExpr) (string, bool)
+}
+
+// pointer takes the address of a variable, or allocates one by calling new. It
+// gives nil if the pointer cannot be followed.
+func pointer(expr ast.Expr, scope EvalScope) Value {
+	h, ok := scope.(heapScope)
+	if !ok {
+		return nil
+	}
+	tv, ok := typeOf(scope, expr)
+	if !ok {
+		return nil
+	}
+	switch x := ast.Unparen(expr).(type) {
+	case *ast.UnaryExpr:
+		if id, ok := ast.Unparen(x.X).(*ast.Ident); ok && h.variable(id.Name) {
+			return &PointerValue{typ: tv.Type, cell: id.Name}
+		}
+	case *ast.CallExpr:
+		if cell, ok := h.allocation(x); ok {
+			return &PointerValue{typ: tv.Type, cell: cell}
+		}
+	}
+	return nil
+}
+
+// allocates reports whether an expression is a call to new that allocates a
+// variable that pointers can be followed to.
+func allocates(x ast.Expr, scope EvalScope) bool {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	h, ok := scope.(heapScope)
+	if !ok {
+		return false
+	}
+	_, ok = h.allocation(call)
+	return ok
+}
+
+// deref gives the variable that a known pointer points to.
+func deref(x ast.Expr, scope EvalScope) (string, bool) {
+	if p, ok := Eval(x, scope)[0].(*PointerValue); ok {
+		return p.cell, true
+	}
+	return "", false
+}
+
+// member selects a field or method of a value. Fields are reached through known
+// pointers.
+func member(x Value, name string, scope EvalScope) Value {
+	p, ok := x.(*PointerValue)
+	if !ok {
+		return x.Member(name)
+	}
+	switch v := scope.Lookup(p.cell).(type) {
+	case *StructValue:
+		if f, ok := v.field(name); ok {
+			return f
+		}
+	case *UnknownValue:
+		return v.Member(name)
+	}
+	return x.Member(name)
+}
+
+// pointers finds the pointers that can be followed while specializing a
+// function body. They are held only in variables that always point to the same
+// variable and that are only used to reach it, so the residual program need
+// not hold the variable they point to. It gives the expressions that take such
+// pointers, and names the variables that calls to new among them allocate
+// after the pointers they are assigned to.
+func pointers(body *ast.BlockStmt, info *types.Info) (map[*ast.UnaryExpr]bool, map[*ast.CallExpr]string) {
+	local := func(id *ast.Ident) *types.Var {
+		obj, ok := info.ObjectOf(id).(*types.Var)
+		if !ok || obj.Pos() < body.Pos() || obj.Pos() >= body.End() {
+			return nil
+		}
+		return obj
+	}
+	candidate := func(id *ast.Ident) *types.Var {
+		if v := local(id); v != nil {
+			if _, ok := v.Type().Underlying().(*types.Pointer); ok {
+				return v
+			}
+		}
+		return nil
+	}
+
+	// Variables that are copied to each other are considered together.
+	group := map[*types.Var]*types.Var{}
+	var find func(v *types.Var) *types.Var
+	find = func(v *types.Var) *types.Var {
+		g, ok := group[v]
+		if !ok {
+			group[v] = v
+			return v
+		}
+		if g != v {
+			g = find(g)
+			group[v] = g
+		}
+		return g
+	}
+	bad := map[*types.Var]bool{}
+	sources := map[*types.Var][]ast.Expr{}
+	allocs := map[*ast.CallExpr]string{}
+	handled := map[*ast.Ident]bool{}
+
+	assign := func(v *types.Var, lhs *ast.Ident, rhs ast.Expr) {
+		switch x := ast.Unparen(rhs).(type) {
+		case *ast.UnaryExpr:
+			if id, ok := ast.Unparen(x.X).(*ast.Ident); ok && x.Op == token.AND && variable(id, info) != nil {
+				sources[v] = append(sources[v], x)
+				return
+			}
+		case *ast.CallExpr:
+			fun, ok := ast.Unparen(x.Fun).(*ast.Ident)
+			if b, builtin := info.Uses[fun].(*types.Builtin); ok && builtin && b.Name() == "new" {
+				if zeroValue(info.TypeOf(x.Args[0]), nil) != nil {
+					sources[v] = append(sources[v], x)
+					allocs[x] = lhs.Name
+					return
+				}
+			}
+		case *ast.Ident:
+			if w := candidate(x); w != nil {
+				handled[x] = true
+				group[find(v)] = find(w)
+				return
+			}
+		}
+		bad[v] = true
+	}
+	assignAll := func(lhs, rhs []ast.Expr) {
+		for i, x := range lhs {
+			id, ok := x.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			v := candidate(id)
+			if v == nil {
+				continue
+			}
+			handled[id] = true
+			find(v)
+			if len(lhs) != len(rhs) {
+				bad[v] = true
+				continue
+			}
+			assign(v, id, rhs[i])
+		}
+	}
+
+	var stack []ast.Node
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, n)
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			assignAll(n.Lhs, n.Rhs)
+		case *ast.ValueSpec:
+			lhs := make([]ast.Expr, len(n.Names))
+			for i, name := range n.Names {
+				lhs[i] = name
+			}
+			assignAll(lhs, n.Values)
+		case *ast.Ident:
+			if v := candidate(n); v != nil && !handled[n] && !followed(stack, info) {
+				find(v)
+				bad[v] = true
+			}
+		}
+		return true
+	})
+
+	// The variables of a group must all point to the same variable.
+	targets := map[*types.Var]map[any]bool{}
+	for v := range group {
+		g := find(v)
+		bad[g] = bad[g] || bad[v]
+		if targets[g] == nil {
+			targets[g] = map[any]bool{}
+		}
+		for _, src := range sources[v] {
+			if x, ok := src.(*ast.UnaryExpr); ok {
+				targets[g][variable(ast.Unparen(x.X).(*ast.Ident), info)] = true
+			} else {
+				targets[g][src] = true
+			}
+		}
+	}
+	refs := map[*ast.UnaryExpr]bool{}
+	for v, srcs := range sources {
+		if g := find(v); !bad[g] && len(targets[g]) == 1 {
+			for _, src := range srcs {
+				if x, ok := src.(*ast.UnaryExpr); ok {
+					refs[x] = true
+				}
+			}
+			continue
+		}
+		for _, src := range srcs {
+			if x, ok := src.(*ast.CallExpr); ok {
+				delete(allocs, x)
+			}
+		}
+	}
+	return refs, allocs
+}
+
+// followed reports whether the use of a pointer variable at the top of the
+// stack only reaches the variable it points to: by following it to read or
+// write the variable or its fields or elements, or by comparing it with nil.
+func followed(stack []ast.Node, info *types.Info) bool {
+	for _, n := range stack {
+		if _, ok := n.(*ast.FuncLit); ok {
+			return false
+		}
+	}
+	i := len(stack) - 1
+	for i > 0 {
+		if _, ok := stack[i-1].(*ast.ParenExpr); !ok {
+			break
+		}
+		i--
+	}
+	if i == 0 {
+		return false
+	}
+	switch p := stack[i-1].(type) {
+	case *ast.BinaryExpr:
+		other := p.X
+		if other == stack[i] {
+			other = p.Y
+		}
+		return (p.Op == token.EQL || p.Op == token.NEQ) && info.Types[other].IsNil()
+	case *ast.StarExpr:
+	case *ast.SelectorExpr:
+		if _, field := info.Uses[p.Sel].(*types.Var); !field {
+			return false
+		}
+	default:
+		return false
+	}
+	// What the pointer reaches must not have its address taken in turn.
+	for i--; i > 0; i-- {
+		switch p := stack[i-1].(type) {
+		case *ast.ParenExpr, *ast.StarExpr:
+			continue
+		case *ast.SelectorExpr:
+			method, ok := info.Uses[p.Sel].(*types.Func)
+			if !ok {
+				continue
+			}
+			_, ptr := method.Type().(*types.Signature).Recv().Type().(*types.Pointer)
+			return !ptr
+		case *ast.IndexExpr:
+			if p.X == stack[i] {
+				continue
+			}
+		case *ast.UnaryExpr:
+			return p.Op != token.AND
+		}
+		return true
+	}
+	return true
+}
+
+// variable gives the variable of a function, including its parameters, that an
+// identifier refers to.
+func variable(id *ast.Ident, info *types.Info) *types.Var {
+	v, ok := info.ObjectOf(id).(*types.Var)
+	if !ok || v.Parent() == nil || v.Parent() == v.Pkg().Scope() {
+		return nil
+	}
+	return v
+}
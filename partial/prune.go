@@ -0,0 +1,252 @@
+package partial
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// prune removes the variables that a residual function body declares but
+// never reads, as the Go compiler would reject them.
+func prune(body []ast.Stmt) []ast.Stmt {
+	for {
+		reads := map[string]bool{}
+		for _, s := range body {
+			collectReads(s, reads)
+		}
+		declared := map[string]bool{}
+		for _, s := range body {
+			collectDecls(s, declared)
+		}
+		unused := map[string]bool{}
+		for name := range declared {
+			if !reads[name] {
+				unused[name] = true
+			}
+		}
+		if len(unused) == 0 {
+			return body
+		}
+		body = removeUnused(body, unused)
+	}
+}
+
+func collectReads(n ast.Node, reads map[string]bool) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, x := range n.Lhs {
+				if _, ok := x.(*ast.Ident); !ok {
+					collectReads(x, reads)
+				}
+			}
+			for _, x := range n.Rhs {
+				collectReads(x, reads)
+			}
+			return false
+
+		case *ast.ValueSpec:
+			for _, x := range n.Values {
+				collectReads(x, reads)
+			}
+			return false
+
+		case *ast.SelectorExpr:
+			collectReads(n.X, reads)
+			return false
+
+		case *ast.BranchStmt:
+			return false
+
+		case *ast.LabeledStmt:
+			collectReads(n.Stmt, reads)
+			return false
+
+		case *ast.RangeStmt:
+			for _, x := range []ast.Expr{n.Key, n.Value} {
+				if _, ok := x.(*ast.Ident); !ok && x != nil {
+					collectReads(x, reads)
+				}
+			}
+			collectReads(n.X, reads)
+			collectReads(n.Body, reads)
+			return false
+
+		case *ast.Ident:
+			reads[n.Name] = true
+		}
+		return true
+	})
+}
+
+func collectDecls(n ast.Node, declared map[string]bool) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+
+		case *ast.AssignStmt:
+			if n.Tok == token.DEFINE {
+				for _, x := range n.Lhs {
+					declared[x.(*ast.Ident).Name] = true
+				}
+			}
+
+		case *ast.ValueSpec:
+			for _, name := range n.Names {
+				declared[name.Name] = true
+			}
+
+		case *ast.RangeStmt:
+			if n.Tok == token.DEFINE {
+				for _, x := range []ast.Expr{n.Key, n.Value} {
+					if x != nil {
+						declared[x.(*ast.Ident).Name] = true
+					}
+				}
+			}
+		}
+		return true
+	})
+	delete(declared, "_")
+}
+
+func removeUnused(body []ast.Stmt, unused map[string]bool) []ast.Stmt {
+	var res []ast.Stmt
+	for _, s := range body {
+		if s = removeUnusedStmt(s, unused); s != nil {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func removeUnusedStmt(s ast.Stmt, unused map[string]bool) ast.Stmt {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		blank := true
+		for i, x := range s.Lhs {
+			if id, ok := x.(*ast.Ident); ok && unused[id.Name] {
+				s.Lhs[i] = &ast.Ident{Name: "_"}
+			}
+			if id, ok := s.Lhs[i].(*ast.Ident); !ok || id.Name != "_" {
+				blank = false
+			}
+		}
+		if !blank {
+			return s
+		}
+		if pure(s.Rhs...) {
+			return nil
+		}
+		s.Tok = token.ASSIGN
+		return s
+
+	case *ast.DeclStmt:
+		decl, ok := s.Decl.(*ast.GenDecl)
+		if !ok || decl.Tok != token.VAR {
+			return s
+		}
+		var specs []ast.Spec
+		for _, spec := range decl.Specs {
+			spec := spec.(*ast.ValueSpec)
+			blank := true
+			for i, name := range spec.Names {
+				if unused[name.Name] {
+					spec.Names[i] = &ast.Ident{Name: "_"}
+				}
+				blank = blank && spec.Names[i].Name == "_"
+			}
+			if !blank || !pure(spec.Values...) {
+				specs = append(specs, spec)
+			}
+		}
+		if specs == nil {
+			return nil
+		}
+		decl.Specs = specs
+		return s
+
+	case *ast.BlockStmt:
+		s.List = removeUnused(s.List, unused)
+
+	case *ast.IfStmt:
+		s.Body.List = removeUnused(s.Body.List, unused)
+		switch els := removeUnusedStmt(s.Else, unused).(type) {
+		case nil, *ast.IfStmt, *ast.BlockStmt:
+			s.Else = els
+		default:
+			s.Else = &ast.BlockStmt{List: []ast.Stmt{els}}
+		}
+		if els, ok := s.Else.(*ast.BlockStmt); ok && len(els.List) == 0 {
+			s.Else = nil
+		}
+		if s.Init == nil && len(s.Body.List) == 0 && s.Else == nil {
+			// Nothing is left to branch between.
+			return discard(s.Cond)
+		}
+
+	case *ast.ForStmt:
+		s.Body.List = removeUnused(s.Body.List, unused)
+
+	case *ast.RangeStmt:
+		s.Body.List = removeUnused(s.Body.List, unused)
+		for _, x := range []*ast.Expr{&s.Key, &s.Value} {
+			if id, ok := (*x).(*ast.Ident); ok && unused[id.Name] {
+				*x = &ast.Ident{Name: "_"}
+			}
+		}
+		if isBlank(s.Value) {
+			s.Value = nil
+		}
+		if isBlank(s.Key) && s.Value == nil {
+			s.Key, s.Tok = nil, token.ILLEGAL
+		}
+
+	case *ast.SwitchStmt:
+		removeUnusedCases(s.Body, unused)
+
+	case *ast.TypeSwitchStmt:
+		removeUnusedCases(s.Body, unused)
+		if guard, ok := s.Assign.(*ast.AssignStmt); ok && unused[guard.Lhs[0].(*ast.Ident).Name] {
+			s.Assign = &ast.ExprStmt{X: guard.Rhs[0]}
+		}
+
+	case *ast.LabeledStmt:
+		s.Stmt = removeUnusedStmt(s.Stmt, unused)
+		if s.Stmt == nil {
+			s.Stmt = &ast.EmptyStmt{}
+		}
+	}
+	return s
+}
+
+func removeUnusedCases(body *ast.BlockStmt, unused map[string]bool) {
+	for _, c := range body.List {
+		c := c.(*ast.CaseClause)
+		c.Body = removeUnused(c.Body, unused)
+	}
+}
+
+// pure reports whether evaluating the expressions has no effect.
+func pure(xs ...ast.Expr) bool {
+	for _, x := range xs {
+		switch x := x.(type) {
+		case *ast.BasicLit, *ast.Ident, *ast.FuncLit:
+		case *ast.ParenExpr:
+			if !pure(x.X) {
+				return false
+			}
+		case *ast.BinaryExpr:
+			if !pure(x.X, x.Y) {
+				return false
+			}
+		case *ast.UnaryExpr:
+			if x.Op == token.ARROW || !pure(x.X) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
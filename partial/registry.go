@@ -0,0 +1,372 @@
+package partial
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var registry = struct {
+	sync.RWMutex
+	funcs map[string]reflect.Value
+}{funcs: map[string]reflect.Value{}}
+
+// Register records that a function is pure, so that calls to it with known
+// arguments are evaluated while specializing. The function is named by the
+// path of its package and its name, as in "strings.ToUpper", and fn must have
+// the same type. Calls that panic, or that give a non-nil error, are left to
+// the residual program.
+func Register(name string, fn any) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("partial: %s registered as %T, not a function", name, fn))
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.funcs[name] = v
+}
+
+func init() {
+	for name, fn := range map[string]any{
+		"strings.Compare":      strings.Compare,
+		"strings.Contains":     strings.Contains,
+		"strings.ContainsAny":  strings.ContainsAny,
+		"strings.ContainsRune": strings.ContainsRune,
+		"strings.Count":        strings.Count,
+		"strings.EqualFold":    strings.EqualFold,
+		"strings.Fields":       strings.Fields,
+		"strings.HasPrefix":    strings.HasPrefix,
+		"strings.HasSuffix":    strings.HasSuffix,
+		"strings.Index":        strings.Index,
+		"strings.IndexByte":    strings.IndexByte,
+		"strings.IndexRune":    strings.IndexRune,
+		"strings.Join":         strings.Join,
+		"strings.LastIndex":    strings.LastIndex,
+		"strings.Repeat":       strings.Repeat,
+		"strings.Replace":      strings.Replace,
+		"strings.ReplaceAll":   strings.ReplaceAll,
+		"strings.Split":        strings.Split,
+		"strings.SplitN":       strings.SplitN,
+		"strings.ToLower":      strings.ToLower,
+		"strings.ToTitle":      strings.ToTitle,
+		"strings.ToUpper":      strings.ToUpper,
+		"strings.Trim":         strings.Trim,
+		"strings.TrimLeft":     strings.TrimLeft,
+		"strings.TrimPrefix":   strings.TrimPrefix,
+		"strings.TrimRight":    strings.TrimRight,
+		"strings.TrimSpace":    strings.TrimSpace,
+		"strings.TrimSuffix":   strings.TrimSuffix,
+
+		"strconv.Atoi":        strconv.Atoi,
+		"strconv.FormatBool":  strconv.FormatBool,
+		"strconv.FormatFloat": strconv.FormatFloat,
+		"strconv.FormatInt":   strconv.FormatInt,
+		"strconv.FormatUint":  strconv.FormatUint,
+		"strconv.Itoa":        strconv.Itoa,
+		"strconv.ParseBool":   strconv.ParseBool,
+		"strconv.ParseFloat":  strconv.ParseFloat,
+		"strconv.ParseInt":    strconv.ParseInt,
+		"strconv.ParseUint":   strconv.ParseUint,
+		"strconv.Quote":       strconv.Quote,
+		"strconv.QuoteRune":   strconv.QuoteRune,
+		"strconv.Unquote":     strconv.Unquote,
+
+		"math.Abs":   math.Abs,
+		"math.Cbrt":  math.Cbrt,
+		"math.Ceil":  math.Ceil,
+		"math.Cos":   math.Cos,
+		"math.Exp":   math.Exp,
+		"math.Floor": math.Floor,
+		"math.Hypot": math.Hypot,
+		"math.Log":   math.Log,
+		"math.Log10": math.Log10,
+		"math.Log2":  math.Log2,
+		"math.Max":   math.Max,
+		"math.Min":   math.Min,
+		"math.Mod":   math.Mod,
+		"math.Pow":   math.Pow,
+		"math.Round": math.Round,
+		"math.Sin":   math.Sin,
+		"math.Sqrt":  math.Sqrt,
+		"math.Tan":   math.Tan,
+		"math.Trunc": math.Trunc,
+
+		"unicode.IsDigit":  unicode.IsDigit,
+		"unicode.IsLetter": unicode.IsLetter,
+		"unicode.IsLower":  unicode.IsLower,
+		"unicode.IsPunct":  unicode.IsPunct,
+		"unicode.IsSpace":  unicode.IsSpace,
+		"unicode.IsUpper":  unicode.IsUpper,
+		"unicode.ToLower":  unicode.ToLower,
+		"unicode.ToUpper":  unicode.ToUpper,
+
+		"unicode/utf8.RuneCountInString": utf8.RuneCountInString,
+		"unicode/utf8.RuneLen":           utf8.RuneLen,
+		"unicode/utf8.ValidString":       utf8.ValidString,
+
+		"fmt.Sprint":   fmt.Sprint,
+		"fmt.Sprintf":  fmt.Sprintf,
+		"fmt.Sprintln": fmt.Sprintln,
+	} {
+		Register(name, fn)
+	}
+}
+
+// An objectScope knows the objects that identifiers refer to.
+type objectScope interface {
+	objectOf(id *ast.Ident) types.Object
+}
+
+// registered finds the registered function that an expression refers to.
+func registered(fun ast.Expr, scope EvalScope) (reflect.Value, *types.Signature, bool) {
+	var id *ast.Ident
+	switch f := ast.Unparen(fun).(type) {
+	case *ast.Ident:
+		id = f
+	case *ast.SelectorExpr:
+		id = f.Sel
+	}
+	s, ok := scope.(objectScope)
+	if id == nil || !ok {
+		return reflect.Value{}, nil, false
+	}
+	obj, ok := s.objectOf(id).(*types.Func)
+	if !ok || obj.Pkg() == nil {
+		return reflect.Value{}, nil, false
+	}
+	sig := obj.Type().(*types.Signature)
+	if sig.Recv() != nil {
+		return reflect.Value{}, nil, false
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	fn, ok := registry.funcs[obj.Pkg().Path()+"."+obj.Name()]
+	return fn, sig, ok
+}
+
+// callHost calls a registered function with known arguments. It gives nil if
+// the results cannot be known.
+func callHost(call *ast.CallExpr, args []Value, scope EvalScope) []Value {
+	fn, sig, ok := registered(call.Fun, scope)
+	if !ok {
+		return nil
+	}
+	t := fn.Type()
+	if t.NumOut() != sig.Results().Len() || t.IsVariadic() != sig.Variadic() {
+		return nil
+	}
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		switch {
+		case i < t.NumIn()-1 || !t.IsVariadic() && i < t.NumIn():
+			pt = t.In(i)
+		case t.IsVariadic() && call.Ellipsis.IsValid():
+			pt = t.In(t.NumIn() - 1)
+		case t.IsVariadic():
+			pt = t.In(t.NumIn() - 1).Elem()
+		default:
+			return nil
+		}
+		v, ok := hostValue(a, pt)
+		if !ok {
+			return nil
+		}
+		in[i] = v
+	}
+	out, ok := invoke(fn, in, call.Ellipsis.IsValid())
+	if !ok {
+		return nil
+	}
+	res := make([]Value, len(out))
+	for i, o := range out {
+		if res[i] = goValue(o, sig.Results().At(i).Type(), currentPackage(scope)); res[i] == nil {
+			return nil
+		}
+	}
+	return res
+}
+
+// invoke calls a function, reporting whether it returns rather than panics.
+func invoke(fn reflect.Value, in []reflect.Value, spread bool) (out []reflect.Value, ok bool) {
+	defer func() {
+		if recover() != nil {
+			out, ok = nil, false
+		}
+	}()
+	if spread {
+		return fn.CallSlice(in), true
+	}
+	return fn.Call(in), true
+}
+
+// basicTypes gives the Go types of the basic types, which values passed as
+// interfaces take.
+var basicTypes = map[types.BasicKind]reflect.Type{
+	types.Bool:       reflect.TypeOf(false),
+	types.Int:        reflect.TypeOf(int(0)),
+	types.Int8:       reflect.TypeOf(int8(0)),
+	types.Int16:      reflect.TypeOf(int16(0)),
+	types.Int32:      reflect.TypeOf(int32(0)),
+	types.Int64:      reflect.TypeOf(int64(0)),
+	types.Uint:       reflect.TypeOf(uint(0)),
+	types.Uint8:      reflect.TypeOf(uint8(0)),
+	types.Uint16:     reflect.TypeOf(uint16(0)),
+	types.Uint32:     reflect.TypeOf(uint32(0)),
+	types.Uint64:     reflect.TypeOf(uint64(0)),
+	types.Uintptr:    reflect.TypeOf(uintptr(0)),
+	types.Float32:    reflect.TypeOf(float32(0)),
+	types.Float64:    reflect.TypeOf(float64(0)),
+	types.Complex64:  reflect.TypeOf(complex64(0)),
+	types.Complex128: reflect.TypeOf(complex128(0)),
+	types.String:     reflect.TypeOf(""),
+}
+
+// hostValue converts a known value to a Go value of a given type. Only values
+// of unnamed basic types can be passed as interfaces, as named types could
+// have methods that the callee would use.
+func hostValue(v Value, t reflect.Type) (reflect.Value, bool) {
+	res := reflect.New(t).Elem()
+	switch v := v.(type) {
+	case basicValue:
+		c := v.basic()
+		if t.Kind() == reflect.Interface {
+			b, ok := types.Default(c.typ).(*types.Basic)
+			if !ok || basicTypes[b.Kind()] == nil {
+				return res, false
+			}
+			w, ok := hostValue(v, basicTypes[b.Kind()])
+			if !ok || !w.Type().AssignableTo(t) {
+				return res, false
+			}
+			res.Set(w)
+			return res, true
+		}
+		return res, setConst(res, c.value)
+
+	case *SliceValue:
+		if t.Kind() != reflect.Slice {
+			return res, false
+		}
+		res.Set(reflect.MakeSlice(t, v.len, v.len))
+		for i := 0; i < v.len; i++ {
+			e, ok := hostValue(v.elems[i], t.Elem())
+			if !ok {
+				return res, false
+			}
+			res.Index(i).Set(e)
+		}
+		return res, true
+
+	case *nilValue:
+		switch t.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Pointer, reflect.Func, reflect.Chan, reflect.Interface:
+			return res, true
+		}
+	}
+	return res, false
+}
+
+// setConst sets a Go value of basic kind to a constant, reporting whether it
+// can hold the constant exactly.
+func setConst(v reflect.Value, c constant.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		if c.Kind() != constant.Bool {
+			return false
+		}
+		v.SetBool(constant.BoolVal(c))
+	case reflect.String:
+		if c.Kind() != constant.String {
+			return false
+		}
+		v.SetString(constant.StringVal(c))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, exact := constant.Int64Val(constant.ToInt(c))
+		if !exact || v.OverflowInt(x) {
+			return false
+		}
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, exact := constant.Uint64Val(constant.ToInt(c))
+		if !exact || v.OverflowUint(x) {
+			return false
+		}
+		v.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		f := constant.ToFloat(c)
+		if f.Kind() != constant.Float && f.Kind() != constant.Int {
+			return false
+		}
+		x, _ := constant.Float64Val(f)
+		v.SetFloat(x)
+	case reflect.Complex64, reflect.Complex128:
+		c = constant.ToComplex(c)
+		if c.Kind() != constant.Complex && c.Kind() != constant.Float && c.Kind() != constant.Int {
+			return false
+		}
+		re, _ := constant.Float64Val(constant.Real(c))
+		im, _ := constant.Float64Val(constant.Imag(c))
+		v.SetComplex(complex(re, im))
+	default:
+		return false
+	}
+	return true
+}
+
+// goValue converts a Go value to a known value of a given type. It gives nil
+// if the value cannot be known, as with errors that are not nil.
+func goValue(v reflect.Value, t types.Type, pkg *types.Package) Value {
+	switch v.Kind() {
+	case reflect.Bool:
+		return inPackage(makeValue(constant.MakeBool(v.Bool()), t), pkg)
+	case reflect.String:
+		return inPackage(makeValue(constant.MakeString(v.String()), t), pkg)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return inPackage(makeValue(constant.MakeInt64(v.Int()), t), pkg)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return inPackage(makeValue(constant.MakeUint64(v.Uint()), t), pkg)
+	case reflect.Float32, reflect.Float64:
+		c := constant.MakeFloat64(v.Float())
+		if c.Kind() == constant.Unknown {
+			return nil
+		}
+		return inPackage(makeValue(c, t), pkg)
+	case reflect.Complex64, reflect.Complex128:
+		x := v.Complex()
+		re, im := constant.MakeFloat64(real(x)), constant.MakeFloat64(imag(x))
+		if re.Kind() == constant.Unknown || im.Kind() == constant.Unknown {
+			return nil
+		}
+		return inPackage(makeValue(constant.BinaryOp(re, token.ADD, constant.MakeImag(im)), t), pkg)
+	case reflect.Slice:
+		s, ok := t.Underlying().(*types.Slice)
+		if !ok {
+			return nil
+		}
+		if v.IsNil() {
+			return &nilValue{typ: t}
+		}
+		elems := make([]Value, v.Len())
+		for i := range elems {
+			if elems[i] = goValue(v.Index(i), s.Elem(), pkg); elems[i] == nil {
+				return nil
+			}
+		}
+		return &SliceValue{compositeValue{typ: t, pkg: pkg}, elems, len(elems)}
+	case reflect.Interface:
+		if v.IsNil() {
+			return &nilValue{typ: t}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1485 @@
+package partial
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// maxSteps bounds the number of points visited along any one path through the
+// residual program.
+const maxSteps = 10000
+
+var errNoTermination = errors.New("specialization does not terminate")
+
+// An UnsupportedError reports a statement that cannot be specialized.
+type UnsupportedError struct {
+	Stmt ast.Stmt
+}
+
+func (e *UnsupportedError) Error() string {
+	if _, ok := e.Stmt.(*ast.SelectStmt); ok {
+		return "unsupported statement: select"
+	}
+	return fmt.Sprintf("unsupported statement: %T", e.Stmt)
+}
+
+// residual generates the code of a specialized function by exploring the
+// states reachable from its entry point.
+type residual struct {
+	pkg     *types.Package
+	types   map[string]types.Type
+	results []string
+	sig     *types.Signature
+	labels  int
+	memo    map[memoKey][]*frame // loops being unrolled
+	escaped []string             // variables that can change without being assigned to
+	fields  map[string]bool      // variables that hold the fields of structs
+	cells   map[string]bool      // variables that calls to new allocate
+
+	name     string                      // of the residual function, if not that of the function
+	sortMaps bool                        // ranges over known maps visit their keys in order
+	calls    *Package                    // whose functions calls are specialized to
+	returns  map[*ast.ReturnStmt][]Value // the values that return statements return
+
+	division *Division // for offline specialization
+}
+
+func newResidual(decl *ast.FuncDecl, info *types.Info) *residual {
+	r := newFuncResidual(decl, decl.Type, info)
+	if obj := info.Defs[decl.Name]; obj != nil {
+		r.pkg = obj.Pkg()
+		r.sig, _ = obj.Type().(*types.Signature)
+	}
+	return r
+}
+
+// closure creates the residual for the body of a function literal, which is
+// generated in the same way as r.
+func (r *residual) closure(lit *ast.FuncLit, info *types.Info) *residual {
+	c := newFuncResidual(lit, lit.Type, info)
+	c.pkg, c.calls, c.sortMaps = r.pkg, r.calls, r.sortMaps
+	c.sig, _ = info.TypeOf(lit).(*types.Signature)
+	return c
+}
+
+func newFuncResidual(fn ast.Node, typ *ast.FuncType, info *types.Info) *residual {
+	r := &residual{
+		types:   varTypes(fn, info),
+		memo:    map[memoKey][]*frame{},
+		fields:  map[string]bool{},
+		cells:   map[string]bool{},
+		returns: map[*ast.ReturnStmt][]Value{},
+	}
+	if typ.Results != nil {
+		for _, f := range typ.Results.List {
+			for _, name := range f.Names {
+				r.results = append(r.results, name.Name)
+			}
+		}
+	}
+	return r
+}
+
+// maxVariants bounds the number of states a loop is unrolled in before the
+// variables that differ between them are generalized.
+const maxVariants = 4
+
+type frameKind int
+
+const (
+	joinFrame     frameKind = iota // paths through a branch meet at a point
+	loopFrame                      // a loop in the residual program
+	unrolledFrame                  // a loop that has been unrolled
+	variantFrame                   // a loop in a different state to its residual form
+	switchFrame                    // a switch in the residual program
+	rangeFrame                     // an iteration of a range that is being unrolled
+)
+
+// A frame is a construct enclosing the code being generated.
+type frame struct {
+	kind  frameKind
+	at    Point // the join or loop header
+	scope *bindings
+	hash  uint64
+
+	// for residual loops
+	exit        Point
+	exits       []arrival
+	generalized []string // unknown throughout the loop
+	synced      []string // held by the residual program on leaving the loop
+	label       string
+
+	// for unrolled ranges
+	items [][]Value // the keys and values of the iterations that follow
+
+	// for unrolled loops
+	forks int // the residual branches taken before the iteration
+}
+
+func newFrame(kind frameKind, at Point, scope *bindings) *frame {
+	return &frame{kind: kind, at: at, scope: scope, hash: scope.Hash()}
+}
+
+func (f *frame) matches(p Point, scope *bindings, hash uint64) bool {
+	return f.at == p && f.hash == hash && f.scope.Equal(scope)
+}
+
+// A memoKey identifies the states of a loop that is being unrolled.
+type memoKey struct {
+	at   Point
+	hash uint64
+}
+
+// A path describes the context that residual code is generated in.
+type path struct {
+	frames *frames
+	steps  int
+	forks  int // the residual branches taken along the path
+}
+
+// frames lists the enclosing frames, innermost first.
+type frames struct {
+	*frame
+	outer *frames
+}
+
+func (c path) enter(f *frame) path {
+	c.frames = &frames{f, c.frames}
+	return c
+}
+
+// nested reports whether the code is generated inside a block that is
+// followed by more code.
+func (c path) nested() bool {
+	for f := c.frames; f != nil; f = f.outer {
+		if f.kind == joinFrame || f.kind == loopFrame {
+			return true
+		}
+	}
+	return false
+}
+
+// residualLoop finds the innermost residual loop with the given header, and
+// the states it has been unrolled in since.
+func (c path) residualLoop(p Point) (*frame, []*bindings) {
+	var variants []*bindings
+	for f := c.frames; f != nil; f = f.outer {
+		if f.at != p {
+			continue
+		}
+		switch f.kind {
+		case loopFrame:
+			return f.frame, variants
+		case variantFrame:
+			variants = append(variants, f.scope)
+		}
+	}
+	return nil, nil
+}
+
+// unrolled finds the outermost unrolled iteration of a loop, and the states
+// the loop has been unrolled in since.
+func (c path) unrolled(p Point) (*frame, []*bindings) {
+	var first *frame
+	var states []*bindings
+	for f := c.frames; f != nil; f = f.outer {
+		if f.at == p && f.kind == unrolledFrame {
+			first = f.frame
+			states = append(states, f.scope)
+		}
+	}
+	return first, states
+}
+
+// iteration finds the innermost frame for a range that is reached at the
+// given point: either an iteration of the range or the residual loop.
+func (c path) iteration(p *rangeNext) *frame {
+	for f := c.frames; f != nil; f = f.outer {
+		if f.at == Point(p) && (f.kind == rangeFrame || f.kind == loopFrame) {
+			return f.frame
+		}
+	}
+	return nil
+}
+
+// An arrival records a path reaching the point where enclosing branches meet.
+type arrival struct {
+	at    Point
+	scope *bindings
+}
+
+// A restart abandons the code generated for a loop, so that it can be
+// generated again with some of its variables generalized.
+type restart struct {
+	frame *frame
+	names []string
+}
+
+func (r *restart) Error() string {
+	return "restart"
+}
+
+// block generates the code along a path, until it either finishes or reaches
+// a point where the enclosing branches meet.
+func (r *residual) block(p Point, scope *bindings, ctx path) ([]ast.Stmt, []arrival, error) {
+	var out []ast.Stmt
+	for ; ctx.steps < maxSteps; ctx.steps++ {
+		var stmts []ast.Stmt
+		stmts, scope = r.generalize(r.division.dynamic(p), scope)
+		out = append(out, stmts...)
+		// Variables that could be changed through a reference to them are
+		// never known.
+		stmts, scope = r.generalize(r.escaped, scope)
+		out = append(out, stmts...)
+		if stmts, arrivals, ok, err := r.jump(p, scope, ctx); ok {
+			return append(out, stmts...), arrivals, err
+		}
+		switch q := p.(type) {
+		case nil:
+			if ctx.nested() {
+				out = append(out, &ast.ReturnStmt{})
+			}
+			return out, nil, nil
+
+		case *returnValues:
+			return append(out, r.ret(q, scope)), nil, nil
+
+		case *evalExpr:
+			if id := mutated(q.expr, scope.objectOf); id != nil && scope.Lookup(id.Name).Known() {
+				if next := mutate(q.expr, scope).(*bindings); next.Lookup(id.Name).Known() {
+					scope, p = next, q.cont
+					break
+				}
+				// The elements that the call changes are not known, so the
+				// residual program must hold the ones that it does not.
+				stmts, scope = r.generalize([]string{id.Name}, scope)
+				out = append(out, stmts...)
+			}
+			if v := Eval(q.expr, scope)[0]; !v.Known() {
+				out = append(out, &ast.ExprStmt{X: v.Expr()})
+			}
+			if panics(q.expr, scope) {
+				return out, nil, nil
+			}
+			p = q.cont
+
+		case *assign:
+			stmts, scope = r.assign(q, scope)
+			out = append(out, stmts...)
+			stmts, scope = r.generalize(r.division.dynamicDefs(q), scope)
+			out = append(out, stmts...)
+			p = q.cont
+
+		case *declare:
+			out = append(out, &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{q.spec}}})
+			for _, name := range q.spec.Names {
+				scope = scope.declare(name.Name)
+			}
+			p = q.cont
+
+		case *branch:
+			next := q.Successors(scope)
+			if len(next) == 1 {
+				p, scope = next[0].point, next[0].scope.(*bindings)
+				continue
+			}
+			stmts, joined, arrivals, err := r.branch(q, scope, ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			out = append(out, stmts...)
+			if joined == nil {
+				return out, arrivals, nil
+			}
+			p, scope = q.join, joined
+
+		case *loop:
+			next := q.Successors(scope)
+			if len(next) == 1 && next[0].point == q.antecedent {
+				p, scope = next[0].point, next[0].scope.(*bindings)
+				continue
+			}
+			var joined *bindings
+			var arrivals []arrival
+			var err error
+			f, variants := ctx.residualLoop(q)
+			if len(next) == 1 && (q.condition != nil || f == nil) {
+				if f, states := ctx.unrolled(q); len(states) >= maxVariants && ctx.forks > f.forks {
+					// A loop without a condition is left from its body,
+					// which does not know when to do so.
+					return nil, nil, &restart{f, differences(append(states, scope))}
+				}
+				stmts, joined, arrivals, err = r.unroll(q, scope, ctx)
+			} else if f != nil {
+				// The loop has returned to its header in a new state.
+				if len(variants) >= maxVariants {
+					states := append(variants, f.scope, scope)
+					return nil, nil, &restart{f, differences(states)}
+				}
+				ctx := ctx.enter(newFrame(variantFrame, q, scope))
+				if q.condition == nil {
+					stmts, arrivals, err = r.block(q.consequent, scope, ctx)
+				} else {
+					stmts, joined, arrivals, err = r.branch(&q.branch, scope, ctx)
+				}
+			} else {
+				stmts, joined, arrivals, err = r.loop(q, scope, ctx)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			out = append(out, stmts...)
+			if joined == nil {
+				return out, arrivals, nil
+			}
+			p, scope = q.antecedent, joined
+
+		case *rangeLoop:
+			items, ok := q.items(scope, r.sortMaps)
+			if ok {
+				f := &frame{kind: rangeFrame, at: q.next, items: items}
+				p, ctx = q.next, ctx.enter(f)
+				continue
+			}
+			stmts, joined, arrivals, err := r.rangeStmt(q, scope, ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			out = append(out, stmts...)
+			if joined == nil {
+				return out, arrivals, nil
+			}
+			p, scope = q.exit, joined
+
+		case *rangeNext:
+			f := ctx.iteration(q)
+			if f.kind == loopFrame {
+				// The residual loop has continued in a new state.
+				return nil, nil, &restart{f, differences([]*bindings{f.scope, scope})}
+			}
+			if len(f.items) == 0 {
+				p = q.loop.exit
+				continue
+			}
+			ctx = ctx.enter(&frame{kind: rangeFrame, at: q, items: f.items[1:]})
+			if bind := q.loop.bind; bind != nil {
+				stmts, scope = r.assignValues(bind, f.items[0][:len(bind.lhs)], scope)
+				out = append(out, stmts...)
+				stmts, scope = r.generalize(r.division.dynamicDefs(q.loop), scope)
+				out = append(out, stmts...)
+			}
+			p = q.loop.body
+
+		case *choice:
+			next := q.Successors(scope)
+			if len(next) == 1 {
+				p, scope = next[0].point, next[0].scope.(*bindings)
+				continue
+			}
+			stmts, joined, arrivals, err := r.choose(q, scope, ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			out = append(out, stmts...)
+			if joined == nil {
+				return out, arrivals, nil
+			}
+			p, scope = q.join, joined
+
+		case *unsupported:
+			return nil, nil, &UnsupportedError{q.stmt}
+		}
+	}
+	return nil, nil, errNoTermination
+}
+
+// jump handles a path reaching a point that an enclosing construct deals with.
+func (r *residual) jump(p Point, scope *bindings, ctx path) ([]ast.Stmt, []arrival, bool, error) {
+	inner := false
+	switched := false // a break would leave a switch instead
+	for fs := ctx.frames; fs != nil; fs = fs.outer {
+		f := fs.frame
+		switch f.kind {
+		case joinFrame:
+			if f.at == p {
+				return nil, []arrival{{p, scope}}, true, nil
+			}
+
+		case loopFrame:
+			if f.at != p && f.exit != p {
+				inner = true
+				continue
+			}
+			out, scope := r.generalize(f.generalized, scope)
+			if f.exit == p {
+				stmts, scope := r.sync(f.synced, scope)
+				f.exits = append(f.exits, arrival{p, scope})
+				out = append(out, stmts...)
+				return append(out, r.branchStmt(token.BREAK, f, inner || switched)), nil, true, nil
+			}
+			if f.matches(p, scope, scope.Hash()) {
+				// The residual program must hold the same values as it did
+				// on entering the loop.
+				for _, name := range sortedNames(f.scope) {
+					h, ok := f.scope.held[name]
+					if ok && !h.Matches(scope.held[name]) {
+						out = append(out, assignStmt(name, valueExpr(h, r.types[name])))
+					}
+				}
+				return append(out, r.branchStmt(token.CONTINUE, f, inner)), nil, true, nil
+			}
+			inner = true
+
+		case switchFrame:
+			switched = true
+		}
+	}
+	hash := scope.Hash()
+	for _, f := range r.memo[memoKey{p, hash}] {
+		if f.matches(p, scope, hash) {
+			return nil, nil, true, &restart{frame: f}
+		}
+	}
+	return nil, nil, false, nil
+}
+
+// branchStmt creates a statement that transfers control to a loop, labelling
+// the loop if it is not the innermost one.
+func (r *residual) branchStmt(tok token.Token, f *frame, inner bool) ast.Stmt {
+	if !inner {
+		return &ast.BranchStmt{Tok: tok}
+	}
+	if f.label == "" {
+		r.labels++
+		f.label = fmt.Sprintf("loop%d", r.labels)
+	}
+	return &ast.BranchStmt{Tok: tok, Label: &ast.Ident{Name: f.label}}
+}
+
+// branch generates an if statement for a branch whose condition is not known.
+// When the paths through the branch meet again in compatible states, the code
+// that follows is shared between them, and the state where they meet is
+// returned. Otherwise each path is generated to its end.
+func (r *residual) branch(p *branch, scope *bindings, ctx path) ([]ast.Stmt, *bindings, []arrival, error) {
+	var out []ast.Stmt
+	for p.join != nil {
+		inner := ctx.enter(newFrame(joinFrame, p.join, scope))
+		then, els, arrivals, err := r.paths(p, scope, inner)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !arrive(arrivals, p.join) {
+			break
+		}
+		joined, hoist, conflicts := merge(scope, arrivals)
+		if conflicts != nil {
+			break
+		}
+		if hoist != nil {
+			// Variables that become unknown in both paths must be declared
+			// before the branch.
+			var stmts []ast.Stmt
+			stmts, scope = r.generalize(hoist, scope)
+			out = append(out, stmts...)
+			continue
+		}
+		cond := Eval(p.condition, scope)[0].Expr()
+		return append(out, ifStmt(cond, then, els)...), joined, nil, nil
+	}
+	then, els, arrivals, err := r.paths(p, scope, ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cond := Eval(p.condition, scope)[0].Expr()
+	return append(out, ifStmt(cond, then, els)...), nil, arrivals, nil
+}
+
+func (r *residual) paths(p *branch, scope *bindings, ctx path) ([]ast.Stmt, []ast.Stmt, []arrival, error) {
+	next := p.Successors(scope)
+	ctx.forks++
+	then, ta, err := r.block(next[0].point, next[0].scope.(*bindings), ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	els, ea, err := r.block(next[1].point, next[1].scope.(*bindings), ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return then, els, append(ta, ea...), nil
+}
+
+// choose generates a switch statement for a switch whose case is not known,
+// with only the cases that could be taken. The paths through it meet again
+// in the same way as those through a branch.
+func (r *residual) choose(p *choice, scope *bindings, ctx path) ([]ast.Stmt, *bindings, []arrival, error) {
+	var out []ast.Stmt
+	for p.join != nil {
+		inner := ctx.enter(newFrame(joinFrame, p.join, scope))
+		stmt, arrivals, err := r.cases(p, scope, inner)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !arrive(arrivals, p.join) {
+			break
+		}
+		joined, hoist, conflicts := merge(scope, arrivals)
+		if conflicts != nil {
+			break
+		}
+		if hoist != nil {
+			var stmts []ast.Stmt
+			stmts, scope = r.generalize(hoist, scope)
+			out = append(out, stmts...)
+			continue
+		}
+		return append(out, stmt), joined, nil, nil
+	}
+	stmt, arrivals, err := r.cases(p, scope, ctx)
+	return append(out, stmt), nil, arrivals, err
+}
+
+func (r *residual) cases(p *choice, scope *bindings, ctx path) (ast.Stmt, []arrival, error) {
+	tag, arms := p.arms(scope)
+	ctx = ctx.enter(&frame{kind: switchFrame})
+	ctx.forks++
+	body := &ast.BlockStmt{}
+	var arrivals []arrival
+	for _, a := range arms {
+		scope := a.scope.(*bindings)
+		if p.bind != nil && a.point != p.join {
+			scope = scope.declare(p.bind.Name)
+		}
+		stmts, as, err := r.block(a.point, scope, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		arrivals = append(arrivals, as...)
+		if a.values == nil && len(stmts) == 0 {
+			continue
+		}
+		body.List = append(body.List, &ast.CaseClause{List: a.values, Body: stmts})
+	}
+	if p.typed {
+		return typeSwitch(p.bind, tag.Expr(), body), arrivals, nil
+	}
+	res := &ast.SwitchStmt{Body: body}
+	if p.tag != nil {
+		res.Tag = tag.Expr()
+	}
+	return res, arrivals, nil
+}
+
+// typeSwitch creates a type switch statement, which only binds a variable if
+// some case refers to it.
+func typeSwitch(bind *ast.Ident, x ast.Expr, body *ast.BlockStmt) ast.Stmt {
+	var guard ast.Stmt = &ast.ExprStmt{X: &ast.TypeAssertExpr{X: x}}
+	reads := map[string]bool{}
+	collectReads(body, reads)
+	if bind != nil && reads[bind.Name] {
+		guard = &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{Name: bind.Name}},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.TypeAssertExpr{X: x}},
+		}
+	}
+	return &ast.TypeSwitchStmt{Assign: guard, Body: body}
+}
+
+// unroll generates the code for an iteration of a loop whose condition is
+// known to hold. If the loop returns to the same state it is generated as a
+// residual loop instead.
+func (r *residual) unroll(p *loop, scope *bindings, ctx path) ([]ast.Stmt, *bindings, []arrival, error) {
+	f := newFrame(unrolledFrame, p, scope)
+	f.forks = ctx.forks
+	key := memoKey{p, f.hash}
+	r.memo[key] = append(r.memo[key], f)
+	next := p.Successors(scope)
+	stmts, arrivals, err := r.block(next[0].point, next[0].scope.(*bindings), ctx.enter(f))
+	r.memo[key] = r.memo[key][:len(r.memo[key])-1]
+	if rs, ok := err.(*restart); ok && rs.frame == f {
+		out, scope := r.generalize(rs.names, scope)
+		stmts, joined, arrivals, err := r.loop(p, scope, ctx)
+		return append(out, stmts...), joined, arrivals, err
+	}
+	return stmts, nil, arrivals, err
+}
+
+// loop generates a for statement for a loop, which continues until control
+// returns to the loop in the same state it entered in. Variables whose values
+// differ between iterations, or between the paths leaving the loop, are
+// generalized to make this possible.
+func (r *residual) loop(p *loop, scope *bindings, ctx path) ([]ast.Stmt, *bindings, []arrival, error) {
+	var out, stmts []ast.Stmt
+	var generalized, synced []string
+	for {
+		f := newFrame(loopFrame, p, scope)
+		f.exit = p.antecedent
+		f.generalized = generalized
+		f.synced = synced
+		next := p.Successors(scope)
+		var cond ast.Expr
+		if len(next) == 2 {
+			cond = Eval(p.condition, scope)[0].Expr()
+			f.exits = append(f.exits, arrival{p.antecedent, next[1].scope.(*bindings)})
+		}
+		body, arrivals, err := r.block(next[0].point, next[0].scope.(*bindings), ctx.enter(f))
+		if rs, ok := err.(*restart); ok && rs.frame == f {
+			if rs.names == nil {
+				return nil, nil, nil, errNoTermination
+			}
+			generalized = append(generalized, rs.names...)
+			stmts, scope = r.generalize(rs.names, scope)
+			out = append(out, stmts...)
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if arrivals != nil {
+			return nil, nil, nil, errors.New("unstructured control flow")
+		}
+		joined, hoist, conflicts := merge(scope, f.exits)
+		if hoist != nil || conflicts != nil {
+			// Variables the paths leaving the loop disagree on must be
+			// held by the residual program when they do so.
+			synced = append(synced, conflicts...)
+			stmts, scope = r.generalize(hoist, scope)
+			out = append(out, stmts...)
+			stmts, scope = r.sync(conflicts, scope)
+			out = append(out, stmts...)
+			continue
+		}
+		var stmt ast.Stmt = &ast.ForStmt{Cond: cond, Body: &ast.BlockStmt{List: trimContinue(body)}}
+		if f.label != "" {
+			stmt = &ast.LabeledStmt{Label: &ast.Ident{Name: f.label}, Stmt: stmt}
+		}
+		return append(out, stmt), joined, nil, nil
+	}
+}
+
+// rangeStmt generates a range statement for a range whose iterations are not
+// known. Its body is generated once, with the variables that differ between
+// iterations generalized, in the same way as the body of a residual loop.
+func (r *residual) rangeStmt(p *rangeLoop, scope *bindings, ctx path) ([]ast.Stmt, *bindings, []arrival, error) {
+	var out, stmts []ast.Stmt
+	if p.mutated {
+		// The residual program must range over the collection that the body
+		// changes, rather than a copy of it.
+		stmts, scope = r.generalize([]string{rootName(p.stmt.X)}, scope)
+		out = append(out, stmts...)
+	}
+	var lhs []string
+	if p.bind != nil && !p.bind.define {
+		for _, x := range p.bind.lhs {
+			if name, ok := assigned(x, scope); ok {
+				lhs = append(lhs, name)
+			}
+		}
+	}
+	stmts, scope = r.generalize(lhs, scope)
+	out = append(out, stmts...)
+	var vars []ast.Expr
+	if p.bind != nil {
+		for _, x := range p.bind.lhs {
+			x, stmts, scope = r.lvalue(x, scope)
+			out = append(out, stmts...)
+			vars = append(vars, x)
+		}
+	}
+	var generalized, synced []string
+	for {
+		res := &ast.RangeStmt{X: Eval(p.stmt.X, scope)[0].Expr()}
+		entered := scope
+		if p.bind != nil {
+			entered = p.bind.bind(entered, nil).(*bindings)
+			if p.bind.define {
+				for _, x := range vars {
+					if name := x.(*ast.Ident).Name; name != "_" {
+						entered = entered.declare(name)
+					}
+				}
+			}
+			res.Key, res.Tok = vars[0], p.stmt.Tok
+			if len(vars) > 1 {
+				res.Value = vars[1]
+			}
+		}
+		f := newFrame(loopFrame, p.next, entered)
+		f.exit = p.exit
+		f.generalized = generalized
+		f.synced = synced
+		f.exits = []arrival{{p.exit, scope}}
+		body, arrivals, err := r.block(p.body, entered, ctx.enter(f))
+		if rs, ok := err.(*restart); ok && rs.frame == f {
+			if rs.names == nil {
+				return nil, nil, nil, errNoTermination
+			}
+			generalized = append(generalized, rs.names...)
+			stmts, scope = r.generalize(rs.names, scope)
+			out = append(out, stmts...)
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if arrivals != nil {
+			return nil, nil, nil, errors.New("unstructured control flow")
+		}
+		joined, hoist, conflicts := merge(scope, f.exits)
+		if hoist != nil || conflicts != nil {
+			synced = append(synced, conflicts...)
+			stmts, scope = r.generalize(hoist, scope)
+			out = append(out, stmts...)
+			stmts, scope = r.sync(conflicts, scope)
+			out = append(out, stmts...)
+			continue
+		}
+		res.Body = &ast.BlockStmt{List: trimContinue(body)}
+		var stmt ast.Stmt = res
+		if f.label != "" {
+			stmt = &ast.LabeledStmt{Label: &ast.Ident{Name: f.label}, Stmt: stmt}
+		}
+		return append(out, stmt), joined, nil, nil
+	}
+}
+
+// generalize makes the given variables unknown, ensuring that they exist in
+// the residual program.
+func (r *residual) generalize(names []string, scope *bindings) ([]ast.Stmt, *bindings) {
+	var out []ast.Stmt
+	for _, name := range names {
+		var stmts []ast.Stmt
+		stmts, scope = r.materialize(name, scope)
+		out = append(out, stmts...)
+	}
+	return out, scope
+}
+
+// sync ensures that the residual program holds the known values of the given
+// variables, which remain known.
+func (r *residual) sync(names []string, scope *bindings) ([]ast.Stmt, *bindings) {
+	var out []ast.Stmt
+	for _, name := range names {
+		v := scope.Lookup(name)
+		if scope.holds(name) && scope.declared[name] {
+			continue
+		}
+		var stmts []ast.Stmt
+		stmts, scope = r.materialize(name, scope)
+		out = append(out, stmts...)
+		scope = scope.refine(name, v).(*bindings)
+	}
+	return out, scope
+}
+
+// differences finds the variables to generalize, given the states a loop has
+// been in. Those that never repeat a value are chosen if there are any,
+// otherwise all of those that vary.
+func differences(states []*bindings) []string {
+	var varying, unique []string
+	for _, name := range sortedNames(states...) {
+		var seen []Value
+		repeats := false
+		for _, s := range states {
+			v := s.Lookup(name)
+			for _, w := range seen {
+				repeats = repeats || v.Matches(w)
+			}
+			seen = append(seen, v)
+		}
+		known := false
+		for _, w := range seen {
+			known = known || w.Known()
+		}
+		if !known {
+			continue
+		}
+		if !repeats {
+			unique = append(unique, name)
+		}
+		for _, w := range seen {
+			if !w.Matches(seen[0]) {
+				varying = append(varying, name)
+				break
+			}
+		}
+	}
+	if unique != nil {
+		return unique
+	}
+	return varying
+}
+
+func sortedNames(scopes ...*bindings) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, s := range scopes {
+		for name := range s.values {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func forgettable(name string, arrivals []arrival) bool {
+	for _, a := range arrivals {
+		if !a.scope.declared[name] || !a.scope.holds(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func arrive(arrivals []arrival, at Point) bool {
+	for _, a := range arrivals {
+		if a.at != at {
+			return false
+		}
+	}
+	return true
+}
+
+// merge combines the states of paths that arrive at the same point. The paths
+// must agree on the known values of the variables that were in scope before
+// they diverged; those that they do not agree on are returned as conflicts.
+// The names of variables that must be declared before the paths diverge are
+// also returned.
+func merge(scope *bindings, arrivals []arrival) (joined *bindings, hoist, conflicts []string) {
+	if len(arrivals) == 0 {
+		return nil, nil, nil
+	}
+	joined = scope.copy()
+	for _, name := range sortedNames(scope) {
+		v := arrivals[0].scope.Lookup(name)
+		held := arrivals[0].scope.held[name]
+		for _, a := range arrivals {
+			if h := a.scope.held[name]; held != nil && (h == nil || !h.Matches(held)) {
+				held = nil
+			}
+			w := a.scope.Lookup(name)
+			if v.Matches(w) {
+				continue
+			}
+			// Known values that the residual variable holds anyway can
+			// be forgotten.
+			if !forgettable(name, arrivals) {
+				conflicts = append(conflicts, name)
+				break
+			}
+			v = &UnknownValue{&ast.Ident{Name: name}}
+		}
+		if !v.Known() && !scope.declared[name] {
+			hoist = append(hoist, name)
+		}
+		if s, ok := v.(*StructValue); ok {
+			for _, n := range fieldVars(s) {
+				if !scope.declared[n] {
+					hoist = append(hoist, n)
+				}
+			}
+		}
+		joined.values[name] = v
+		delete(joined.held, name)
+		if held != nil {
+			joined.held[name] = held
+		}
+	}
+	if conflicts != nil {
+		return nil, nil, conflicts
+	}
+	return joined, hoist, nil
+}
+
+func (r *residual) ret(p *returnValues, scope *bindings) ast.Stmt {
+	if p.results != nil {
+		values := append([]Value(nil), evalArgs(p.results, scope)...)
+		results := make([]ast.Expr, len(values))
+		for i, v := range values {
+			t := r.resultType(i, len(values))
+			values[i] = assignable(v, t, r.pkg)
+			results[i] = valueExpr(v, t)
+		}
+		ret := &ast.ReturnStmt{Results: results}
+		r.returns[ret] = values
+		return ret
+	}
+	var results []ast.Expr
+	dynamic := true
+	for i, name := range r.results {
+		v := scope.Lookup(name)
+		results = append(results, valueExpr(v, r.resultType(i, len(r.results))))
+		if id, ok := v.Expr().(*ast.Ident); !ok || id.Name != name {
+			dynamic = false
+		}
+	}
+	if dynamic {
+		return &ast.ReturnStmt{}
+	}
+	return &ast.ReturnStmt{Results: results}
+}
+
+// resultType gives the type of a function result, if the function has the
+// given number of results.
+func (r *residual) resultType(i, n int) types.Type {
+	if r.sig == nil || r.sig.Results().Len() != n {
+		return nil
+	}
+	return r.sig.Results().At(i).Type()
+}
+
+func (r *residual) assign(p *assign, scope *bindings) ([]ast.Stmt, *bindings) {
+	return r.assignValues(p, evalArgs(p.rhs, scope), scope)
+}
+
+// assignValues assigns values that have already been evaluated.
+func (r *residual) assignValues(p *assign, rhs []Value, scope *bindings) ([]ast.Stmt, *bindings) {
+	var out []ast.Stmt
+	var lhs, values []ast.Expr
+	if len(rhs) == len(p.lhs) {
+		rhs = append([]Value(nil), rhs...)
+		for i, x := range p.lhs {
+			if name, path, ok := fieldPath(x); ok {
+				if cell, ok := deref(&ast.Ident{Name: name}, scope); ok {
+					name = cell
+				}
+				// Assigning to a field of a struct that is held as a value
+				// updates the value.
+				if v, ok := scope.Lookup(name).(*StructValue); ok {
+					if v = withField(v, path, rhs[i]); v != nil {
+						scope = scope.Bind(name, r.split(name, v, &lhs, &values)).(*bindings)
+						continue
+					}
+				}
+			}
+			name, whole := assigned(x, scope)
+			if v, ok := rhs[i].(*StructValue); ok && whole && !isBlank(x) {
+				rhs[i] = r.split(name, v, &lhs, &values)
+				continue
+			}
+			if whole && rhs[i].Known() {
+				continue
+			}
+			var stmts []ast.Stmt
+			x, stmts, scope = r.lvalue(x, scope)
+			out = append(out, stmts...)
+			lhs = append(lhs, x)
+			values = append(values, valueExpr(rhs[i], r.lhsType(x)))
+		}
+	} else {
+		for _, x := range p.lhs {
+			var stmts []ast.Stmt
+			x, stmts, scope = r.lvalue(x, scope)
+			out = append(out, stmts...)
+			lhs = append(lhs, x)
+		}
+		values = []ast.Expr{rhs[0].Expr()}
+	}
+	next := p.bind(scope, rhs).(*bindings)
+	if lhs == nil {
+		return out, next
+	}
+
+	// Variables that do not yet exist in the residual program must be
+	// declared by the assignment.
+	var fresh []string
+	blank := 0
+	for _, x := range lhs {
+		id, ok := x.(*ast.Ident)
+		switch {
+		case !ok || scope.declared[id.Name]:
+		case id.Name == "_":
+			blank++
+		default:
+			fresh = append(fresh, id.Name)
+			next = next.declare(id.Name)
+		}
+	}
+	tok := token.ASSIGN
+	if len(fresh) > 0 {
+		tok = token.DEFINE
+	}
+	if len(fresh) > 0 && len(fresh)+blank < len(lhs) {
+		tok = token.ASSIGN
+		for _, name := range fresh {
+			t := r.types[name]
+			if t == nil {
+				tok = token.DEFINE
+				continue
+			}
+			out = append(out, r.varDecl(name, t, nil))
+		}
+	}
+	return append(out, &ast.AssignStmt{Lhs: lhs, Tok: tok, Rhs: values}), next
+}
+
+// split gives the value of a struct as it is held in a variable. The fields that
+// are not known are held in variables of their own, rather than in the struct,
+// and the assignments to them are added to lhs and values.
+func (r *residual) split(name string, v *StructValue, lhs, values *[]ast.Expr) *StructValue {
+	s := v.typ.Underlying().(*types.Struct)
+	fields := make([]Value, len(v.fields))
+	for i, f := range v.fields {
+		field := s.Field(i)
+		if f, ok := f.(*StructValue); ok {
+			fields[i] = r.split(r.fieldVar(name, field), f, lhs, values)
+			continue
+		}
+		if f.Known() {
+			fields[i] = f
+			continue
+		}
+		n := r.fieldVar(name, field)
+		fields[i] = &UnknownValue{&ast.Ident{Name: n}}
+		if id, ok := f.Expr().(*ast.Ident); ok && id.Name == n {
+			continue
+		}
+		*lhs = append(*lhs, &ast.Ident{Name: n})
+		*values = append(*values, f.Expr())
+	}
+	return &StructValue{v.compositeValue, fields}
+}
+
+// fieldVar names the variable that holds a field of a struct variable.
+func (r *residual) fieldVar(name string, field *types.Var) string {
+	n := name + strings.ToUpper(field.Name()[:1]) + field.Name()[1:]
+	for r.types[n] != nil && !r.fields[n] {
+		n += "_"
+	}
+	r.types[n] = field.Type()
+	r.fields[n] = true
+	return n
+}
+
+func isBlank(x ast.Expr) bool {
+	id, ok := x.(*ast.Ident)
+	return ok && id.Name == "_"
+}
+
+// lvalue produces the residual form of an expression being assigned to. The
+// variable that is ultimately being updated is made available in the residual
+// program.
+func (r *residual) lvalue(x ast.Expr, scope *bindings) (ast.Expr, []ast.Stmt, *bindings) {
+	switch x := x.(type) {
+	case *ast.Ident:
+		return &ast.Ident{Name: x.Name}, nil, scope
+
+	case *ast.ParenExpr:
+		return r.lvalue(x.X, scope)
+
+	case *ast.IndexExpr:
+		base, stmts, scope := r.base(x.X, scope)
+		return &ast.IndexExpr{X: base, Index: Eval(x.Index, scope)[0].Expr()}, stmts, scope
+
+	case *ast.SelectorExpr:
+		base, stmts, scope := r.base(x.X, scope)
+		return &ast.SelectorExpr{X: base, Sel: x.Sel}, stmts, scope
+
+	case *ast.StarExpr:
+		if cell, ok := deref(x.X, scope); ok {
+			return &ast.Ident{Name: cell}, nil, scope
+		}
+		return &ast.StarExpr{X: Eval(x.X, scope)[0].Expr()}, nil, scope
+	}
+	return x, nil, scope
+}
+
+// base produces the residual form of an expression whose field or element is
+// being assigned to. Fields and elements are reached through known pointers.
+func (r *residual) base(x ast.Expr, scope *bindings) (ast.Expr, []ast.Stmt, *bindings) {
+	if id, ok := x.(*ast.Ident); ok {
+		if _, ok := scope.Lookup(id.Name).(*PointerValue); ok {
+			x = &ast.StarExpr{X: id}
+		}
+	}
+	if name, ok := assigned(x, scope); ok {
+		stmts, scope := r.materialize(name, scope)
+		return &ast.Ident{Name: name}, stmts, scope
+	}
+	return r.lvalue(x, scope)
+}
+
+// assigned gives the variable that an assignment to an expression sets: a
+// variable, or the variable that a known pointer points to.
+func assigned(x ast.Expr, scope *bindings) (string, bool) {
+	switch x := ast.Unparen(x).(type) {
+	case *ast.Ident:
+		return x.Name, true
+	case *ast.StarExpr:
+		return deref(x.X, scope)
+	}
+	return "", false
+}
+
+// materialize ensures that a variable exists in the residual program, holding
+// its current value.
+func (r *residual) materialize(name string, scope *bindings) ([]ast.Stmt, *bindings) {
+	v := scope.Lookup(name)
+	if !v.Known() && !refersTo(v, name) {
+		// A variable that stands for an expression, as the parameter of a
+		// function stands for its argument, must hold its value from here on.
+		var stmt ast.Stmt
+		if scope.declared[name] {
+			stmt = assignStmt(name, v.Expr())
+		} else {
+			stmt = r.define(name, v)
+		}
+		scope = scope.Bind(name, &UnknownValue{&ast.Ident{Name: name}}).(*bindings)
+		return []ast.Stmt{stmt}, scope.declare(name)
+	}
+	if !v.Known() {
+		// A variable that holds the field of a struct may be needed before
+		// it is assigned to.
+		if (r.fields[name] || r.cells[name]) && !scope.declared[name] {
+			return []ast.Stmt{r.varDecl(name, r.types[name], nil)}, scope.declare(name)
+		}
+		return nil, scope
+	}
+	if scope.declared[name] {
+		return []ast.Stmt{assignStmt(name, valueExpr(v, r.types[name]))}, scope.declare(name)
+	}
+	return []ast.Stmt{r.define(name, v)}, scope.declare(name)
+}
+
+// refersTo reports whether a value is that of the variable with the given name.
+func refersTo(v Value, name string) bool {
+	id, ok := v.Expr().(*ast.Ident)
+	return ok && id.Name == name
+}
+
+// define declares a variable in the residual program with a known initial
+// value.
+func (r *residual) define(name string, v Value) ast.Stmt {
+	if t := r.types[name]; t != nil && !types.Identical(t, defaultType(v)) {
+		return r.varDecl(name, t, valueExpr(v, t))
+	}
+	return &ast.AssignStmt{
+		Lhs: []ast.Expr{&ast.Ident{Name: name}},
+		Tok: token.DEFINE,
+		Rhs: []ast.Expr{v.Expr()},
+	}
+}
+
+func (r *residual) varDecl(name string, t types.Type, value ast.Expr) ast.Stmt {
+	spec := &ast.ValueSpec{Names: []*ast.Ident{{Name: name}}, Type: r.typeExpr(t)}
+	if value != nil {
+		spec.Values = []ast.Expr{value}
+	}
+	return &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{spec}}}
+}
+
+func (r *residual) typeExpr(t types.Type) ast.Expr {
+	return typeExpr(t, r.pkg)
+}
+
+// defaultType gives the type of a variable declared with v as its initial
+// value.
+func defaultType(v Value) types.Type {
+	switch v := v.(type) {
+	case basicValue:
+		return types.Default(v.basic().typ)
+	case interface{ composite() *compositeValue }:
+		return v.composite().typ
+	case *PointerValue:
+		return v.typ
+	case *FuncValue:
+		return v.typ
+	case *ClosureValue:
+		return v.typ
+	}
+	return nil
+}
+
+// valueExpr gives the residual form of a value that is assigned to something
+// of a given type, which constants need not be converted to.
+func valueExpr(v Value, t types.Type) ast.Expr {
+	if c, ok := v.(basicValue); ok && t != nil && types.Identical(c.basic().typ, t) {
+		return c.basic().literal()
+	}
+	return v.Expr()
+}
+
+// escapes finds the variables that can change without being assigned to, and
+// names the variables that calls to new allocate. Pointers that pointers finds
+// are followed, except offline, where the division decides what is known.
+func (r *residual) escapes(body *ast.BlockStmt, info *types.Info) map[*ast.CallExpr]string {
+	var refs map[*ast.UnaryExpr]bool
+	allocs := map[*ast.CallExpr]string{}
+	if r.division == nil {
+		var sites map[*ast.CallExpr]string
+		refs, sites = pointers(body, info)
+		var calls []*ast.CallExpr
+		for call := range sites {
+			calls = append(calls, call)
+		}
+		sort.Slice(calls, func(i, j int) bool {
+			return calls[i].Pos() < calls[j].Pos()
+		})
+		for _, call := range calls {
+			name := sites[call] + "Val"
+			for r.types[name] != nil {
+				name += "_"
+			}
+			r.types[name] = info.TypeOf(call.Args[0])
+			r.cells[name] = true
+			allocs[call] = name
+		}
+	}
+	escaped := append(addressed(body, info, refs), shared(body, info)...)
+	r.escaped = uniqueNames(append(escaped, captured(body, info)...))
+	return allocs
+}
+
+// addressed finds the variables whose address is taken in a function body,
+// including by calling methods with pointer receivers. Addresses taken by the
+// given expressions are not counted.
+func addressed(body *ast.BlockStmt, info *types.Info, skip map[*ast.UnaryExpr]bool) []string {
+	var names []string
+	add := func(x ast.Expr) {
+		for {
+			switch y := x.(type) {
+			case *ast.ParenExpr:
+				x = y.X
+				continue
+			case *ast.SelectorExpr:
+				x = y.X
+				continue
+			case *ast.IndexExpr:
+				x = y.X
+				continue
+			case *ast.Ident:
+				names = append(names, y.Name)
+			}
+			return
+		}
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.UnaryExpr:
+			if n.Op == token.AND && !skip[n] {
+				add(n.X)
+			}
+		case *ast.SelectorExpr:
+			// The method is found from its name, as info need not hold
+			// selections.
+			fn, ok := info.Uses[n.Sel].(*types.Func)
+			if !ok || !info.Types[n.X].IsValue() {
+				break
+			}
+			recv := fn.Type().(*types.Signature).Recv()
+			if recv == nil {
+				break
+			}
+			if _, ptr := recv.Type().(*types.Pointer); !ptr {
+				break
+			}
+			if _, ptr := info.TypeOf(n.X).Underlying().(*types.Pointer); !ptr {
+				add(n.X)
+			}
+		}
+		return true
+	})
+	return uniqueNames(names)
+}
+
+// shared finds the slice and map variables in a function body whose elements
+// could be changed, either by assigning to them or by sharing them with other
+// code. Slices and maps that are only read from can be known, as can slices
+// that are only appended to in place, as in s = append(s, x), or copied into,
+// and maps that are only deleted from.
+func shared(body *ast.BlockStmt, info *types.Info) []string {
+	reads := map[*ast.Ident]bool{}
+	writes := map[*ast.Ident]bool{}
+	elem := func(x ast.Expr) *ast.Ident {
+		if x, ok := ast.Unparen(x).(*ast.IndexExpr); ok {
+			id, _ := ast.Unparen(x.X).(*ast.Ident)
+			return id
+		}
+		return nil
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IndexExpr:
+			if id, ok := ast.Unparen(n.X).(*ast.Ident); ok {
+				reads[id] = true
+			}
+		case *ast.ExprStmt:
+			// Statements that copy into a slice or delete from a map change
+			// the variable that holds it, rather than sharing it.
+			if id := mutated(n.X, info.ObjectOf); id != nil {
+				reads[id] = true
+			}
+		case *ast.CallExpr:
+			if id, ok := ast.Unparen(n.Fun).(*ast.Ident); ok && len(n.Args) == 1 {
+				if b, ok := info.Uses[id].(*types.Builtin); ok && (b.Name() == "len" || b.Name() == "cap") {
+					if id, ok := ast.Unparen(n.Args[0]).(*ast.Ident); ok {
+						reads[id] = true
+					}
+				}
+			}
+			if id, ok := ast.Unparen(n.Fun).(*ast.Ident); ok && len(n.Args) == 2 {
+				if b, ok := info.Uses[id].(*types.Builtin); ok && b.Name() == "copy" {
+					if id, ok := ast.Unparen(n.Args[1]).(*ast.Ident); ok {
+						reads[id] = true
+					}
+				}
+			}
+			if appended(n, info) != nil && n.Ellipsis.IsValid() {
+				// The elements of the last argument are copied.
+				if id, ok := ast.Unparen(n.Args[len(n.Args)-1]).(*ast.Ident); ok {
+					reads[id] = true
+				}
+			}
+		case *ast.RangeStmt:
+			if id, ok := ast.Unparen(n.X).(*ast.Ident); ok {
+				reads[id] = true
+			}
+		case *ast.AssignStmt:
+			for i, x := range n.Lhs {
+				if id, ok := x.(*ast.Ident); ok {
+					reads[id] = true
+					if len(n.Rhs) == len(n.Lhs) {
+						if s := appended(n.Rhs[i], info); s != nil && s.Name == id.Name {
+							reads[s] = true
+						}
+					}
+				} else if id := elem(x); id != nil {
+					writes[id] = true
+				}
+			}
+		case *ast.IncDecStmt:
+			if id := elem(n.X); id != nil {
+				writes[id] = true
+			}
+		}
+		return true
+	})
+	var names []string
+	for id, obj := range info.Uses {
+		if id.Pos() < body.Pos() || id.Pos() >= body.End() {
+			continue
+		}
+		if _, ok := obj.(*types.Var); !ok {
+			continue
+		}
+		switch obj.Type().Underlying().(type) {
+		case *types.Slice, *types.Map:
+			if !reads[id] || writes[id] {
+				names = append(names, id.Name)
+			}
+		}
+	}
+	return names
+}
+
+// appended gives the variable that a call to append appends to.
+func appended(x ast.Expr, info *types.Info) *ast.Ident {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return nil
+	}
+	fun, ok := ast.Unparen(call.Fun).(*ast.Ident)
+	if b, builtin := info.Uses[fun].(*types.Builtin); !ok || !builtin || b.Name() != "append" {
+		return nil
+	}
+	id, _ := ast.Unparen(call.Args[0]).(*ast.Ident)
+	return id
+}
+
+func (r *residual) lhsType(x ast.Expr) types.Type {
+	if id, ok := x.(*ast.Ident); ok {
+		return r.types[id.Name]
+	}
+	return nil
+}
+
+func assignStmt(name string, value ast.Expr) ast.Stmt {
+	return &ast.AssignStmt{
+		Lhs: []ast.Expr{&ast.Ident{Name: name}},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{value},
+	}
+}
+
+// trimContinue removes continue statements that end a loop body.
+func trimContinue(body []ast.Stmt) []ast.Stmt {
+	if len(body) == 0 {
+		return body
+	}
+	switch s := body[len(body)-1].(type) {
+	case *ast.BranchStmt:
+		if s.Tok == token.CONTINUE && s.Label == nil {
+			return body[:len(body)-1]
+		}
+	case *ast.IfStmt:
+		s.Body.List = trimContinue(s.Body.List)
+		if els, ok := s.Else.(*ast.BlockStmt); ok {
+			els.List = trimContinue(els.List)
+		}
+	case *ast.SwitchStmt:
+		trimCases(s.Body)
+	case *ast.TypeSwitchStmt:
+		trimCases(s.Body)
+	}
+	return body
+}
+
+func trimCases(body *ast.BlockStmt) {
+	for _, c := range body.List {
+		c := c.(*ast.CaseClause)
+		c.Body = trimContinue(c.Body)
+	}
+}
+
+func ifStmt(cond ast.Expr, then, els []ast.Stmt) []ast.Stmt {
+	if len(then) == 0 && len(els) == 0 {
+		if s := discard(cond); s != nil {
+			return []ast.Stmt{s}
+		}
+		return nil
+	}
+	if len(then) == 0 {
+		cond, then, els = not(cond), els, nil
+	}
+	res := &ast.IfStmt{Cond: cond, Body: &ast.BlockStmt{List: then}}
+	if len(els) == 0 {
+		return []ast.Stmt{res}
+	}
+	if _, ok := then[len(then)-1].(*ast.ReturnStmt); ok {
+		return append([]ast.Stmt{res}, els...)
+	}
+	res.Else = &ast.BlockStmt{List: els}
+	return []ast.Stmt{res}
+}
+
+// discard evaluates an expression for its effects alone, if it has any.
+func discard(x ast.Expr) ast.Stmt {
+	if pure(x) {
+		return nil
+	}
+	if _, ok := ast.Unparen(x).(*ast.CallExpr); ok {
+		return &ast.ExprStmt{X: x}
+	}
+	return &ast.AssignStmt{Lhs: []ast.Expr{&ast.Ident{Name: "_"}}, Tok: token.ASSIGN, Rhs: []ast.Expr{x}}
+}
+
+func not(x ast.Expr) ast.Expr {
+	switch y := x.(type) {
+	case *ast.Ident, *ast.CallExpr, *ast.SelectorExpr, *ast.ParenExpr:
+	case *ast.UnaryExpr:
+		if y.Op == token.NOT {
+			return y.X
+		}
+	default:
+		x = &ast.ParenExpr{X: x}
+	}
+	return &ast.UnaryExpr{Op: token.NOT, X: x}
+}
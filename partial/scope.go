@@ -0,0 +1,177 @@
+package partial
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// bindings is the ExecScope used when specializing a function. Besides the
+// value of each variable it tracks which variables have been declared in the
+// residual program, and the known values that those variables hold there.
+type bindings struct {
+	values   map[string]Value
+	declared map[string]bool
+	held     map[string]Value
+	info     *types.Info
+	vars     map[string]types.Type
+	pkg      *types.Package
+	allocs   map[*ast.CallExpr]string // variables allocated by new
+	res      *residual                // being generated
+}
+
+func newBindings() *bindings {
+	return &bindings{
+		values:   map[string]Value{},
+		declared: map[string]bool{},
+		held:     map[string]Value{},
+	}
+}
+
+func (b *bindings) Lookup(name string) Value {
+	if v, ok := b.values[name]; ok {
+		return v
+	}
+	return &UnknownValue{&ast.Ident{Name: name}}
+}
+
+func (b *bindings) Bind(name string, value Value) ExecScope {
+	c := b.copy()
+	value = assignable(value, b.vars[name], b.pkg)
+	c.values[name] = value
+	if !value.Known() {
+		delete(c.held, name)
+	}
+	return c
+}
+
+// refine records that a variable is known to have a value without it having
+// been assigned to.
+func (b *bindings) refine(name string, value Value) ExecScope {
+	c := b.copy()
+	value = assignable(value, b.vars[name], b.pkg)
+	c.values[name] = value
+	if c.declared[name] {
+		c.held[name] = value
+	}
+	return c
+}
+
+// holds reports whether the residual program holds the value of a variable.
+func (b *bindings) holds(name string) bool {
+	v := b.Lookup(name)
+	if !v.Known() {
+		return true
+	}
+	h, ok := b.held[name]
+	return ok && h.Matches(v)
+}
+
+// Equal reports whether two scopes agree on the known values of variables.
+func (b *bindings) Equal(s ExecScope) bool {
+	c, ok := s.(*bindings)
+	if !ok {
+		return false
+	}
+	for name, v := range b.values {
+		if !v.Matches(c.Lookup(name)) {
+			return false
+		}
+	}
+	for name, v := range c.values {
+		if !v.Matches(b.Lookup(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash is consistent with Equal.
+func (b *bindings) Hash() uint64 {
+	var h uint64
+	for name, v := range b.values {
+		if v.Known() {
+			h ^= hashString(name)*31 + v.Hash()
+		}
+	}
+	return h
+}
+
+func (b *bindings) typeOf(x ast.Expr) (types.TypeAndValue, bool) {
+	if b.info == nil {
+		return types.TypeAndValue{}, false
+	}
+	tv, ok := b.info.Types[x]
+	return tv, ok
+}
+
+func (b *bindings) currentPackage() *types.Package {
+	return b.pkg
+}
+
+// variable reports whether name is a variable of the function, which pointers
+// can be followed to.
+func (b *bindings) variable(name string) bool {
+	_, ok := b.vars[name]
+	return ok
+}
+
+func (b *bindings) allocation(call *ast.CallExpr) (string, bool) {
+	name, ok := b.allocs[call]
+	return name, ok
+}
+
+func (b *bindings) objectOf(id *ast.Ident) types.Object {
+	if b.info == nil {
+		return nil
+	}
+	return b.info.ObjectOf(id)
+}
+
+// function gives a function of the package whose calls are specialized, or a
+// method of x with the value recv.
+func (b *bindings) function(id *ast.Ident, x ast.Expr, recv Value) *FuncValue {
+	if b.res == nil || b.res.calls == nil {
+		return nil
+	}
+	obj, ok := b.info.Uses[id].(*types.Func)
+	decl := b.res.calls.decls[obj]
+	if !ok || decl == nil {
+		return nil
+	}
+	sig := obj.Type().(*types.Signature)
+	if x == nil {
+		if sig.Recv() != nil {
+			return nil
+		}
+	} else if t := b.info.TypeOf(x); t == nil || !types.Identical(t, sig.Recv().Type()) {
+		// Promoted methods, and methods called through pointers, have
+		// another receiver.
+		return nil
+	}
+	return &FuncValue{pkg: b.res.calls, decl: decl, typ: sig, recv: recv}
+}
+
+func (b *bindings) copy() *bindings {
+	c := newBindings()
+	c.info, c.vars, c.pkg, c.allocs, c.res = b.info, b.vars, b.pkg, b.allocs, b.res
+	for k, v := range b.values {
+		c.values[k] = v
+	}
+	for k, v := range b.declared {
+		c.declared[k] = v
+	}
+	for k, v := range b.held {
+		c.held[k] = v
+	}
+	return c
+}
+
+// declare records that name is a variable in the residual program, whose
+// value is not known.
+func (b *bindings) declare(name string) *bindings {
+	c := b.copy()
+	c.values[name] = &UnknownValue{&ast.Ident{Name: name}}
+	c.declared[name] = true
+	delete(c.held, name)
+	return c
+}
@@ -0,0 +1,214 @@
+package partial
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+)
+
+// unshadow gives a copy of a function in which each variable that shadows
+// another of the function has a name of its own, along with the type
+// information for the copy and the names that the variables are given.
+// Variables are told apart by name as a function is specialized, so a variable
+// would otherwise be confused with the one it shadows. A function without
+// shadowed variables is given as it is.
+func unshadow(decl *ast.FuncDecl, info *types.Info) (*ast.FuncDecl, *types.Info, map[types.Object]string) {
+	names := shadowing(decl, info)
+	if len(names) == 0 {
+		return decl, info, nil
+	}
+	c := &copier{copies: map[ast.Node]ast.Node{}}
+	res := c.copy(reflect.ValueOf(decl)).Interface().(*ast.FuncDecl)
+	renamed := map[token.Pos]string{}
+	for obj, name := range names {
+		renamed[obj.Pos()] = name
+	}
+	for n, m := range c.copies {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		obj, def := info.Defs[id]
+		if obj == nil && !def {
+			obj = info.Uses[id]
+		}
+		if name, ok := names[obj]; ok {
+			m.(*ast.Ident).Name = name
+		} else if name, ok := renamed[id.Pos()]; ok && def && obj == nil {
+			// The variable of a type switch, which each clause declares.
+			m.(*ast.Ident).Name = name
+		}
+	}
+	return res, copyInfo(info, c.copies), names
+}
+
+// shadowing finds the variables of a function that shadow others of it, and
+// gives each a new name. The variables that a type switch declares in each of
+// its clauses are given the same name.
+func shadowing(decl *ast.FuncDecl, info *types.Info) map[types.Object]string {
+	taken := map[string]bool{}
+	seen := map[types.Object]bool{}
+	var vars []types.Object
+	add := func(obj types.Object) {
+		v, ok := obj.(*types.Var)
+		if ok && !v.IsField() && !seen[v] && v.Pos() >= decl.Pos() && v.Pos() < decl.End() {
+			seen[v] = true
+			vars = append(vars, v)
+		}
+	}
+	ast.Inspect(decl, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			taken[n.Name] = true
+			// The variables of type switches are found where they are used.
+			add(info.ObjectOf(n))
+		case *ast.CaseClause:
+			add(info.Implicits[n])
+		}
+		return true
+	})
+	sort.SliceStable(vars, func(i, j int) bool {
+		return vars[i].Pos() < vars[j].Pos()
+	})
+	res := map[types.Object]string{}
+	byPos := map[token.Pos]string{}
+	for i, v := range vars {
+		if name, ok := byPos[v.Pos()]; ok {
+			res[v] = name
+			continue
+		}
+		for _, u := range vars[:i] {
+			if u.Name() != v.Name() || u.Pos() == v.Pos() || !encloses(u.Parent(), v.Parent()) {
+				continue
+			}
+			name := v.Name() + "_"
+			for taken[name] {
+				name += "_"
+			}
+			taken[name] = true
+			res[v], byPos[v.Pos()] = name, name
+			break
+		}
+	}
+	return res
+}
+
+// encloses reports whether a scope is, or encloses, another.
+func encloses(outer, inner *types.Scope) bool {
+	for s := inner; s != nil; s = s.Parent() {
+		if s == outer {
+			return true
+		}
+	}
+	return false
+}
+
+// copier copies syntax trees, recording the copy of each node. Objects and
+// scopes that the parser resolves identifiers to are shared by the copies.
+type copier struct {
+	copies map[ast.Node]ast.Node
+}
+
+func (c *copier) copy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		switch v.Interface().(type) {
+		case *ast.Object, *ast.Scope:
+			return v
+		}
+		res := reflect.New(v.Type().Elem())
+		res.Elem().Set(c.copy(v.Elem()))
+		if n, ok := v.Interface().(ast.Node); ok {
+			c.copies[n] = res.Interface().(ast.Node)
+		}
+		return res
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.New(v.Type()).Elem()
+		res.Set(c.copy(v.Elem()))
+		return res
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(c.copy(v.Index(i)))
+		}
+		return res
+
+	case reflect.Struct:
+		res := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			res.Field(i).Set(c.copy(v.Field(i)))
+		}
+		return res
+	}
+	return v
+}
+
+// copyInfo gives the type information for copies of nodes, as info holds it
+// for the nodes themselves.
+func copyInfo(info *types.Info, copies map[ast.Node]ast.Node) *types.Info {
+	res := &types.Info{}
+	if info.Types != nil {
+		res.Types = map[ast.Expr]types.TypeAndValue{}
+	}
+	if info.Defs != nil {
+		res.Defs = map[*ast.Ident]types.Object{}
+	}
+	if info.Uses != nil {
+		res.Uses = map[*ast.Ident]types.Object{}
+	}
+	if info.Implicits != nil {
+		res.Implicits = map[ast.Node]types.Object{}
+	}
+	if info.Selections != nil {
+		res.Selections = map[*ast.SelectorExpr]*types.Selection{}
+	}
+	if info.Scopes != nil {
+		res.Scopes = map[ast.Node]*types.Scope{}
+	}
+	if info.Instances != nil {
+		res.Instances = map[*ast.Ident]types.Instance{}
+	}
+	for n, m := range copies {
+		if x, ok := n.(ast.Expr); ok {
+			if tv, ok := info.Types[x]; ok {
+				res.Types[m.(ast.Expr)] = tv
+			}
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			if obj, ok := info.Defs[id]; ok {
+				res.Defs[m.(*ast.Ident)] = obj
+			}
+			if obj, ok := info.Uses[id]; ok {
+				res.Uses[m.(*ast.Ident)] = obj
+			}
+			if inst, ok := info.Instances[id]; ok {
+				res.Instances[m.(*ast.Ident)] = inst
+			}
+		}
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if s, ok := info.Selections[sel]; ok {
+				res.Selections[m.(*ast.SelectorExpr)] = s
+			}
+		}
+		if obj, ok := info.Implicits[n]; ok {
+			res.Implicits[m] = obj
+		}
+		if s, ok := info.Scopes[n]; ok {
+			res.Scopes[m] = s
+		}
+	}
+	return res
+}
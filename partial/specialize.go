@@ -1,30 +1,352 @@
 package partial
 
 import (
+	"fmt"
 	"go/ast"
 	"go/token"
+	"go/types"
+	"strings"
 )
 
 type ExecScope interface {
 	Lookup(name string) Value
 	Bind(name string, value Value) ExecScope
+	Equal(s ExecScope) bool
+	Hash() uint64
+}
+
+// Specialize produces a residual version of a function, given the values of
+// some of its parameters. The residual function takes only the remaining
+// parameters. Struct parameters may instead be given values for some of their
+// fields, named as in cfg.Mode. Info must hold the Types, Defs and Uses of
+// decl. Other maps, such as Selections, are not needed.
+func Specialize(decl *ast.FuncDecl, info *types.Info, static map[string]Value, opts ...Option) (*ast.FuncDecl, error) {
+	r := newResidual(decl, info)
+	for _, opt := range opts {
+		opt(r)
+	}
+	name := decl.Name.Name
+	if r.name != "" {
+		name = r.name
+	}
+	var self *specialization
+	if r.calls != nil {
+		// Calls the function makes to itself with the same static values are
+		// calls to the residual function.
+		r.calls.Reserve(name)
+		self = r.calls.seed(decl, static, name)
+	}
+	res, err := r.specialize(decl, info, static)
+	if err != nil {
+		if self != nil {
+			self.failed = true
+		}
+		return nil, err
+	}
+	res.Name.Name = name
+	if r.calls != nil {
+		r.calls.roots = append(r.calls.roots, res)
+	}
+	return res, nil
+}
+
+// specializeDecl produces a residual function, along with the residual that
+// generated it.
+func specializeDecl(decl *ast.FuncDecl, info *types.Info, static map[string]Value, opts ...Option) (*ast.FuncDecl, *residual, error) {
+	r := newResidual(decl, info)
+	for _, opt := range opts {
+		opt(r)
+	}
+	res, err := r.specialize(decl, info, static)
+	return res, r, err
+}
+
+// specialize produces a residual function, once the options have been
+// applied to r.
+func (r *residual) specialize(decl *ast.FuncDecl, info *types.Info, static map[string]Value) (*ast.FuncDecl, error) {
+	var entry Point
+	if d := r.division; d != nil {
+		if d.decl != decl {
+			return nil, fmt.Errorf("%s: division is for %s", decl.Name.Name, d.decl.Name.Name)
+		}
+		decl, info, entry = d.src, d.info, d.entry
+	} else {
+		decl, info, _ = unshadow(decl, info)
+		entry = newAnalyzer(decl.Body).analyze(decl.Body, nil)
+	}
+	// Shadowing variables are named as they are in the copy.
+	r.types = varTypes(decl, info)
+
+	params, scope, err := bindParams(decl, info, static)
+	if err != nil {
+		return nil, err
+	}
+	scope.allocs, scope.res = r.escapes(decl.Body, info), r
+	body, _, err := r.block(entry, scope, path{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", decl.Name.Name, err)
+	}
+
+	typ := *decl.Type
+	typ.Params = params
+	return &ast.FuncDecl{
+		Recv: decl.Recv,
+		Name: &ast.Ident{Name: decl.Name.Name},
+		Type: &typ,
+		Body: &ast.BlockStmt{List: prune(body)},
+	}, nil
+}
+
+// varTypes finds the types of the variables declared in a function or function
+// literal.
+func varTypes(decl ast.Node, info *types.Info) map[string]types.Type {
+	res := map[string]types.Type{}
+	for id, obj := range info.Defs {
+		if v, ok := obj.(*types.Var); ok && id.Pos() >= decl.Pos() && id.Pos() < decl.End() {
+			res[id.Name] = v.Type()
+		}
+	}
+	return res
+}
+
+// An Option changes how a function is specialized.
+type Option func(*residual)
+
+// Offline specializes a function according to a division computed by Divide,
+// rather than deciding what to evaluate as it goes.
+func Offline(d *Division) Option {
+	return func(r *residual) {
+		r.division = d
+	}
+}
+
+// Named gives the residual function a name, rather than the name of the
+// function. With Calls, the calls that the function makes to itself with the
+// same static values call it by this name.
+func Named(name string) Option {
+	return func(r *residual) {
+		r.name = name
+	}
+}
+
+// SortMapRanges lets ranges over known maps be unrolled, visiting the keys in
+// sorted order. Go does not specify the order that a map is ranged over in, so
+// without this option such ranges are left to the residual program, where the
+// map is built from its literal.
+func SortMapRanges() Option {
+	return func(r *residual) {
+		r.sortMaps = true
+	}
+}
+
+// bindParams creates the scope a function body is specialized in, returning
+// the parameters that remain in the residual function. Fields of struct
+// parameters may be given values by naming them as in cfg.Mode, in which case
+// the parameter remains.
+func bindParams(decl *ast.FuncDecl, info *types.Info, static map[string]Value) (*ast.FieldList, *bindings, error) {
+	scope := newBindings()
+	scope.info, scope.vars = info, varTypes(decl, info)
+	if obj := info.Defs[decl.Name]; obj != nil {
+		scope.pkg = obj.Pkg()
+	}
+	values, fields := map[string]Value{}, map[string]map[string]Value{}
+	for name, v := range static {
+		param, field, ok := strings.Cut(name, ".")
+		if !ok {
+			values[name] = v
+			continue
+		}
+		if fields[param] == nil {
+			fields[param] = map[string]Value{}
+		}
+		fields[param][field] = v
+	}
+	seen := map[string]bool{}
+	params := &ast.FieldList{}
+	for _, f := range decl.Type.Params.List {
+		var names []*ast.Ident
+		for _, name := range f.Names {
+			seen[name.Name] = true
+			if v, ok := values[name.Name]; ok {
+				if t := info.TypeOf(name); t != nil && !assignableTo(v, t) {
+					return nil, nil, fmt.Errorf("%s: parameter %s of type %s cannot be %s", decl.Name.Name, name.Name, t, types.ExprString(v.Expr()))
+				}
+				scope = scope.Bind(name.Name, v).(*bindings)
+				continue
+			}
+			scope = scope.declare(name.Name)
+			names = append(names, name)
+			if known := fields[name.Name]; known != nil {
+				v, err := partialStruct(name, info.TypeOf(name), known, scope.pkg)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %w", decl.Name.Name, err)
+				}
+				scope = scope.Bind(name.Name, v).(*bindings)
+			}
+		}
+		if names == nil && f.Names != nil {
+			continue
+		}
+		params.List = append(params.List, &ast.Field{Names: names, Type: f.Type})
+	}
+	for name := range static {
+		if param, _, _ := strings.Cut(name, "."); !seen[param] {
+			return nil, nil, fmt.Errorf("%s has no parameter %s", decl.Name.Name, param)
+		}
+	}
+	for _, fields := range []*ast.FieldList{decl.Recv, decl.Type.Results} {
+		if fields == nil {
+			continue
+		}
+		for _, f := range fields.List {
+			for _, name := range f.Names {
+				scope = scope.declare(name.Name)
+			}
+		}
+	}
+	return params, scope, nil
+}
+
+// partialStruct creates the value of a struct parameter, given the values of
+// some of its fields. The other fields refer to those of the parameter.
+func partialStruct(x ast.Expr, t types.Type, values map[string]Value, pkg *types.Package) (*StructValue, error) {
+	s, ok := t.Underlying().(*types.Struct)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a struct", types.ExprString(x))
+	}
+	nested := map[string]map[string]Value{}
+	for name, v := range values {
+		field, rest, ok := strings.Cut(name, ".")
+		if fieldIndex(s, field) < 0 {
+			return nil, fmt.Errorf("%s has no field %s", types.ExprString(x), field)
+		}
+		if ok {
+			if nested[field] == nil {
+				nested[field] = map[string]Value{}
+			}
+			nested[field][rest] = v
+		}
+	}
+	fields := make([]Value, s.NumFields())
+	for i := range fields {
+		field := s.Field(i)
+		sel := &ast.SelectorExpr{X: x, Sel: &ast.Ident{Name: field.Name()}}
+		switch v, ok := values[field.Name()]; {
+		case ok:
+			if !assignableTo(v, field.Type()) {
+				return nil, fmt.Errorf("%s of type %s cannot be %s", types.ExprString(sel), field.Type(), types.ExprString(v.Expr()))
+			}
+			fields[i] = assignable(v, field.Type(), pkg)
+		case nested[field.Name()] != nil:
+			v, err := partialStruct(sel, field.Type(), nested[field.Name()], pkg)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = v
+		default:
+			fields[i] = &UnknownValue{sel}
+		}
+	}
+	return &StructValue{compositeValue{typ: t, pkg: pkg}, fields}, nil
 }
 
 type analyzer struct {
 	next, out Point
-	labels    map[string]Point
+	labels    *labels
+	fall      Point              // the body of the next case of a switch
+	label     string             // of the loop or switch being analyzed
+	stmts     map[Point]ast.Stmt // that the points are made from
+}
+
+// labels records the points that the labels of a function body refer to.
+type labels struct {
+	gotos     map[string]Point
+	breaks    map[string]Point
+	continues map[string]Point
+	headers   map[string]*loop // labels that goto statements jump back to
+}
+
+// newAnalyzer creates the analyzer for a function body. A label that a goto
+// statement jumps back to is the header of a loop, as control can return to
+// it, and a label that one jumps forward to is analyzed before the goto is.
+func newAnalyzer(body ast.Stmt) *analyzer {
+	l := &labels{
+		gotos:     map[string]Point{},
+		breaks:    map[string]Point{},
+		continues: map[string]Point{},
+		headers:   map[string]*loop{},
+	}
+	defined := map[string]token.Pos{}
+	var gotos []*ast.BranchStmt
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.LabeledStmt:
+			defined[n.Label.Name] = n.Pos()
+		case *ast.BranchStmt:
+			if n.Tok == token.GOTO {
+				gotos = append(gotos, n)
+			}
+		}
+		return true
+	})
+	for _, g := range gotos {
+		if pos, ok := defined[g.Label.Name]; ok && pos < g.Pos() {
+			l.headers[g.Label.Name] = &loop{}
+		}
+	}
+	return &analyzer{labels: l, stmts: map[Point]ast.Stmt{}}
 }
 
 func (a *analyzer) analyze(stmt ast.Stmt, cont Point) Point {
 	switch stmt := stmt.(type) {
-	case *ast.EmptyStmt:
+	case nil, *ast.EmptyStmt:
 		return cont
 
 	case *ast.ExprStmt:
-		return &evalExpr{stmt.X, cont}
+		return a.from(stmt, &evalExpr{stmt.X, cont})
 
 	case *ast.AssignStmt:
-		return &assign{stmt.Lhs, stmt.Rhs, stmt.Tok == token.DEFINE, cont}
+		if stmt.Tok == token.ASSIGN || stmt.Tok == token.DEFINE {
+			return a.from(stmt, &assign{stmt.Lhs, stmt.Rhs, stmt.Tok == token.DEFINE, cont})
+		}
+		// x op= y is x = x op y, with op one of the binary operators in the
+		// same order as the assignment operators.
+		if res := opAssign(stmt.Lhs[0], stmt.Tok-token.ADD_ASSIGN+token.ADD, stmt.Rhs[0], cont); res != nil {
+			return a.from(stmt, res)
+		}
+
+	case *ast.IncDecStmt:
+		op := token.ADD
+		if stmt.Tok == token.DEC {
+			op = token.SUB
+		}
+		if res := opAssign(stmt.X, op, &ast.BasicLit{Kind: token.INT, Value: "1"}, cont); res != nil {
+			return a.from(stmt, res)
+		}
+
+	case *ast.DeclStmt:
+		decl, ok := stmt.Decl.(*ast.GenDecl)
+		if !ok || decl.Tok == token.TYPE || decl.Tok == token.IMPORT {
+			break
+		}
+		for i := len(decl.Specs) - 1; i >= 0; i-- {
+			spec := decl.Specs[i].(*ast.ValueSpec)
+			if spec.Values == nil && decl.Tok == token.CONST {
+				return &unsupported{stmt}
+			}
+			if spec.Values == nil {
+				cont = a.from(stmt, &declare{spec, cont})
+				continue
+			}
+			lhs := make([]ast.Expr, len(spec.Names))
+			for j, name := range spec.Names {
+				lhs[j] = name
+			}
+			cont = a.from(stmt, &assign{lhs, spec.Values, true, cont})
+		}
+		return cont
 
 	case *ast.BlockStmt:
 		for i := len(stmt.List) - 1; i >= 0; i-- {
@@ -33,7 +355,7 @@ func (a *analyzer) analyze(stmt ast.Stmt, cont Point) Point {
 		return cont
 
 	case *ast.ReturnStmt:
-		return &returnValues{stmt.Results}
+		return a.from(stmt, &returnValues{stmt.Results})
 
 	case *ast.IfStmt:
 		consequent := a.analyze(stmt.Body, cont)
@@ -41,25 +363,112 @@ func (a *analyzer) analyze(stmt ast.Stmt, cont Point) Point {
 		if stmt.Else != nil {
 			antecedent = a.analyze(stmt.Else, cont)
 		}
-		res := &branch{stmt.Cond, consequent, antecedent}
+		res := a.from(stmt, &branch{stmt.Cond, consequent, antecedent, cont})
 		if stmt.Init != nil {
 			return a.analyze(stmt.Init, res)
 		}
 		return res
 
 	case *ast.ForStmt:
-		loop := &branch{stmt.Cond, nil, cont}
-		body := a.inLoop(loop, cont).analyze(stmt.Body, a.analyze(stmt.Post, loop))
-		loop.consequent = body
+		loop := &loop{branch{condition: stmt.Cond, antecedent: cont}}
+		a.from(stmt, loop)
+		post := a.analyze(stmt.Post, loop)
+		loop.consequent = a.inLoop(post, cont).analyze(stmt.Body, post)
 		return a.analyze(stmt.Init, loop)
 
+	case *ast.RangeStmt:
+		res := &rangeLoop{stmt: stmt, exit: cont, mutated: mutates(stmt)}
+		a.from(stmt, res)
+		res.next = &rangeNext{res}
+		res.body = a.inLoop(res.next, cont).analyze(stmt.Body, res.next)
+		if stmt.Key != nil {
+			lhs := []ast.Expr{stmt.Key}
+			if stmt.Value != nil {
+				lhs = append(lhs, stmt.Value)
+			}
+			res.bind = &assign{lhs, nil, stmt.Tok == token.DEFINE, res.body}
+		}
+		return res
+
+	case *ast.SwitchStmt:
+		res := &choice{tag: stmt.Tag, join: cont}
+		a.from(stmt, res)
+		inner := a.inLoop(a.next, cont)
+		res.clauses = make([]clause, len(stmt.Body.List))
+		next := cont
+		for i := len(stmt.Body.List) - 1; i >= 0; i-- {
+			c := stmt.Body.List[i].(*ast.CaseClause)
+			inner.fall = next
+			next = inner.analyze(&ast.BlockStmt{List: c.Body}, cont)
+			res.clauses[i] = clause{values: c.List, body: next}
+			if c.List == nil {
+				res.def = &res.clauses[i]
+			}
+		}
+		return a.analyze(stmt.Init, res)
+
+	case *ast.TypeSwitchStmt:
+		res := &choice{join: cont, typed: true}
+		a.from(stmt, res)
+		switch guard := stmt.Assign.(type) {
+		case *ast.AssignStmt:
+			res.tag = guard.Rhs[0].(*ast.TypeAssertExpr).X
+			res.bind = guard.Lhs[0].(*ast.Ident)
+		case *ast.ExprStmt:
+			res.tag = guard.X.(*ast.TypeAssertExpr).X
+		}
+		inner := a.inLoop(a.next, cont)
+		res.clauses = make([]clause, len(stmt.Body.List))
+		for i, c := range stmt.Body.List {
+			c := c.(*ast.CaseClause)
+			body := inner.analyze(&ast.BlockStmt{List: c.Body}, cont)
+			res.clauses[i] = clause{values: c.List, body: body}
+			if res.bind != nil {
+				res.clauses[i].bound = &assign{[]ast.Expr{res.bind}, []ast.Expr{res.tag}, true, body}
+				a.from(c, res.clauses[i].bound)
+			}
+			if c.List == nil {
+				res.def = &res.clauses[i]
+			}
+		}
+		return a.analyze(stmt.Init, res)
+
+	case *ast.SelectStmt:
+		// Which case of a select proceeds depends on other goroutines, so
+		// neither it nor a labelled break out of it can be specialized.
+		return &unsupported{stmt}
+
+	case *ast.LabeledStmt:
+		name := stmt.Label.Name
+		inner := a
+		switch stmt.Stmt.(type) {
+		case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt:
+			inner = &analyzer{next: a.next, out: a.out, labels: a.labels, fall: a.fall, label: name, stmts: a.stmts}
+		}
+		res := inner.analyze(stmt.Stmt, cont)
+		if header := a.labels.headers[name]; header != nil {
+			header.consequent = res
+			res = a.from(stmt, header)
+		}
+		a.labels.gotos[name] = res
+		return res
+
 	case *ast.BranchStmt:
-		switch stmt.Tok {
-		case token.GOTO:
-			return a.labels[stmt.Label.Name]
-		case token.BREAK:
+		switch {
+		case stmt.Tok == token.GOTO:
+			if header := a.labels.headers[stmt.Label.Name]; header != nil {
+				return header
+			}
+			return a.labels.gotos[stmt.Label.Name]
+		case stmt.Tok == token.FALLTHROUGH:
+			return a.fall
+		case stmt.Label != nil && stmt.Tok == token.BREAK:
+			return a.labels.breaks[stmt.Label.Name]
+		case stmt.Label != nil && stmt.Tok == token.CONTINUE:
+			return a.labels.continues[stmt.Label.Name]
+		case stmt.Tok == token.BREAK:
 			return a.out
-		case token.CONTINUE:
+		case stmt.Tok == token.CONTINUE:
 			return a.next
 		}
 
@@ -67,6 +476,92 @@ func (a *analyzer) analyze(stmt ast.Stmt, cont Point) Point {
 	return &unsupported{stmt}
 }
 
+// opAssign desugars an assignment that applies an operator to the variable
+// being assigned to. The variable is evaluated twice by doing so, which is only
+// the same as evaluating it once if that has no effects.
+func opAssign(x ast.Expr, op token.Token, y ast.Expr, cont Point) Point {
+	if !operand(x) {
+		return nil
+	}
+	return &assign{[]ast.Expr{x}, []ast.Expr{&ast.BinaryExpr{X: x, Op: op, Y: y}}, false, cont}
+}
+
+// operand reports whether an expression that is assigned to can be evaluated
+// without effects.
+func operand(x ast.Expr) bool {
+	switch x := x.(type) {
+	case *ast.Ident:
+		return true
+	case *ast.ParenExpr:
+		return operand(x.X)
+	case *ast.SelectorExpr:
+		return operand(x.X)
+	case *ast.StarExpr:
+		return operand(x.X)
+	case *ast.IndexExpr:
+		return operand(x.X) && pure(x.Index)
+	}
+	return false
+}
+
+// from records the statement that a point is made from.
+func (a *analyzer) from(stmt ast.Stmt, p Point) Point {
+	a.stmts[p] = stmt
+	return p
+}
+
+// inLoop creates the analyzer for the body of a loop or switch, which break
+// and continue statements leave by the given points, as do those that name
+// its label.
 func (a *analyzer) inLoop(next, out Point) *analyzer {
-	return &analyzer{next, out, a.labels}
+	if a.label != "" {
+		a.labels.breaks[a.label] = out
+		a.labels.continues[a.label] = next
+	}
+	return &analyzer{next: next, out: out, labels: a.labels, stmts: a.stmts}
+}
+
+// mutates reports whether the body of a range assigns to the elements of the
+// collection being ranged over, or deletes them from it.
+func mutates(stmt *ast.RangeStmt) bool {
+	name := rootName(stmt.X)
+	if name == "" {
+		return false
+	}
+	elem := func(x ast.Expr) bool {
+		ix, ok := ast.Unparen(x).(*ast.IndexExpr)
+		return ok && rootName(ix.X) == name
+	}
+	found := false
+	ast.Inspect(stmt.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, x := range n.Lhs {
+				found = found || elem(x)
+			}
+		case *ast.IncDecStmt:
+			found = found || elem(n.X)
+		case *ast.CallExpr:
+			if id, ok := n.Fun.(*ast.Ident); ok && id.Name == "delete" && len(n.Args) > 0 {
+				found = found || rootName(n.Args[0]) == name
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// rootName gives the variable that an expression selects from or indexes.
+func rootName(x ast.Expr) string {
+	switch x := ast.Unparen(x).(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		return rootName(x.X)
+	case *ast.IndexExpr:
+		return rootName(x.X)
+	case *ast.StarExpr:
+		return rootName(x.X)
+	}
+	return ""
 }
@@ -1,7 +1,13 @@
 package partial
 
 import (
+	"errors"
 	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"reflect"
 	"testing"
 )
@@ -58,14 +64,2412 @@ func TestAnalysis(t *testing.T) {
 					},
 				},
 				antecedent: &returnValues{nil},
+				join:       &returnValues{nil},
 			},
 		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
-			p := new(analyzer).analyze(test.stmt, &returnValues{nil})
+			p := newAnalyzer(test.stmt).analyze(test.stmt, &returnValues{nil})
 			if !reflect.DeepEqual(test.res, p) {
 				t.Errorf("expected %#v, got %#v", test.res, p)
 			}
 		})
 	}
 }
+
+func specialize(t *testing.T, src, name string, static map[string]Value) string {
+	t.Helper()
+	decl, info := parseFunc(t, src, name)
+	res, err := Specialize(decl, info, static)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return formatSource(t, nodeString(res))
+}
+
+func parseFunc(t *testing.T, src, name string) (*ast.FuncDecl, *types.Info) {
+	t.Helper()
+	f, info := parseFile(t, src)
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.FuncDecl); ok && d.Name.Name == name {
+			return d, info
+		}
+	}
+	t.Fatalf("no function %s", name)
+	return nil, nil
+}
+
+func parseFile(t *testing.T, src string) (*ast.File, *types.Info) {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "test.go", "package test\n"+src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Defs:  map[*ast.Ident]types.Object{},
+		Uses:  map[*ast.Ident]types.Object{},
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("test", fset, []*ast.File{f}, info); err != nil {
+		t.Fatal(err)
+	}
+	return f, info
+}
+
+func formatSource(t *testing.T, src string) string {
+	t.Helper()
+	res, err := format.Source([]byte(src))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, src)
+	}
+	return string(res)
+}
+
+func TestSpecialize(t *testing.T) {
+	for _, test := range []struct {
+		name, in, out string
+		static        map[string]Value
+	}{
+		{
+			"NoStatic",
+			`func f(x int) int {
+				return x * 2
+			}`,
+			`func f(x int) int {
+				return x * 2
+			}`,
+			nil,
+		},
+		{
+			"StaticParam",
+			`func f(x, y int) int { return x * y }`,
+			`func f(y int) int {
+				return 3 * y
+			}`,
+			map[string]Value{"x": Int(3)},
+		},
+		{
+			"StaticLocal",
+			`func f(x, y int) int {
+				z := x + 1
+				return z * y
+			}`,
+			`func f(y int) int {
+				return 4 * y
+			}`,
+			map[string]Value{"x": Int(3)},
+		},
+		{
+			"DynamicLocal",
+			`func f(x, y int) int {
+				z := y + x
+				return z * z
+			}`,
+			`func f(y int) int {
+				z := y + 3
+				return z * z
+			}`,
+			map[string]Value{"x": Int(3)},
+		},
+		{
+			"StaticIf",
+			`func f(double bool, x int) int {
+				if double {
+					return x * 2
+				}
+				return x
+			}`,
+			`func f(x int) int {
+				return x * 2
+			}`,
+			map[string]Value{"double": True},
+		},
+		{
+			"DynamicIf",
+			`func f(x, y int) int {
+				z := y
+				if x == 1 {
+					z = y * 2
+				}
+				return z
+			}`,
+			`func f(x, y int) int {
+				z := y
+				if x == 1 {
+					z = y * 2
+				}
+				return z
+			}`,
+			nil,
+		},
+		{
+			"Join",
+			`func f(x, y int, g func(int)) int {
+				z := 1
+				if x > 0 {
+					g(y)
+				} else {
+					g(x)
+				}
+				return y + z
+			}`,
+			`func f(x, y int, g func(int)) int {
+				if x > 0 {
+					g(y)
+				} else {
+					g(x)
+				}
+				return y + 1
+			}`,
+			nil,
+		},
+		{
+			"NestedJoin",
+			`func f(x, y int, g func(int)) int {
+				z := 1
+				if x > 0 {
+					if y > 0 {
+						g(y)
+					}
+					g(x)
+				}
+				return y + z
+			}`,
+			`func f(x, y int, g func(int)) int {
+				if x > 0 {
+					if y > 0 {
+						g(y)
+					}
+					g(x)
+				}
+				return y + 1
+			}`,
+			nil,
+		},
+		{
+			"JoinEmpty",
+			`func f(x, y int, g func(int) bool) int {
+				z := 1
+				if x > 0 {
+					z = 1
+				}
+				if g(y) {
+					z = 1
+				}
+				if g(x) == (y > 0) {
+					z = 1
+				}
+				return y + z
+			}`,
+			`func f(x, y int, g func(int) bool) int {
+				g(y)
+				_ = g(x) == (y > 0)
+				return y + 1
+			}`,
+			nil,
+		},
+		{
+			"JoinDeclares",
+			`func f(x, y int) int {
+				z := 0
+				if x > 0 {
+					z = y
+				} else {
+					z = 0 - y
+				}
+				return z * 2
+			}`,
+			`func f(x, y int) int {
+				z := 0
+				if x > 0 {
+					z = y
+				} else {
+					z = 0 - y
+				}
+				return z * 2
+			}`,
+			nil,
+		},
+		{
+			"JoinIncompatible",
+			`func f(x, y int) int {
+				z := 1
+				if x > 0 {
+					z = 2
+				}
+				return y * z
+			}`,
+			`func f(x, y int) int {
+				if x > 0 {
+					return y * 2
+				}
+				return y * 1
+			}`,
+			nil,
+		},
+		{
+			"BoundByCondition",
+			`func f(x, y int) int {
+				if x == 1 {
+					return x + y
+				}
+				return y
+			}`,
+			`func f(x, y int) int {
+				if x == 1 {
+					return 1 + y
+				}
+				return y
+			}`,
+			nil,
+		},
+		{
+			"TypedLocal",
+			`func f(x int, y int64) int64 {
+				z := x
+				var w int64 = 1
+				if y > 0 {
+					w = y
+				}
+				return w * int64(z)
+			}`,
+			`func f(y int64) int64 {
+				if y > 0 {
+					w := y
+					return w * 2
+				}
+				return 2
+			}`,
+			map[string]Value{"x": Int(2)},
+		},
+		{
+			"NamedConstant",
+			`type Mode int
+
+			func f(g func(any)) any {
+				m := Mode(3)
+				g(m + 1)
+				return m
+			}`,
+			`func f(g func(any)) any {
+				g(Mode(4))
+				return Mode(3)
+			}`,
+			nil,
+		},
+		{
+			"NamedConstantImported",
+			`import tm "time"
+
+			func f(n int) any {
+				var d tm.Duration = 5
+				return d * tm.Duration(n)
+			}`,
+			`func f() any {
+				return tm.Duration(10)
+			}`,
+			map[string]Value{"n": Int(2)},
+		},
+		{
+			"DivideByZero",
+			`func f(x, n int) int {
+				return x / n + x % n
+			}`,
+			`func f(x int) int {
+				return x/(*new(int)) + x%(*new(int))
+			}`,
+			map[string]Value{"n": Int(0)},
+		},
+		{
+			"IndexOutOfRange",
+			`func f(s string, i, j int) byte {
+				if j > 0 {
+					return [2]byte{1, 2}[i]
+				}
+				return s[i-j]
+			}`,
+			`func f(j int) byte {
+				if j > 0 {
+					return [2]byte{1, 2}[(*new(int))+5]
+				}
+				return "abc"[5-j]
+			}`,
+			map[string]Value{"s": String("abc"), "i": Int(5)},
+		},
+		{
+			"Statements",
+			`func f(n int, g func(int)) {
+				var total int
+				g(n)
+				total = n
+				g(total)
+			}`,
+			`func f(g func(int)) {
+				g(5)
+				g(5)
+			}`,
+			map[string]Value{"n": Int(5)},
+		},
+		{
+			"StaticLoop",
+			`func f(g func(int)) {
+				for i := 0; i == 0 || i == 1 || i == 2; i = i + 1 {
+					g(i)
+				}
+			}`,
+			`func f(g func(int)) {
+				g(0)
+				g(1)
+				g(2)
+			}`,
+			nil,
+		},
+		{
+			"DynamicLoop",
+			`func f(n int, g func(int)) {
+				i := 0
+				for i < n {
+					g(i)
+					i = i + 1
+				}
+			}`,
+			`func f(n int, g func(int)) {
+				i := 0
+				for i < n {
+					g(i)
+					i = i + 1
+				}
+			}`,
+			nil,
+		},
+		{
+			"PolyvariantLoop",
+			`func f(n int, g func(int)) {
+				k := 0
+				for i := 0; i < n; i = i + 1 {
+					g(k)
+					k = k ^ 1
+				}
+			}`,
+			`func f(n int, g func(int)) {
+				i := 0
+				for i < n {
+					g(0)
+					i = i + 1
+					if i < n {
+						g(1)
+						i = i + 1
+					} else {
+						break
+					}
+				}
+			}`,
+			nil,
+		},
+		{
+			"LoopWithBreak",
+			`func f(g func() bool, h func()) int {
+				n := 0
+				for {
+					if g() {
+						break
+					}
+					h()
+				}
+				return n
+			}`,
+			`func f(g func() bool, h func()) int {
+				for {
+					if g() {
+						break
+					}
+					h()
+				}
+				return 0
+			}`,
+			nil,
+		},
+		{
+			"LoopExits",
+			`func f(g, h func() bool) int {
+				x := 0
+				for g() {
+					if h() {
+						x = 1
+						break
+					}
+				}
+				return x
+			}`,
+			`func f(g, h func() bool) int {
+				x := 0
+				for g() {
+					if h() {
+						x = 1
+						break
+					}
+				}
+				return x
+			}`,
+			nil,
+		},
+		{
+			"NestedLoops",
+			`func f(g, h func() bool, k func()) {
+				for g() {
+					for h() {
+						if g() {
+							continue
+						}
+						if h() {
+							break
+						}
+						k()
+					}
+				}
+			}`,
+			`func f(g, h func() bool, k func()) {
+				for g() {
+					for h() {
+						if g() {
+							continue
+						}
+						if h() {
+							break
+						}
+						k()
+					}
+				}
+			}`,
+			nil,
+		},
+		{
+			"AddressTaken",
+			`func f(n, y int) int {
+				x := n + 1
+				p := &x
+				*p = y
+				return x * n
+			}`,
+			`func f(y int) int {
+				x := y
+				return x * 3
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"AddressEscapes",
+			`func f(n int, g func(*int)) int {
+				x := n + 1
+				p := &x
+				g(p)
+				return x * n
+			}`,
+			`func f(g func(*int)) int {
+				x := 4
+				g(&x)
+				return x * 3
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"PointerCopy",
+			`func f(n, y int) int {
+				x := y
+				p := &x
+				q := p
+				*q = n
+				if p != nil {
+					return x + *p
+				}
+				return 0
+			}`,
+			`func f(y int) int {
+				return 6
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"PointerField",
+			`type point struct{ x, y int }
+			func f(n, y int) int {
+				pt := point{x: n}
+				p := &pt
+				p.y = y
+				(*p).x = (*p).x + 1
+				return pt.x * p.y
+			}`,
+			`func f(y int) int {
+				ptY := y
+				return 4 * ptY
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"New",
+			`func f(n, y int) int {
+				p := new(int)
+				*p = *p + n
+				q := new(int)
+				*q = y
+				return *p * *q
+			}`,
+			`func f(y int) int {
+				qVal := y
+				return 3 * qVal
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"PointerTargets",
+			`func f(c bool, y int) int {
+				a, b := 1, 2
+				p := &a
+				if c {
+					p = &b
+				}
+				*p = y
+				return a + b
+			}`,
+			`func f(c bool, y int) int {
+				a := 1
+				b := 2
+				if c {
+					b = y
+					return a + b
+				}
+				a = y
+				return a + b
+			}`,
+			nil,
+		},
+		{
+			"UnknownPointer",
+			`func f(q *int, n int) int {
+				x := n
+				*q = x
+				return x
+			}`,
+			`func f(q *int) int {
+				*q = 3
+				return 3
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"AddressOfParam",
+			`func f(n, y int) int {
+				p := &n
+				*p = *p + y
+				return n
+			}`,
+			`func f(y int) int {
+				n := 3 + y
+				return n
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"Receive",
+			`func f(ch chan int, k int) int {
+				x := <-ch
+				<-ch
+				return -x * k
+			}`,
+			`func f(ch chan int) int {
+				x := <-ch
+				<-ch
+				return -x * 2
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"ShortCircuit",
+			`func f(debug bool, check func() bool, x int) int {
+				if debug && check() {
+					return 0
+				}
+				if !debug || check() {
+					return x
+				}
+				return -x
+			}`,
+			`func f(check func() bool, x int) int {
+				return x
+			}`,
+			map[string]Value{"debug": False},
+		},
+		{
+			"Composite",
+			`type point struct{ x, y int }
+			func f(i, x int) int {
+				coeffs := []int{1, 2, 3}
+				p := point{x: 2}
+				return coeffs[i]*x + p.x + len(coeffs)
+			}`,
+			`func f(x int) int {
+				return 2*x + 2 + 3
+			}`,
+			map[string]Value{"i": Int(1)},
+		},
+		{
+			"CompositeEscapes",
+			`type point struct{ x, y int }
+			func f(g func([]int), y int) point {
+				s := []int{1, 2, 3}
+				g(s)
+				p := point{x: s[0]}
+				p.y = y
+				return p
+			}`,
+			`func f(g func([]int), y int) point {
+				s := []int{1, 2, 3}
+				g(s)
+				p := point{x: s[0]}
+				p.y = y
+				return p
+			}`,
+			nil,
+		},
+		{
+			"CompositeResult",
+			`type point struct{ x, y int }
+			func f(n int) (point, [2]int) {
+				return point{y: n}, [2]int{n}
+			}`,
+			`func f() (point, [2]int) {
+				return point{y: 4}, [2]int{4}
+			}`,
+			map[string]Value{"n": Int(4)},
+		},
+		{
+			"PartlyStaticParam",
+			`type config struct {
+				mode   string
+				userID int
+				scale  int
+			}
+			func f(cfg config) int {
+				if cfg.mode == "fast" {
+					return cfg.userID * cfg.scale
+				}
+				return cfg.userID
+			}`,
+			`func f(cfg config) int {
+				return cfg.userID * 2
+			}`,
+			map[string]Value{"cfg.mode": String("fast"), "cfg.scale": Int(2)},
+		},
+		{
+			"SplitStruct",
+			`type point struct{ x, y int }
+			func f(n, y int) int {
+				p := point{x: n, y: y}
+				p.y = p.y + p.x
+				return p.x * p.y
+			}`,
+			`func f(y int) int {
+				pY := y
+				pY = pY + 3
+				return 3 * pY
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"SplitStructEscapes",
+			`type point struct{ x, y int }
+			func f(g func(point), n, y int) {
+				p := point{x: n, y: y}
+				g(p)
+				p.x = 1
+				g(p)
+			}`,
+			`func f(g func(point), y int) {
+				pY := y
+				g(point{x: 3, y: pY})
+				g(point{x: 1, y: pY})
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"SplitStructJoin",
+			`type point struct{ x, y int }
+			func f(c bool, n, y int) int {
+				p := point{x: n}
+				if c {
+					p.y = y
+				} else {
+					p.y = -y
+				}
+				return p.x + p.y
+			}`,
+			`func f(c bool, y int) int {
+				var pY int
+				if c {
+					pY = y
+				} else {
+					pY = -y
+				}
+				return 2 + pY
+			}`,
+			map[string]Value{"n": Int(2)},
+		},
+		{
+			"SplitStructConflict",
+			`type point struct{ x, y int }
+			func f(c bool, n, y int) int {
+				p := point{x: n}
+				if c {
+					p.y = y
+				}
+				return p.x + p.y
+			}`,
+			`func f(c bool, y int) int {
+				if c {
+					pY := y
+					return 2 + pY
+				}
+				return 2
+			}`,
+			map[string]Value{"n": Int(2)},
+		},
+		{
+			"MapLookup",
+			`func f(mode string, x int) int {
+				widths := map[string]int{"html": 80, "text": 72}
+				if w, ok := widths[mode]; ok {
+					return w * x
+				}
+				return widths[mode] + x
+			}`,
+			`func f(x int) int {
+				return 80 * x
+			}`,
+			map[string]Value{"mode": String("html")},
+		},
+		{
+			"MapMissing",
+			`func f(mode string, x int) int {
+				widths := map[string]int{"html": 80, "text": 72}
+				if w, ok := widths[mode]; ok {
+					return w * x
+				}
+				return widths[mode] + x
+			}`,
+			`func f(x int) int {
+				return 0 + x
+			}`,
+			map[string]Value{"mode": String("pdf")},
+		},
+		{
+			"MapDynamicKey",
+			`func f(mode string, x int) int {
+				widths := map[string]int{"html": 80, "text": x}
+				if _, ok := widths[mode]; ok {
+					return widths[mode]
+				}
+				return len(widths)
+			}`,
+			`func f(mode string) int {
+				_, ok := map[string]int{"html": 80, "text": 5}[mode]
+				if ok {
+					return map[string]int{"html": 80, "text": 5}[mode]
+				}
+				return 2
+			}`,
+			map[string]Value{"x": Int(5)},
+		},
+		{
+			"MapWritten",
+			`func f(mode string, x int) int {
+				widths := map[string]int{"html": 80}
+				widths[mode] = x
+				return widths["html"]
+			}`,
+			`func f(mode string, x int) int {
+				widths := map[string]int{"html": 80}
+				widths[mode] = x
+				return widths["html"]
+			}`,
+			nil,
+		},
+		{
+			"HostCalls",
+			`import (
+				"fmt"
+				"strconv"
+				"strings"
+			)
+
+			func f(s string, n int) string {
+				parts := strings.Split(s, ",")
+				return strings.ToUpper(parts[1]) + strconv.Itoa(n) + fmt.Sprintf("%03d", n)
+			}`,
+			`func f() string {
+				return "B42042"
+			}`,
+			map[string]Value{"s": String("a,b"), "n": Int(42)},
+		},
+		{
+			"HostCallError",
+			`import "strconv"
+
+			func f(s string) int {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return -1
+				}
+				return n
+			}`,
+			`func f() int {
+				n, err := strconv.Atoi("x")
+				if err != nil {
+					return -1
+				}
+				return n
+			}`,
+			map[string]Value{"s": String("x")},
+		},
+		{
+			"HostCallPanics",
+			`import "strings"
+
+			func f(n int) string {
+				return strings.Repeat("a", n)
+			}`,
+			`func f() string {
+				return strings.Repeat("a", -1)
+			}`,
+			map[string]Value{"n": Int(-1)},
+		},
+		{
+			"Append",
+			`func f(n int) int {
+				s := []int{1}
+				s = append(s, n, 2)
+				return s[1] + len(s)
+			}`,
+			`func f() int {
+				return 8
+			}`,
+			map[string]Value{"n": Int(5)},
+		},
+		{
+			"AppendDynamic",
+			`func f(n, y int, t []int) []int {
+				s := []int{n}
+				s = append(s, y)
+				return append(s, t...)
+			}`,
+			`func f(y int, t []int) []int {
+				s := []int{1}
+				s = append(s, y)
+				return append(s, t...)
+			}`,
+			map[string]Value{"n": Int(1)},
+		},
+		{
+			"Make",
+			`func f(n int) int {
+				s := make([]int, n, 4)
+				s = append(s, 7)
+				return len(s) + cap(s) + s[3]
+			}`,
+			`func f() int {
+				return 15
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"MinMax",
+			`func f(k, y int) int {
+				return min(y, k, 5) + max(k, 2)
+			}`,
+			`func f(y int) int {
+				return min(y, 3) + 3
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"Panic",
+			`func f(k, x int) int {
+				if x > k {
+					return 1
+				}
+				panic("too small")
+			}`,
+			`func f(x int) int {
+				if x > 2 {
+					return 1
+				}
+				panic("too small")
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"Effects",
+			`func f(k int, m map[int]int, s []int) {
+				delete(m, k)
+				copy(s, []int{k})
+				println(k)
+			}`,
+			`func f(m map[int]int, s []int) {
+				delete(m, 1)
+				copy(s, []int{1})
+				println(1)
+			}`,
+			map[string]Value{"k": Int(1)},
+		},
+		{
+			"PointerMethod",
+			`type counter struct{ n int }
+			func (c *counter) inc(d int) int {
+				c.n += d
+				return c.n
+			}
+			func f(n, x int) int {
+				c := counter{n: n}
+				c.inc(2)
+				c.inc(x)
+				return c.n
+			}`,
+			`func f(x int) int {
+				c := counter{n: 1}
+				c.inc(2)
+				c.inc(x)
+				return c.n
+			}`,
+			map[string]Value{"n": Int(1)},
+		},
+		{
+			"ShadowBlock",
+			`func f(a int) int {
+				x := a
+				{
+					x := 5
+					a = x
+				}
+				return x + a
+			}`,
+			`func f() int {
+				return 8
+			}`,
+			map[string]Value{"a": Int(3)},
+		},
+		{
+			"ShadowIf",
+			`func f(k, b int) int {
+				x := k
+				if b > 0 {
+					x := b
+					println(x)
+				}
+				return x
+			}`,
+			`func f(b int) int {
+				if b > 0 {
+					x_ := b
+					println(x_)
+				}
+				return 2
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"ShadowLoop",
+			`func f(k, n int) int {
+				x := k
+				for i := 0; i < n; i++ {
+					x := i
+					println(x)
+				}
+				return x
+			}`,
+			`func f(n int) int {
+				i := 0
+				for i < n {
+					x_ := i
+					println(x_)
+					i = i + 1
+				}
+				return 2
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"ShadowTypeSwitch",
+			`func f(k int, v any) int {
+				x := k
+				switch x := v.(type) {
+				case int:
+					println(x)
+				}
+				return x
+			}`,
+			`func f(v any) int {
+				switch x_ := v.(type) {
+				case int:
+					println(x_)
+				}
+				return 2
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"CopyKnown",
+			`func f(k int) int {
+				s := []int{1, 2, 3}
+				copy(s, []int{k, k})
+				return s[0] + s[1] + s[2]
+			}`,
+			`func f() int {
+				return 13
+			}`,
+			map[string]Value{"k": Int(5)},
+		},
+		{
+			"DeleteKnown",
+			`func f(k int) int {
+				m := map[string]int{"a": k, "b": 2}
+				delete(m, "a")
+				return m["a"] + len(m)
+			}`,
+			`func f() int {
+				return 1
+			}`,
+			map[string]Value{"k": Int(5)},
+		},
+		{
+			"DeleteDynamic",
+			`func f(k int, x string) int {
+				m := map[string]int{"a": k}
+				delete(m, x)
+				return m["a"] + len(m)
+			}`,
+			`func f(x string) int {
+				m := map[string]int{"a": 1}
+				delete(m, x)
+				return m["a"] + len(m)
+			}`,
+			map[string]Value{"k": Int(1)},
+		},
+		{
+			"ClosureCall",
+			`func f(k, y int) int {
+				g := func(x int) int { return x * k }
+				return g(y) + g(1)
+			}`,
+			`func f(y int) int {
+				return y*3 + 3
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"ClosureDynamicArg",
+			`func f(k, y int) int {
+				g := func(x int) int {
+					if x > k {
+						return 1
+					}
+					return 2
+				}
+				return g(y)
+			}`,
+			`func f(y int) int {
+				return func(x int) int {
+					if x > 3 {
+						return 1
+					}
+					return 2
+				}(y)
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"ClosureEscapes",
+			`func f(k int) func(int) int {
+				return func(x int) int {
+					if k > 2 {
+						return x * k
+					}
+					return x
+				}
+			}`,
+			`func f() func(int) int {
+				return func(x int) int {
+					return x * 3
+				}
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"ClosureBody",
+			`func f(k, y int) int {
+				g := func(x int) int {
+					z := x + k
+					return z * z
+				}
+				return g(y)
+			}`,
+			`func f(y int) int {
+				return func(x int) int {
+					z := x + 2
+					return z * z
+				}(y)
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"ClosureUnknownCapture",
+			`func f(k, y int) func() int {
+				return func() int { return y + k }
+			}`,
+			`func f(y int) func() int {
+				return func() int {
+					return y + 1
+				}
+			}`,
+			map[string]Value{"k": Int(1)},
+		},
+		{
+			"ClosureAssigns",
+			`func f(k, y int) int {
+				n := k
+				inc := func() { n = n + y }
+				inc()
+				inc()
+				return n
+			}`,
+			`func f(y int) int {
+				n := 1
+				inc := func() {
+					n = n + y
+				}
+				inc()
+				inc()
+				return n
+			}`,
+			map[string]Value{"k": Int(1)},
+		},
+		{
+			"SwitchStatic",
+			`func f(k, x int) int {
+				switch k {
+				case 1, 2:
+					return x
+				case 3:
+					x = x * 2
+					fallthrough
+				case 4:
+					return x + 1
+				default:
+					return 0
+				}
+			}`,
+			`func f(x int) int {
+				x = x * 2
+				return x + 1
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"SwitchDefault",
+			`func f(k, x int) int {
+				switch k {
+				case 1:
+					return x
+				default:
+					x = x + k
+				}
+				return x
+			}`,
+			`func f(x int) int {
+				x = x + 5
+				return x
+			}`,
+			map[string]Value{"k": Int(5)},
+		},
+		{
+			"SwitchDynamic",
+			`func f(k, x int) int {
+				switch x {
+				case k:
+					x = x + 1
+				case 2, k + 1, 4:
+					x = x * k
+				case k - 2:
+					break
+				}
+				return x
+			}`,
+			`func f(x int) int {
+				switch x {
+				case 2:
+					return 3
+				case 3, 4:
+					x = x * 2
+					return x
+				case 0:
+					return 0
+				default:
+					return x
+				}
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"SwitchNoTag",
+			`func f(k, x int) int {
+				switch {
+				case x > 10:
+					return 1
+				case k > 0:
+					return 2
+				case x < 0:
+					return 3
+				}
+				return 4
+			}`,
+			`func f(x int) int {
+				switch {
+				case x > 10:
+					return 1
+				default:
+					return 2
+				}
+			}`,
+			map[string]Value{"k": Int(1)},
+		},
+		{
+			"SwitchInLoop",
+			`func f(n, x int) int {
+				for i := 0; i < n; i = i + 1 {
+					switch x {
+					case 0:
+						return i
+					case 1:
+						continue
+					}
+					x = x - 1
+				}
+				return x
+			}`,
+			`func f(n, x int) int {
+				i := 0
+				for i < n {
+					switch x {
+					case 0:
+						return i
+					case 1:
+						i = i + 1
+						x = 1
+						continue
+					}
+					x = x - 1
+					i = i + 1
+				}
+				return x
+			}`,
+			nil,
+		},
+		{
+			"SwitchExitsLoop",
+			`func f(x, y int) int {
+				for x != 0 {
+					switch x {
+					case 1:
+						x = 0
+					default:
+						x = x - y
+					}
+				}
+				return y
+			}`,
+			`func f(x, y int) int {
+			loop2:
+				for x != 0 {
+					switch x {
+					case 1:
+						x = 0
+						break loop2
+					default:
+						x = x - y
+					}
+				}
+				return y
+			}`,
+			nil,
+		},
+		{
+			"TypeSwitchStatic",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(k, x int) int {
+				var s shape = square{k}
+				switch v := s.(type) {
+				case rect:
+					return v.w
+				case square:
+					return v.n * x
+				default:
+					return 0
+				}
+			}`,
+			`func f(x int) int {
+				return 3 * x
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"TypeSwitchInterface",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(k int) int {
+				var s shape = rect{k, 2}
+				switch s.(type) {
+				case nil:
+					return 0
+				case interface{ perimeter() int }:
+					return 1
+				case shape:
+					return s.area()
+				}
+				return 3
+			}`,
+			`func f(k int) int {
+				sW := k
+				return rect{w: sW, h: 2}.area()
+			}`,
+			nil,
+		},
+		{
+			"TypeSwitchDynamic",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(s shape, x int) int {
+				switch v := s.(type) {
+				case rect:
+					return v.w + x
+				case square:
+					return x
+				case nil:
+					return 0
+				}
+				return -1
+			}`,
+			`func f(s shape, x int) int {
+				switch v := s.(type) {
+				case rect:
+					return v.w + x
+				case square:
+					return x
+				case nil:
+					return 0
+				}
+				return -1
+			}`,
+			nil,
+		},
+		{
+			"TypeSwitchUnbound",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(s shape, x int) int {
+				switch v := s.(type) {
+				case rect:
+					return x + 1
+				default:
+					if x > 0 {
+						return v.area()
+					}
+				}
+				return 0
+			}`,
+			`func f(s shape) int {
+				switch s.(type) {
+				case rect:
+					return 0
+				}
+				return 0
+			}`,
+			map[string]Value{"x": Int(-1)},
+		},
+		{
+			"TypeAssert",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(k int) int {
+				var s shape = square{k}
+				if r, ok := s.(rect); ok {
+					return r.w
+				}
+				return s.(square).n
+			}`,
+			`func f() int {
+				return 2
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"TypeAssertFails",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(k int) int {
+				var s shape = square{k}
+				return s.(rect).w
+			}`,
+			`func f() int {
+				return shape(square{n: 2}).(rect).w
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"TypeAssertDynamic",
+			`type shape interface{ area() int }
+			type square struct{ n int }
+			type rect struct{ w, h int }
+			func (s square) area() int { return s.n * s.n }
+			func (r rect) area() int { return r.w * r.h }
+			func f(s shape) int {
+				if r, ok := s.(rect); ok {
+					return r.w
+				}
+				return s.(square).n
+			}`,
+			`func f(s shape) int {
+				r, ok := s.(rect)
+				if ok {
+					return r.w
+				}
+				return s.(square).n
+			}`,
+			nil,
+		},
+		{
+			"RangeSlice",
+			`func f(k, x int) int {
+				s := []int{1, k, 3}
+				t := 0
+				for i, v := range s {
+					if i == 1 {
+						continue
+					}
+					t = t + v*x
+				}
+				return t
+			}`,
+			`func f(x int) int {
+				t := 0 + 1*x
+				t = t + 3*x
+				return t
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"RangeString",
+			`func f(s string, x int) int {
+				n := 0
+				for _, r := range s {
+					if r == 'b' {
+						break
+					}
+					n = n + x
+				}
+				return n
+			}`,
+			`func f(x int) int {
+				n := 0 + x
+				n = n + x
+				return n
+			}`,
+			map[string]Value{"s": String("aébc")},
+		},
+		{
+			"RangeInt",
+			`func f(n int, xs []int) int {
+				t := 0
+				for i := range n {
+					t = t + xs[i]
+				}
+				return t
+			}`,
+			`func f(xs []int) int {
+				t := 0 + xs[0]
+				t = t + xs[1]
+				t = t + xs[2]
+				return t
+			}`,
+			map[string]Value{"n": Int(3)},
+		},
+		{
+			"RangeDynamic",
+			`func f(k int, xs []int) int {
+				t := 0
+				for i, x := range xs {
+					if i > k {
+						return t
+					}
+					t = t + x*k
+				}
+				return t
+			}`,
+			`func f(xs []int) int {
+				t := 0
+				for i, x := range xs {
+					if i > 2 {
+						return t
+					}
+					t = t + x*2
+				}
+				return t
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"RangeDynamicUnused",
+			`func f(k int, xs []int) int {
+				n := 0
+				for i, x := range xs {
+					if k > 0 {
+						n = n + i
+					} else {
+						n = n + x
+					}
+				}
+				return n
+			}`,
+			`func f(xs []int) int {
+				n := 0
+				for i := range xs {
+					n = n + i
+				}
+				return n
+			}`,
+			map[string]Value{"k": Int(1)},
+		},
+		{
+			"RangeMutated",
+			`func f(x int) int {
+				s := []int{1, 2, 3}
+				t := 0
+				for i, v := range s {
+					if i+1 < len(s) {
+						s[i+1] = v * x
+					}
+					t = t + v
+				}
+				return t
+			}`,
+			`func f(x int) int {
+				s := []int{1, 2, 3}
+				t := 0
+				for i, v := range s {
+					if i+1 < len(s) {
+						s[i+1] = v * x
+					}
+					t = t + v
+				}
+				return t
+			}`,
+			nil,
+		},
+		{
+			"LabelStatic",
+			`func f(s string, sep byte) int {
+				n := 0
+				state := 0
+			scan:
+				for i := 0; i < len(s); i = i + 1 {
+					switch state {
+					case 0:
+						if s[i] == sep {
+							continue scan
+						}
+						state = 1
+						n = n + 1
+					case 1:
+						if s[i] == '.' {
+							break scan
+						}
+						if s[i] == sep {
+							state = 0
+						}
+					}
+				}
+				return n
+			}`,
+			`func f() int {
+				return 3
+			}`,
+			map[string]Value{"s": String(" a bc  d. e"), "sep": Int(' ')},
+		},
+		{
+			"LabelDynamic",
+			`func f(s string, sep byte) int {
+				n := 0
+				state := 0
+			scan:
+				for i := 0; i < len(s); i = i + 1 {
+					switch state {
+					case 0:
+						if s[i] == sep {
+							continue scan
+						}
+						state = 1
+						n = n + 1
+					case 1:
+						if s[i] == '.' {
+							break scan
+						}
+						if s[i] == sep {
+							state = 0
+						}
+					}
+				}
+				return n
+			}`,
+			`func f(s string) int {
+				i := 0
+				n := 0
+				state := 0
+			loop1:
+				for i < len(s) {
+					switch state {
+					case 0:
+						if s[i] == 44 {
+							i = i + 1
+							state = 0
+							continue
+						}
+						n = n + 1
+						i = i + 1
+						state = 1
+					case 1:
+						if s[i] == 46 {
+							state = 1
+							break loop1
+						}
+						if s[i] == 44 {
+							i = i + 1
+							state = 0
+						} else {
+							i = i + 1
+							state = 1
+						}
+					default:
+						i = i + 1
+					}
+				}
+				return n
+			}`,
+			map[string]Value{"sep": Int(',')},
+		},
+		{
+			"NestedLabels",
+			`func f(rows [][]int, k int) int {
+				t := 0
+			outer:
+				for _, row := range rows {
+					for _, x := range row {
+						if x == k {
+							continue outer
+						}
+						if x < 0 {
+							break outer
+						}
+						t = t + x
+					}
+				}
+				return t
+			}`,
+			`func f(rows [][]int) int {
+				t := 0
+			loop2:
+				for _, row := range rows {
+					for _, x := range row {
+						if x == 0 {
+							break
+						}
+						if x < 0 {
+							break loop2
+						}
+						t = t + x
+					}
+				}
+				return t
+			}`,
+			map[string]Value{"k": Int(0)},
+		},
+		{
+			"GotoStatic",
+			`func f(n int) int {
+				i := 0
+				t := 0
+			again:
+				if i < n {
+					t = t + i
+					i = i + 1
+					goto again
+				}
+				return t
+			}`,
+			`func f() int {
+				return 6
+			}`,
+			map[string]Value{"n": Int(4)},
+		},
+		{
+			"GotoDynamic",
+			`func f(n int) int {
+				i := 0
+				t := 0
+			again:
+				if i < n {
+					t = t + i
+					i = i + 1
+					goto again
+				}
+				return t
+			}`,
+			`func f(n int) int {
+				i := 0
+				t := 0
+				for {
+					if i < n {
+						t = t + i
+						i = i + 1
+						continue
+					}
+					return t
+				}
+			}`,
+			nil,
+		},
+		{
+			"GotoForward",
+			`func f(x, k int) int {
+				if x < k {
+					goto fail
+				}
+				return x
+			fail:
+				return -1
+			}`,
+			`func f(x int) int {
+				if x < 3 {
+					return -1
+				}
+				return x
+			}`,
+			map[string]Value{"k": Int(3)},
+		},
+		{
+			"IncDec",
+			`func f(n int) int {
+				t := 0
+				for i := 0; i < n; i++ {
+					t += i
+				}
+				n--
+				return t * n
+			}`,
+			`func f() int {
+				return 18
+			}`,
+			map[string]Value{"n": Int(4)},
+		},
+		{
+			"OpAssign",
+			`func f(k uint) uint {
+				mask := uint(0)
+				for _, b := range []uint{0, 1, 2, 3} {
+					mask |= 1 << b
+				}
+				mask &^= k
+				mask <<= 1
+				return mask
+			}`,
+			`func f() uint {
+				return 26
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"OpAssignDynamic",
+			`func f(x, k int) int {
+				x += k
+				x *= k
+				x++
+				return x
+			}`,
+			`func f(x int) int {
+				x = x + 2
+				x = x * 2
+				x = x + 1
+				return x
+			}`,
+			map[string]Value{"k": Int(2)},
+		},
+		{
+			"OpAssignIndex",
+			`func f(counts []int, i int) []int {
+				counts[i] += 2
+				counts[i]--
+				return counts
+			}`,
+			`func f(counts []int) []int {
+				counts[1] = counts[1] + 2
+				counts[1] = counts[1] - 1
+				return counts
+			}`,
+			map[string]Value{"i": Int(1)},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out := specialize(t, test.in, "f", test.static)
+			expected := formatSource(t, test.out)
+			if out != expected {
+				t.Errorf("\nexpected\n%s\ngot\n%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestIndexOutOfRange(t *testing.T) {
+	out := specialize(t, `func f(s string, i int) byte {
+		return s[i]
+	}`, "f", map[string]Value{"s": String("abc"), "i": Int(-1)})
+	expected := formatSource(t, `func f() byte {
+		return "abc"[(*new(int))+-1]
+	}`)
+	if out != expected {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expected, out)
+	}
+	// The residual program panics at run time, as the original does, rather
+	// than failing to compile.
+	parseFile(t, out)
+}
+
+func TestRangeMaps(t *testing.T) {
+	src := `func f(x int) int {
+		m := map[string]int{"b": 2, "a": 1, "c": 3}
+		t := 0
+		for k, v := range m {
+			if k != "b" {
+				t = t*x + v
+			}
+		}
+		return t
+	}`
+	for _, test := range []struct {
+		name string
+		opts []Option
+		out  string
+	}{
+		{
+			"Unsorted",
+			nil,
+			`func f(x int) int {
+				t := 0
+				for k, v := range map[string]int{"b": 2, "a": 1, "c": 3} {
+					if k != "b" {
+						t = t*x + v
+					}
+				}
+				return t
+			}`,
+		},
+		{
+			"Sorted",
+			[]Option{SortMapRanges()},
+			`func f(x int) int {
+				t := 0*x + 1
+				t = t*x + 3
+				return t
+			}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			decl, info := parseFunc(t, src, "f")
+			res, err := Specialize(decl, info, nil, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := formatSource(t, nodeString(res))
+			if expected := formatSource(t, test.out); out != expected {
+				t.Errorf("\nexpected\n%s\ngot\n%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestCalls(t *testing.T) {
+	for _, test := range []struct {
+		name, in, out string
+	}{
+		{
+			"Fold",
+			`func sq(x int) int { return x * x }
+			func f() int { return sq(3) + 1 }`,
+			`func f() int {
+				return 10
+			}`,
+		},
+		{
+			"Inline",
+			`func scale(x, k int) int { return x * k }
+			func f(y int) int { return scale(y, 3) }`,
+			`func f(y int) int {
+				return y * 3
+			}`,
+		},
+		{
+			"Separate",
+			`func clamp(x, hi int) int {
+				if x > hi {
+					return hi
+				}
+				return x
+			}
+			func f(y int) int { return clamp(y, 10) + clamp(y, 10) }`,
+			`func f(y int) int {
+				return clamp10(y) + clamp10(y)
+			}
+
+			func clamp10(x int) int {
+				if x > 10 {
+					return 10
+				}
+				return x
+			}`,
+		},
+		{
+			"ArgumentEffects",
+			`func scale(x, k int) int { return x * k }
+			func g() int { return 0 }
+			func f() int { return scale(g(), 3) }`,
+			`func f() int {
+				return scale3(g())
+			}
+
+			func scale3(x int) int {
+				return x * 3
+			}`,
+		},
+		{
+			"Recursive",
+			`func pow(x, n int) int {
+				if n == 0 {
+					return 1
+				}
+				return x * pow(x, n-1)
+			}
+			func f(y int) int { return pow(y, 2) }`,
+			`func f(y int) int {
+				return y * (y * 1)
+			}`,
+		},
+		{
+			"RecursiveResidual",
+			`func sum(n, x int) int {
+				if x > 0 {
+					return n + sum(n, x-1)
+				}
+				return 0
+			}
+			func f(y int) int { return sum(2, y) }`,
+			`func f(y int) int {
+				return sum2(y)
+			}
+
+			func sum2(x int) int {
+				if x > 0 {
+					return 2 + sum2(x-1)
+				}
+				return 0
+			}`,
+		},
+		{
+			"Method",
+			`type rect struct{ w, h int }
+			func (r rect) area() int { return r.w * r.h }
+			func (r rect) clip(k int) int {
+				if r.w > k {
+					return k
+				}
+				return r.w
+			}
+			func f(r rect) int { return rect{2, 3}.area() + r.clip(2) }`,
+			`func f(r rect) int {
+				return 6 + rectClip2(r)
+			}
+
+			func rectClip2(r rect) int {
+				if r.w > 2 {
+					return 2
+				}
+				return r.w
+			}`,
+		},
+		{
+			"Closure",
+			`func apply(f func(int) int, x int) int { return f(x) }
+			func twice(f func(int) int, x int) int {
+				y := f(x)
+				return f(y)
+			}
+			func f(k, y int) int {
+				return apply(func(x int) int { return x * k }, y) + twice(func(x int) int { return x + 3 }, y)
+			}`,
+			`func f(k, y int) int {
+				return apply(func(x int) int {
+					return x * k
+				}, y) + twiceFunc(y)
+			}
+
+			func twiceFunc(x int) int {
+				y := x + 3
+				return y + 3
+			}`,
+		},
+		{
+			"InlineDynamicBranch",
+			`func pick(k, x int) int {
+				z := k
+				if x > 0 {
+					z = k
+				}
+				return z * 2
+			}
+			func f(y int) int { return pick(3, y) }`,
+			`func f(y int) int {
+				return 6
+			}`,
+		},
+		{
+			"NoStatic",
+			`func scale(x, k int) int { return x * k }
+			func f(y int) int { return scale(y, y) }`,
+			`func f(y int) int {
+				return scale(y, y)
+			}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f, info := parseFile(t, test.in)
+			var decl *ast.FuncDecl
+			for _, d := range f.Decls {
+				if d, ok := d.(*ast.FuncDecl); ok && d.Name.Name == "f" {
+					decl = d
+				}
+			}
+			pkg := NewPackage([]*ast.File{f}, info)
+			res, err := Specialize(decl, info, nil, Calls(pkg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := nodeString(res)
+			for _, d := range pkg.Funcs() {
+				src += "\n\n" + nodeString(d)
+			}
+			expected := formatSource(t, test.out)
+			if got := formatSource(t, src); got != expected {
+				t.Errorf("expected\n%s\ngot\n%s", expected, got)
+			}
+		})
+	}
+}
+
+func TestCallsRecursiveRoot(t *testing.T) {
+	f, info := parseFile(t, `func sum(n, x int) int {
+		if x > 0 {
+			return n + sum(n, x-1)
+		}
+		return 0
+	}`)
+	decl := f.Decls[0].(*ast.FuncDecl)
+	pkg := NewPackage([]*ast.File{f}, info)
+	res, err := Specialize(decl, info, map[string]Value{"n": Int(2)}, Calls(pkg), Named("sum2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := nodeString(res)
+	for _, d := range pkg.Funcs() {
+		src += "\n\n" + nodeString(d)
+	}
+	expected := formatSource(t, `func sum2(x int) int {
+		if x > 0 {
+			return 2 + sum2(x-1)
+		}
+		return 0
+	}`)
+	if got := formatSource(t, src); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("test.double", func(x int) int { return x * 2 })
+	out := specialize(t, `func double(x int) int { return x * 2 }
+		func f(y int) int { return double(21) + double(y) }`, "f", nil)
+	expected := formatSource(t, `func f(y int) int {
+		return 42 + double(y)
+	}`)
+	if out != expected {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestSpecializeErrors(t *testing.T) {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, "test.go", "package test\nfunc f(x int) { for i := 0; ; i = i + 1 {} }", 0)
+	decl := f.Decls[0].(*ast.FuncDecl)
+	info := &types.Info{Defs: map[*ast.Ident]types.Object{}}
+	if _, err := Specialize(decl, info, map[string]Value{"y": Int(1)}); err == nil {
+		t.Error("expected an error for an unknown parameter")
+	}
+	if _, err := Divide(decl, info, []string{"y"}); err == nil {
+		t.Error("expected an error for an unknown parameter")
+	}
+	if _, err := Specialize(decl, info, nil); !errors.Is(err, errNoTermination) {
+		t.Errorf("expected non-termination, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		static map[string]Value
+	}{
+		{"String", map[string]Value{"x": String("a")}},
+		{"Bool", map[string]Value{"x": True}},
+		{"Fraction", map[string]Value{"x": Float(1.5)}},
+		{"Overflow", map[string]Value{"b": Int(256)}},
+		{"Interface", map[string]Value{"s": Int(3)}},
+		{"Field", map[string]Value{"p.x": String("a")}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			decl, info := parseFunc(t, `type shape interface{ area() int }
+			type point struct{ x, y int }
+			func f(x int, b byte, s shape, p point) int {
+				return x * int(b) + s.area() + p.x
+			}`, "f")
+			if _, err := Specialize(decl, info, test.static); err == nil {
+				t.Error("expected an error for a value of the wrong type")
+			}
+		})
+	}
+}
+
+func TestSpecializeSelect(t *testing.T) {
+	decl, info := parseFunc(t, `func f(k int, c chan int) int {
+		n := 0
+	loop:
+		for {
+			select {
+			case x := <-c:
+				if x == k {
+					break loop
+				}
+				n = n + x
+			}
+		}
+		return n
+	}`, "f")
+	_, err := Specialize(decl, info, map[string]Value{"k": Int(1)})
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expected an unsupported statement, got %v", err)
+	}
+	if _, ok := unsupported.Stmt.(*ast.SelectStmt); !ok {
+		t.Errorf("expected the select to be unsupported, got %T", unsupported.Stmt)
+	}
+	if msg := unsupported.Error(); msg != "unsupported statement: select" {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	for _, test := range []struct {
+		name, in, out string
+		static        map[string]Value
+		dynamic       []string
+	}{
+		{
+			"StaticLoop",
+			`func f(n, x int) int {
+				s := 0
+				for i := 0; ; i = i + 1 {
+					if i == n {
+						break
+					}
+					s = s + x
+				}
+				return s
+			}`,
+			`func f(x int) int {
+				s := 0
+				s = s + x
+				s = s + x
+				return s
+			}`,
+			map[string]Value{"n": Int(2)},
+			[]string{"x", "s"},
+		},
+		{
+			"DynamicLoop",
+			`func f(n, x int) int {
+				s := 0
+				for i := 0; i < n; i = i + 1 {
+					s = s + x
+				}
+				return s
+			}`,
+			`func f(n int) int {
+				i := 0
+				s := 0
+				for i < n {
+					s = s + 2
+					i = i + 1
+				}
+				return s
+			}`,
+			map[string]Value{"x": Int(2)},
+			[]string{"n", "s", "i"},
+		},
+		{
+			"InfiniteLoop",
+			`func f() {
+				for i := 0; ; i = i + 1 {
+				}
+			}`,
+			`func f() {
+				i := 0
+				for {
+					i = i + 1
+				}
+			}`,
+			nil,
+			[]string{"i"},
+		},
+		{
+			"Switch",
+			`func f(n, x int) int {
+				y := 0
+				switch n {
+				case 1:
+					y = x
+				case x:
+					y = 2
+				}
+				return y
+			}`,
+			`func f(x int) int {
+				y := 0
+				switch 3 {
+				case x:
+					y = 2
+				}
+				return y
+			}`,
+			map[string]Value{"n": Int(3)},
+			[]string{"x", "y"},
+		},
+		{
+			"Shadow",
+			`func f(n, x int) int {
+				s := n
+				if x > 0 {
+					s := x
+					println(s)
+				}
+				return s
+			}`,
+			`func f(x int) int {
+				if x > 0 {
+					s_ := x
+					println(s_)
+				}
+				return 2
+			}`,
+			map[string]Value{"n": Int(2)},
+			[]string{"x", "s"},
+		},
+		{
+			"DynamicDelete",
+			`func f(k int, x string) int {
+				m := map[string]int{"a": k}
+				delete(m, x)
+				return len(m)
+			}`,
+			`func f(x string) int {
+				m := map[string]int{"a": 1}
+				delete(m, x)
+				return len(m)
+			}`,
+			map[string]Value{"k": Int(1)},
+			[]string{"x", "m"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			decl, info := parseFunc(t, test.in, "f")
+			var static []string
+			for name := range test.static {
+				static = append(static, name)
+			}
+			d, err := Divide(decl, info, static)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dynamic []string
+			for _, obj := range d.Dynamic() {
+				dynamic = append(dynamic, obj.Name())
+			}
+			if !reflect.DeepEqual(dynamic, test.dynamic) {
+				t.Errorf("expected dynamic variables %v, got %v", test.dynamic, dynamic)
+			}
+			res, err := Specialize(decl, info, test.static, Offline(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := formatSource(t, nodeString(res))
+			expected := formatSource(t, test.out)
+			if out != expected {
+				t.Errorf("\nexpected\n%s\ngot\n%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestScopeEquality(t *testing.T) {
+	a := newBindings().Bind("x", Int(1)).Bind("s", String("a"))
+	b := newBindings().declare("y").Bind("s", String("a")).Bind("x", Int(1))
+	c := a.Bind("x", Int(2))
+	if !a.Equal(b) || a.Hash() != b.Hash() {
+		t.Error("expected scopes with the same known values to be equal")
+	}
+	if a.Equal(c) {
+		t.Error("expected scopes with different known values to differ")
+	}
+	if a.Equal(a.Bind("x", &UnknownValue{&ast.Ident{Name: "x"}})) {
+		t.Error("expected known and unknown values to differ")
+	}
+}
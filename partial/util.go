@@ -2,15 +2,90 @@ package partial
 
 import (
 	"go/ast"
+	"go/constant"
+	"go/parser"
 	"go/token"
+	"go/types"
+	"hash/fnv"
 )
 
 type hasExpr interface {
 	Expr() ast.Expr
 }
 
+// opExpr applies an operator in the residual program. A constant operand
+// takes its type from the other operand if that is not constant, unless it is
+// being shifted.
 func opExpr(op token.Token, x hasExpr, y hasExpr) Value {
-	return &UnknownValue{&ast.BinaryExpr{Op: op, X: x.Expr(), Y: y.Expr()}}
+	xe, ye := x.Expr(), y.Expr()
+	c, xc := x.(basicValue)
+	d, yc := y.(basicValue)
+	if xc && !yc && op != token.SHL && op != token.SHR {
+		xe = c.basic().literal()
+	}
+	if yc && !xc {
+		ye = d.basic().literal()
+	}
+	if yc && (op == token.QUO || op == token.REM) && constant.Sign(d.basic().value) == 0 {
+		// Go rejects division by a constant zero, so the residual program
+		// divides by a zero that is not constant, and panics at run time as
+		// the original does.
+		ye = zeroExpr(d)
+	} else if xc && yc && basicInfo(c.basic().typ)&basicInfo(d.basic().typ)&types.IsNumeric != 0 {
+		// Constants whose result overflows, or depends on the platform, are
+		// rejected by Go, so the residual program computes it at run time.
+		switch {
+		case !isUntyped(c.basic().typ):
+			xe = &ast.ParenExpr{X: dynamicExpr(c)}
+		case !isUntyped(d.basic().typ):
+			ye = &ast.ParenExpr{X: dynamicExpr(d)}
+		}
+	}
+	return &UnknownValue{&ast.BinaryExpr{Op: op, X: xe, Y: ye}}
+}
+
+// zeroExpr gives a zero of the type of a constant that is not itself constant,
+// for use where Go would reject an operation on constants that panics at run
+// time.
+func zeroExpr(c basicValue) ast.Expr {
+	return &ast.ParenExpr{X: &ast.StarExpr{X: &ast.CallExpr{
+		Fun:  &ast.Ident{Name: "new"},
+		Args: []ast.Expr{typeExpr(types.Default(c.basic().typ), c.basic().pkg)},
+	}}}
+}
+
+// dynamicExpr gives a constant as an expression that is not constant, so that
+// operations on it are left to run time.
+func dynamicExpr(c basicValue) ast.Expr {
+	return &ast.BinaryExpr{Op: token.ADD, X: zeroExpr(c), Y: c.basic().literal()}
+}
+
+// indexExpr indexes a value in the residual program. A constant index that is
+// out of range is not constant there, as Go rejects those of strings and
+// arrays, and negative ones of slices.
+func indexExpr(x, i Value) Value {
+	ie := i.Expr()
+	if c, ok := i.(basicValue); ok && x.Known() {
+		rejected := true
+		switch x.(type) {
+		case *MapValue:
+			rejected = false
+		case *SliceValue:
+			rejected = constant.Sign(c.basic().value) < 0
+		}
+		if rejected {
+			ie = dynamicExpr(c)
+		}
+	}
+	return &UnknownValue{&ast.IndexExpr{X: x.Expr(), Index: ie}}
+}
+
+func unaryExpr(op token.Token, x hasExpr) Value {
+	e := x.Expr()
+	if _, ok := e.(*ast.BinaryExpr); ok {
+		e = &ast.ParenExpr{X: e}
+	}
+	return &UnknownValue{&ast.UnaryExpr{Op: op, X: e}}
 }
 
 func callExpr(f hasExpr, args []Value) Value {
@@ -28,3 +103,53 @@ func argsExpr(args []Value) []ast.Expr {
 	}
 	return res
 }
+
+// typeExpr gives an expression for a type, as it is named in a package.
+func typeExpr(t types.Type, pkg *types.Package) ast.Expr {
+	s := types.TypeString(t, func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		return importName(pkg, p)
+	})
+	e, err := parser.ParseExpr(s)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// importName gives the name that the files of a package import another
+// package by. Its own name is preferred where some file imports it by that,
+// and otherwise the first name that a file gives it.
+func importName(pkg, imported *types.Package) string {
+	if pkg == nil {
+		return imported.Name()
+	}
+	alias := ""
+	for i := 0; i < pkg.Scope().NumChildren(); i++ {
+		file := pkg.Scope().Child(i)
+		for _, name := range file.Names() {
+			obj, ok := file.Lookup(name).(*types.PkgName)
+			if !ok || obj.Imported() != imported || name == "_" {
+				continue
+			}
+			if name == imported.Name() {
+				return name
+			}
+			if alias == "" {
+				alias = name
+			}
+		}
+	}
+	if alias == "" {
+		return imported.Name()
+	}
+	return alias
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -2,8 +2,13 @@ package partial
 
 import (
 	"go/ast"
+	"go/constant"
 	"go/token"
+	"go/types"
+	"math"
 	"strconv"
+	"strings"
+	"unicode"
 )
 
 type Value interface {
@@ -12,126 +17,252 @@ type Value interface {
 	Known() bool
 	KnownRef() bool
 	Op(op token.Token, w Value) Value
+	UnaryOp(op token.Token) Value
 	Member(name string) Value
 	Call(args []Value) []Value
-	Update(w Value)
+	Update(scope ExecScope, w Value) ExecScope
+	Hash() uint64
 }
 
 type UnknownValue struct {
 	expr ast.Expr
 }
 
-func (v *UnknownValue) Expr() ast.Expr                   { return v.expr }
-func (v *UnknownValue) Matches(w Value) bool             { return !w.Known() }
-func (v *UnknownValue) Known() bool                      { return false }
-func (v *UnknownValue) KnownRef() bool                   { return false }
-func (v *UnknownValue) Op(op token.Token, w Value) Value { return opExpr(op, v, w) }
-func (v *UnknownValue) Member(name string) Value         { return selExpr(v, name) }
-func (v *UnknownValue) Call(args []Value) []Value        { return []Value{callExpr(v, args)} }
-func (v *UnknownValue) Update(w Value)                   {}
+func (v *UnknownValue) Expr() ast.Expr                        { return v.expr }
+func (v *UnknownValue) Matches(w Value) bool                  { return !w.Known() }
+func (v *UnknownValue) Known() bool                           { return false }
+func (v *UnknownValue) KnownRef() bool                        { return false }
+func (v *UnknownValue) Op(op token.Token, w Value) Value      { return opExpr(op, v, w) }
+func (v *UnknownValue) UnaryOp(op token.Token) Value          { return unaryExpr(op, v) }
+func (v *UnknownValue) Member(name string) Value              { return selExpr(v, name) }
+func (v *UnknownValue) Call(args []Value) []Value             { return []Value{callExpr(v, args)} }
+func (v *UnknownValue) Update(s ExecScope, w Value) ExecScope { return s }
+func (v *UnknownValue) Hash() uint64                          { return 0 }
 
 type baseValue struct{}
 
-func (baseValue) Matches(Value) bool               { return false }
-func (baseValue) Known() bool                      { return true }
-func (baseValue) KnownRef() bool                   { return false }
-func (baseValue) Op(op token.Token, w Value) Value { panic("invalid operation") }
-func (baseValue) Member(name string) Value         { panic("invalid operation") }
-func (baseValue) Call(args []Value) []Value        { panic("invalid operation") }
-func (baseValue) Update(w Value)                   {}
+func (baseValue) Matches(Value) bool                    { return false }
+func (baseValue) Known() bool                           { return true }
+func (baseValue) KnownRef() bool                        { return false }
+func (baseValue) Op(op token.Token, w Value) Value      { panic("invalid operation") }
+func (baseValue) UnaryOp(op token.Token) Value          { panic("invalid operation") }
+func (baseValue) Member(name string) Value              { panic("invalid operation") }
+func (baseValue) Call(args []Value) []Value             { panic("invalid operation") }
+func (baseValue) Update(s ExecScope, w Value) ExecScope { return s }
 
-type IntValue struct {
+// A constValue is a value of basic type, held as a constant along with its
+// type. Untyped constants have untyped types.
+type constValue struct {
 	baseValue
-	value int64
+	value constant.Value
+	typ   types.Type
+	pkg   *types.Package // that a named type is named relative to
 }
 
-func Int(v int64) *IntValue {
-	return &IntValue{value: v}
+// basicValue is implemented by the values that are held as constants.
+type basicValue interface {
+	Value
+	basic() *constValue
 }
 
-func (v *IntValue) Expr() ast.Expr {
-	return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(v.value, 10)}
+func (v *constValue) basic() *constValue {
+	return v
 }
 
-func (v *IntValue) Matches(w Value) bool {
-	if w, ok := w.(*IntValue); ok {
-		return w.value == v.value
+func (v *constValue) Matches(w Value) bool {
+	u, ok := w.(basicValue)
+	if !ok {
+		return false
+	}
+	x, y := v.value, u.basic().value
+	if x.Kind() != y.Kind() && (!numeric(x) || !numeric(y)) {
+		return false
 	}
-	return false
-}
-
-func (v *IntValue) Op(op token.Token, w Value) Value {
-	if w, ok := w.(*IntValue); ok {
-		vx, wx := v.value, w.value
-		switch op {
-		case token.ADD:
-			return Int(vx + wx)
-		case token.MUL:
-			return Int(vx * wx)
-		case token.QUO:
-			return Int(vx / wx)
-		case token.REM:
-			return Int(vx % wx)
-		case token.AND:
-			return Int(vx | wx)
-		case token.OR:
-			return Int(vx | wx)
-		case token.XOR:
-			return Int(vx ^ wx)
-		case token.SHL:
-			return Int(vx << uint(wx))
-		case token.SHR:
-			return Int(vx >> uint(wx))
-		case token.AND_NOT:
-			return Int(vx &^ wx)
-
-		case token.EQL:
-			return Bool(vx == wx)
-		case token.NEQ:
+	return constant.Compare(x, token.EQL, y)
+}
+
+func (v *constValue) Hash() uint64 {
+	switch v.value.Kind() {
+	case constant.Bool:
+		if constant.BoolVal(v.value) {
+			return 1
 		}
+		return 2
+	case constant.String:
+		return hashString(constant.StringVal(v.value))
 	}
-	return opExpr(op, v, w)
+	// Numbers that are equal must hash the same whatever their kind.
+	re, _ := constant.Float64Val(constant.ToFloat(constant.Real(v.value)))
+	im, _ := constant.Float64Val(constant.ToFloat(constant.Imag(v.value)))
+	return math.Float64bits(re) ^ math.Float64bits(im)*31
 }
 
-type StringValue struct {
-	baseValue
-	value string
+// Expr gives the value as a literal, converted to its type if the literal
+// would otherwise have a different type.
+func (v *constValue) Expr() ast.Expr {
+	lit, t := v.lit()
+	b, ok := v.typ.Underlying().(*types.Basic)
+	if !ok || b.Info()&types.IsUntyped != 0 || types.Identical(v.typ, t) {
+		return lit
+	}
+	return &ast.CallExpr{Fun: typeExpr(v.typ, v.pkg), Args: []ast.Expr{lit}}
 }
 
-func String(v string) *StringValue {
-	return &StringValue{value: v}
+// literal gives the value as a literal, without regard to its type.
+func (v *constValue) literal() ast.Expr {
+	lit, _ := v.lit()
+	return lit
 }
 
-func (v *StringValue) Matches(w Value) bool {
-	if w, ok := w.(*StringValue); ok {
-		return w.value == v.value
+// lit gives the value as a literal, along with the type that the literal has
+// by default.
+func (v *constValue) lit() (ast.Expr, types.Type) {
+	info := basicInfo(v.typ)
+	switch {
+	case v.value.Kind() == constant.Bool:
+		return &ast.Ident{Name: v.value.String()}, types.Typ[types.Bool]
+
+	case v.value.Kind() == constant.String:
+		return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(constant.StringVal(v.value))}, types.Typ[types.String]
+
+	case info&types.IsComplex != 0:
+		re, im := constant.Real(v.value), constant.Imag(v.value)
+		op := token.ADD
+		if constant.Sign(im) < 0 {
+			op, im = token.SUB, constant.UnaryOp(token.SUB, im, 0)
+		}
+		imag := &ast.BasicLit{Kind: token.IMAG, Value: floatString(im, v.bits()) + "i"}
+		if constant.Sign(re) == 0 && op == token.ADD {
+			return imag, types.Typ[types.Complex128]
+		}
+		var real ast.Expr = &ast.BasicLit{Kind: token.FLOAT, Value: floatString(re, v.bits())}
+		if constant.Sign(re) < 0 {
+			real = &ast.UnaryExpr{Op: token.SUB, X: &ast.BasicLit{Kind: token.FLOAT, Value: floatString(constant.UnaryOp(token.SUB, re, 0), v.bits())}}
+		}
+		return &ast.ParenExpr{X: &ast.BinaryExpr{X: real, Op: op, Y: imag}}, types.Typ[types.Complex128]
+	}
+
+	if constant.Sign(v.value) < 0 {
+		neg := &constValue{value: constant.UnaryOp(token.SUB, v.value, 0), typ: v.typ}
+		lit, t := neg.lit()
+		return &ast.UnaryExpr{Op: token.SUB, X: lit}, t
 	}
-	return false
+	switch {
+	case info&types.IsFloat != 0:
+		s := floatString(v.value, v.bits())
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return &ast.BasicLit{Kind: token.FLOAT, Value: s}, types.Typ[types.Float64]
+
+	case isRune(v.typ):
+		if i, ok := constant.Int64Val(v.value); ok && i <= unicode.MaxRune && unicode.IsPrint(rune(i)) {
+			return &ast.BasicLit{Kind: token.CHAR, Value: strconv.QuoteRune(rune(i))}, types.Typ[types.Int32]
+		}
+	}
+	return &ast.BasicLit{Kind: token.INT, Value: v.value.ExactString()}, types.Typ[types.Int]
+}
+
+// bits gives the precision of the floats in a value's type.
+func (v *constValue) bits() int {
+	if b, ok := v.typ.Underlying().(*types.Basic); ok && (b.Kind() == types.Float32 || b.Kind() == types.Complex64) {
+		return 32
+	}
+	return 64
+}
+
+// floatString formats a number as the shortest decimal that rounds to the same
+// float of the given precision.
+func floatString(c constant.Value, bits int) string {
+	f, _ := constant.Float64Val(constant.ToFloat(c))
+	return strconv.FormatFloat(f, 'g', -1, bits)
+}
+
+func numeric(c constant.Value) bool {
+	k := c.Kind()
+	return k == constant.Int || k == constant.Float || k == constant.Complex
 }
 
-func (v *StringValue) Expr() ast.Expr {
-	return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(v.value)}
+func isRune(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && (b.Kind() == types.Int32 || b.Kind() == types.UntypedRune)
 }
 
-func (v *StringValue) Op(op token.Token, w Value) Value {
-	if w, ok := w.(*StringValue); ok {
-		vx, wx := v.value, w.value
-		switch op {
-		case token.ADD:
-			return String(vx + wx)
+func (v *constValue) Op(op token.Token, w Value) Value {
+	u, ok := w.(basicValue)
+	if !ok {
+		return opExpr(op, v, w)
+	}
+	if res := constOp(v, op, u.basic()); res != nil {
+		pkg := v.pkg
+		if pkg == nil {
+			pkg = u.basic().pkg
 		}
+		return inPackage(res, pkg)
 	}
 	return opExpr(op, v, w)
 }
 
+func (v *constValue) UnaryOp(op token.Token) Value {
+	if res := constUnary(op, v); res != nil {
+		return inPackage(res, v.pkg)
+	}
+	if basicInfo(v.typ)&types.IsNumeric != 0 && !isUntyped(v.typ) {
+		// As with binary operators, the result is left to run time.
+		return unaryExpr(op, &UnknownValue{dynamicExpr(v)})
+	}
+	return unaryExpr(op, v)
+}
+
+type IntValue struct {
+	constValue
+}
+
+func Int(v int64) *IntValue {
+	return &IntValue{constValue{value: constant.MakeInt64(v), typ: types.Typ[types.UntypedInt]}}
+}
+
+type StringValue struct {
+	constValue
+}
+
+func String(v string) *StringValue {
+	return &StringValue{constValue{value: constant.MakeString(v), typ: types.Typ[types.UntypedString]}}
+}
+
+type FloatValue struct {
+	constValue
+}
+
+func Float(v float64) *FloatValue {
+	return &FloatValue{constValue{value: constant.MakeFloat64(v), typ: types.Typ[types.UntypedFloat]}}
+}
+
+type ComplexValue struct {
+	constValue
+}
+
+func Complex(v complex128) *ComplexValue {
+	c := constant.BinaryOp(
+		constant.MakeFloat64(real(v)),
+		token.ADD,
+		constant.MakeImag(constant.MakeFloat64(imag(v))),
+	)
+	return &ComplexValue{constValue{value: c, typ: types.Typ[types.UntypedComplex]}}
+}
+
+// Rune creates an untyped rune constant.
+func Rune(v rune) *IntValue {
+	return &IntValue{constValue{value: constant.MakeInt64(int64(v)), typ: types.Typ[types.UntypedRune]}}
+}
+
 type BoolValue struct {
-	baseValue
-	value bool
+	constValue
 }
 
 var (
-	True  = &BoolValue{value: true}
-	False = &BoolValue{value: false}
+	True  = &BoolValue{constValue{value: constant.MakeBool(true), typ: types.Typ[types.UntypedBool]}}
+	False = &BoolValue{constValue{value: constant.MakeBool(false), typ: types.Typ[types.UntypedBool]}}
 )
 
 func Bool(value bool) *BoolValue {
@@ -140,27 +271,3 @@ func Bool(value bool) *BoolValue {
 	}
 	return False
 }
-
-func (v *BoolValue) Expr() ast.Expr {
-	return &ast.Ident{Name: strconv.FormatBool(v.value)}
-}
-
-func (v *BoolValue) Matches(w Value) bool {
-	if w, ok := w.(*BoolValue); ok {
-		return w.value == v.value
-	}
-	return false
-}
-
-func (v *BoolValue) Op(op token.Token, w Value) Value {
-	if w, ok := w.(*BoolValue); ok {
-		vx, wx := v.value, w.value
-		switch op {
-		case token.LAND:
-			return Bool(vx && wx)
-		case token.LOR:
-			return Bool(vx || wx)
-		}
-	}
-	return opExpr(op, v, w)
-}